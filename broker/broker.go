@@ -0,0 +1,514 @@
+// Copyright © 2017 Ray Johnson <ray.johnson@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package broker is a small MQTT 3.1.1 broker.  It is meant for testing
+// on machines that have no broker, not for production use.  It supports
+// QoS 0, 1 and 2, retained messages, wild cards, persistent sessions,
+// wills and publishes $SYS statistics like mosquitto does.
+package broker
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/rayjohnson/zap/topicfilter"
+)
+
+// maxInflight is the most QoS 1 and 2 messages a session can have waiting
+// for an acknowledgement, including those queued while it is offline
+const maxInflight = 1000
+
+// Broker routes messages between the clients connected to it
+type Broker struct {
+	// Version is published as $SYS/broker/version
+	Version string
+	// SysInterval is how often $SYS statistics are published, 0 turns them off
+	SysInterval time.Duration
+
+	mu        sync.Mutex
+	sessions  map[string]*session
+	retained  map[string]*packets.PublishPacket
+	listeners []net.Listener
+	nextID    int
+
+	stats     counters
+	startTime time.Time
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// session is the state the broker keeps for a client id.  Sessions of
+// clients that connect with clean session false outlive the connection.
+type session struct {
+	clientID      string
+	clean         bool
+	conn          *connection
+	subscriptions map[string]byte
+
+	lastMessageID uint16
+	seq           uint64
+	inflight      map[uint16]*outbound
+	// some of inflight did not fit in the queue of the connection and
+	// are sent when there is room
+	backlog bool
+	// QoS 2 messages received but not yet released by the client
+	received map[uint16]bool
+}
+
+// outbound is a QoS 1 or 2 message sent to a client that has not been
+// fully acknowledged yet
+type outbound struct {
+	seq      uint64
+	pub      *packets.PublishPacket
+	released bool // PUBREC received, waiting for PUBCOMP
+	queued   bool // sent on the current connection or waiting in its queue
+}
+
+// New creates a broker that publishes $SYS statistics every 10 seconds
+func New() *Broker {
+	return &Broker{
+		Version:     "zap",
+		SysInterval: 10 * time.Second,
+		sessions:    make(map[string]*session),
+		retained:    make(map[string]*packets.PublishPacket),
+		startTime:   time.Now(),
+		done:        make(chan struct{}),
+	}
+}
+
+// ListenAndServe listens on the TCP address and serves clients until
+// the broker is closed
+func (b *Broker) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return b.Serve(l)
+}
+
+// Serve accepts clients on the listener until the broker is closed
+func (b *Broker) Serve(l net.Listener) error {
+	b.mu.Lock()
+	select {
+	case <-b.done:
+		b.mu.Unlock()
+		l.Close()
+		return nil
+	default:
+	}
+	b.listeners = append(b.listeners, l)
+	first := len(b.listeners) == 1
+	b.mu.Unlock()
+
+	if first && b.SysInterval > 0 {
+		b.wg.Add(1)
+		go b.publishSysStats()
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-b.done:
+				return nil
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		b.stats.add(&b.stats.sockets, 1)
+		c := newConnection(b, conn)
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			c.serve()
+		}()
+	}
+}
+
+// Close stops the listeners, disconnects all clients and waits for
+// everything to shut down
+func (b *Broker) Close() error {
+	b.closeOnce.Do(func() {
+		b.mu.Lock()
+		close(b.done)
+		for _, l := range b.listeners {
+			l.Close()
+		}
+		for _, s := range b.sessions {
+			if s.conn != nil {
+				s.conn.conn.Close()
+			}
+		}
+		b.mu.Unlock()
+	})
+	b.wg.Wait()
+	return nil
+}
+
+// DropClient closes the network connection of a client without a
+// DISCONNECT, as if the network had failed.  It returns false if the
+// client is not connected.
+func (b *Broker) DropClient(clientID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.sessions[clientID]
+	if !ok || s.conn == nil {
+		return false
+	}
+	s.conn.conn.Close()
+	return true
+}
+
+// attach connects a client to its session, creating or resetting the
+// session as needed.  It returns true if an existing session was resumed
+// and a nil session if the broker is closing.
+func (b *Broker) attach(c *connection, clientID string, clean bool) (*session, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	select {
+	case <-b.done:
+		return nil, false
+	default:
+	}
+
+	if clientID == "" {
+		b.nextID++
+		clientID = "zap-broker-" + strconv.Itoa(b.nextID)
+	}
+
+	s, present := b.sessions[clientID]
+	if present && s.conn != nil {
+		// a new connection with the same id takes over the session
+		s.conn.conn.Close()
+	}
+	if !present || clean || s.clean {
+		s = &session{
+			clientID:      clientID,
+			subscriptions: make(map[string]byte),
+			inflight:      make(map[uint16]*outbound),
+			received:      make(map[uint16]bool),
+		}
+		b.sessions[clientID] = s
+		present = false
+	}
+	s.clean = clean
+	s.conn = c
+	c.session = s
+
+	b.stats.add(&b.stats.connections, 1)
+	if connected := b.connectedCount(); connected > b.stats.get(&b.stats.clientsMaximum) {
+		b.stats.set(&b.stats.clientsMaximum, connected)
+	}
+
+	return s, present
+}
+
+// resume resends the messages that were not acknowledged or were queued
+// while the client was offline, in the order they were first sent
+func (b *Broker) resume(s *session) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, out := range s.inflight {
+		out.queued = false
+	}
+	b.sendPending(s)
+}
+
+// retry sends the messages that did not fit in the queue of the
+// connection earlier
+func (b *Broker) retry(c *connection) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if s := c.session; s != nil && s.conn == c {
+		b.sendPending(s)
+	}
+}
+
+// sendPending queues the messages of the session that are not queued on
+// its connection yet, oldest first.  What does not fit is retried when
+// the connection has room.  The caller must hold the broker lock.
+func (b *Broker) sendPending(s *session) {
+	if s.conn == nil {
+		return
+	}
+	var pending []*outbound
+	for _, out := range s.inflight {
+		if !out.queued {
+			pending = append(pending, out)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].seq < pending[j].seq })
+
+	s.backlog = false
+	for _, out := range pending {
+		var pkt packets.ControlPacket
+		if out.released {
+			rel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+			rel.MessageID = out.pub.MessageID
+			pkt = rel
+		} else {
+			pub := copyPublish(out.pub)
+			pub.Dup = out.pub.Dup
+			pkt = pub
+		}
+		if !s.conn.trySend(pkt) {
+			s.backlog = true
+			s.conn.wakeRetry()
+			return
+		}
+		out.pub.Dup = true
+		out.queued = true
+	}
+}
+
+// detach is called when a connection goes away
+func (b *Broker) detach(c *connection) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := c.session
+	if s == nil || s.conn != c {
+		return
+	}
+	s.conn = nil
+	if s.clean {
+		delete(b.sessions, s.clientID)
+	}
+}
+
+func (b *Broker) connectedCount() int64 {
+	var n int64
+	for _, s := range b.sessions {
+		if s.conn != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// subscribe adds the filters to the session and returns the SUBACK
+// return codes and the retained messages that match the new filters
+func (b *Broker) subscribe(s *session, filters []string, qoss []byte) []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	codes := make([]byte, len(filters))
+	for i, filter := range filters {
+		qos := qoss[i]
+		if !validTopicFilter(filter) || qos > 2 {
+			codes[i] = 0x80
+			continue
+		}
+		s.subscriptions[filter] = qos
+		codes[i] = qos
+	}
+	return codes
+}
+
+// sendRetained sends the retained messages matching the filters, which
+// must be called after the SUBACK has been queued
+func (b *Broker) sendRetained(s *session, filters []string, codes []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// a topic matching more than one of the filters is sent once, with
+	// the highest QoS granted
+	granted := make(map[string]byte)
+	for topic := range b.retained {
+		for i, filter := range filters {
+			if codes[i] == 0x80 || !topicfilter.Match(filter, topic) {
+				continue
+			}
+			if qos, ok := granted[topic]; !ok || codes[i] > qos {
+				granted[topic] = codes[i]
+			}
+		}
+	}
+
+	var topics []string
+	for topic := range granted {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	for _, topic := range topics {
+		pub := b.retained[topic]
+		b.deliver(s, pub, minQos(pub.Qos, granted[topic]), true)
+	}
+}
+
+func (b *Broker) unsubscribe(s *session, filters []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, filter := range filters {
+		delete(s.subscriptions, filter)
+	}
+}
+
+// publish stores the message if it is retained and sends it to every
+// session with a matching subscription
+func (b *Broker) publish(pub *packets.PublishPacket) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if pub.Retain {
+		if len(pub.Payload) == 0 {
+			delete(b.retained, pub.TopicName)
+		} else {
+			stored := copyPublish(pub)
+			stored.Qos = pub.Qos
+			b.retained[pub.TopicName] = stored
+		}
+	}
+
+	for _, s := range b.sessions {
+		matched := false
+		var qos byte
+		for filter, subQos := range s.subscriptions {
+			if topicfilter.Match(filter, pub.TopicName) {
+				matched = true
+				if subQos > qos {
+					qos = subQos
+				}
+			}
+		}
+		if matched {
+			// the retain flag is only set when sending to a new subscription
+			b.deliver(s, pub, minQos(pub.Qos, qos), false)
+		}
+	}
+}
+
+// deliver sends a message to a session, or queues it if the session is
+// offline or its connection is not keeping up.  Only QoS 0 messages are
+// dropped when they can not be sent.  The caller must hold the broker lock.
+func (b *Broker) deliver(s *session, msg *packets.PublishPacket, qos byte, retain bool) {
+	pub := copyPublish(msg)
+	pub.Qos = qos
+	pub.Retain = retain
+
+	if qos == 0 {
+		if s.conn == nil || !s.conn.trySend(pub) {
+			b.stats.add(&b.stats.publishDropped, 1)
+		}
+		return
+	}
+
+	if len(s.inflight) >= maxInflight {
+		b.stats.add(&b.stats.publishDropped, 1)
+		return
+	}
+	pub.MessageID = s.newMessageID()
+	s.seq++
+	out := &outbound{seq: s.seq, pub: pub}
+	s.inflight[pub.MessageID] = out
+
+	if s.conn == nil || s.backlog {
+		// sent when the client reconnects, or after the older messages
+		// waiting for room in the queue
+		return
+	}
+	// keep the stored copy untouched by the writer
+	if !s.conn.trySend(copyPublish(pub)) {
+		s.backlog = true
+		s.conn.wakeRetry()
+		return
+	}
+	pub.Dup = true
+	out.queued = true
+}
+
+// acknowledge handles PUBACK, PUBREC and PUBCOMP from a client
+func (b *Broker) acknowledge(s *session, packetType byte, id uint16) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	out, ok := s.inflight[id]
+	if !ok {
+		return
+	}
+	switch packetType {
+	case packets.Puback, packets.Pubcomp:
+		delete(s.inflight, id)
+	case packets.Pubrec:
+		out.released = true
+	}
+}
+
+// receivedQos2 records a QoS 2 message from a client and returns false if
+// it was a resend of one that has not been released yet
+func (b *Broker) receivedQos2(s *session, id uint16) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if s.received[id] {
+		return false
+	}
+	s.received[id] = true
+	return true
+}
+
+func (b *Broker) released(s *session, id uint16) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(s.received, id)
+}
+
+func (s *session) newMessageID() uint16 {
+	for {
+		s.lastMessageID++
+		if s.lastMessageID == 0 {
+			continue
+		}
+		if _, used := s.inflight[s.lastMessageID]; !used {
+			return s.lastMessageID
+		}
+	}
+}
+
+func copyPublish(pub *packets.PublishPacket) *packets.PublishPacket {
+	c := pub.Copy()
+	c.Qos = pub.Qos
+	c.Retain = pub.Retain
+	c.MessageID = pub.MessageID
+	return c
+}
+
+func minQos(a byte, b byte) byte {
+	if a < b {
+		return a
+	}
+	return b
+}
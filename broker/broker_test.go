@@ -0,0 +1,310 @@
+package broker
+
+import (
+	"math"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startBroker(t *testing.T) (*Broker, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	b := New()
+	b.SysInterval = 0
+	go b.Serve(l)
+	return b, "tcp://" + l.Addr().String()
+}
+
+func connect(t *testing.T, server string, id string, configure func(*MQTT.ClientOptions)) MQTT.Client {
+	opts := MQTT.NewClientOptions().AddBroker(server).SetClientID(id)
+	if configure != nil {
+		configure(opts)
+	}
+	client := MQTT.NewClient(opts)
+	token := client.Connect()
+	require.True(t, token.WaitTimeout(5*time.Second), "connect timed out")
+	require.NoError(t, token.Error())
+	return client
+}
+
+func subscribe(t *testing.T, client MQTT.Client, filter string, qos byte) chan MQTT.Message {
+	messages := make(chan MQTT.Message, 100)
+	token := client.Subscribe(filter, qos, func(c MQTT.Client, msg MQTT.Message) {
+		messages <- msg
+	})
+	require.True(t, token.WaitTimeout(5*time.Second), "subscribe timed out")
+	require.NoError(t, token.Error())
+	return messages
+}
+
+func publish(t *testing.T, client MQTT.Client, topic string, qos byte, retained bool, payload string) {
+	token := client.Publish(topic, qos, retained, payload)
+	require.True(t, token.WaitTimeout(5*time.Second), "publish timed out")
+	require.NoError(t, token.Error())
+}
+
+func receive(t *testing.T, messages chan MQTT.Message) MQTT.Message {
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	return nil
+}
+
+func assertNoMessage(t *testing.T, messages chan MQTT.Message) {
+	select {
+	case msg := <-messages:
+		t.Fatalf("unexpected message on %s", msg.Topic())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPublishQos(t *testing.T) {
+	b, server := startBroker(t)
+	defer b.Close()
+
+	sub := connect(t, server, "sub", nil)
+	defer sub.Disconnect(0)
+	pub := connect(t, server, "pub", nil)
+	defer pub.Disconnect(0)
+
+	messages := subscribe(t, sub, "sensors/+/temp", 2)
+	for qos := byte(0); qos <= 2; qos++ {
+		publish(t, pub, "sensors/kitchen/temp", qos, false, "21")
+		msg := receive(t, messages)
+		assert.Equal(t, "sensors/kitchen/temp", msg.Topic())
+		assert.Equal(t, "21", string(msg.Payload()))
+		assert.Equal(t, qos, msg.Qos())
+		assert.False(t, msg.Retained())
+	}
+
+	publish(t, pub, "sensors/kitchen/humidity", 0, false, "40")
+	assertNoMessage(t, messages)
+}
+
+func TestSubscriptionQosDowngrade(t *testing.T) {
+	b, server := startBroker(t)
+	defer b.Close()
+
+	client := connect(t, server, "client", nil)
+	defer client.Disconnect(0)
+
+	messages := subscribe(t, client, "a/#", 1)
+	publish(t, client, "a/b", 2, false, "x")
+	assert.Equal(t, byte(1), receive(t, messages).Qos())
+}
+
+func TestRetained(t *testing.T) {
+	b, server := startBroker(t)
+	defer b.Close()
+
+	client := connect(t, server, "client", nil)
+	defer client.Disconnect(0)
+
+	publish(t, client, "status/a", 1, true, "on")
+	publish(t, client, "status/b", 0, true, "off")
+
+	messages := subscribe(t, client, "status/#", 1)
+	msg := receive(t, messages)
+	assert.Equal(t, "status/a", msg.Topic())
+	assert.True(t, msg.Retained())
+	assert.Equal(t, byte(1), msg.Qos())
+	msg = receive(t, messages)
+	assert.Equal(t, "status/b", msg.Topic())
+	assert.Equal(t, byte(0), msg.Qos())
+
+	// an empty retained message clears it
+	publish(t, client, "status/a", 0, true, "")
+	receive(t, messages)
+	client.Unsubscribe("status/#").Wait()
+	messages = subscribe(t, client, "status/#", 0)
+	assert.Equal(t, "status/b", receive(t, messages).Topic())
+	assertNoMessage(t, messages)
+}
+
+func TestPersistentSession(t *testing.T) {
+	b, server := startBroker(t)
+	defer b.Close()
+
+	persistent := func(opts *MQTT.ClientOptions) {
+		opts.SetCleanSession(false)
+	}
+	client := connect(t, server, "durable", persistent)
+	subscribe(t, client, "queue", 1)
+	client.Disconnect(250)
+
+	pub := connect(t, server, "pub", nil)
+	defer pub.Disconnect(0)
+	publish(t, pub, "queue", 1, false, "while you were out")
+
+	messages := make(chan MQTT.Message, 10)
+	client = connect(t, server, "durable", func(opts *MQTT.ClientOptions) {
+		persistent(opts)
+		opts.SetDefaultPublishHandler(func(c MQTT.Client, msg MQTT.Message) {
+			messages <- msg
+		})
+	})
+	defer client.Disconnect(0)
+	assert.Equal(t, "while you were out", string(receive(t, messages).Payload()))
+}
+
+func TestWill(t *testing.T) {
+	b, server := startBroker(t)
+	defer b.Close()
+
+	watcher := connect(t, server, "watcher", nil)
+	defer watcher.Disconnect(0)
+	messages := subscribe(t, watcher, "clients/+/status", 0)
+
+	raw, err := net.Dial("tcp", server[len("tcp://"):])
+	require.NoError(t, err)
+	connect := []byte{0x10, 0, 0, 4, 'M', 'Q', 'T', 'T', 4, 0x06, 0, 60,
+		0, 1, 'w',
+		0, 16, 'c', 'l', 'i', 'e', 'n', 't', 's', '/', 'w', '/', 's', 't', 'a', 't', 'u', 's',
+		0, 4, 'g', 'o', 'n', 'e'}
+	connect[1] = byte(len(connect) - 2)
+	_, err = raw.Write(connect)
+	require.NoError(t, err)
+	connack := make([]byte, 4)
+	_, err = raw.Read(connack)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x20, 2, 0, 0}, connack)
+
+	// closing without a DISCONNECT sends the will
+	raw.Close()
+	msg := receive(t, messages)
+	assert.Equal(t, "clients/w/status", msg.Topic())
+	assert.Equal(t, "gone", string(msg.Payload()))
+}
+
+func TestSysStats(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	b := New()
+	b.Version = "zap test"
+	b.SysInterval = 50 * time.Millisecond
+	go b.Serve(l)
+	defer b.Close()
+
+	client := connect(t, "tcp://"+l.Addr().String(), "client", nil)
+	defer client.Disconnect(0)
+
+	all := subscribe(t, client, "#", 0)
+	sys := subscribe(t, client, "$SYS/broker/version", 0)
+	assert.Equal(t, "$SYS/broker/version", receive(t, sys).Topic())
+	assertNoMessage(t, all)
+
+	values := b.Stats()
+	assert.Equal(t, "zap test", values["$SYS/broker/version"])
+	assert.Equal(t, "1", values["$SYS/broker/clients/connected"])
+	assert.Equal(t, "2", values["$SYS/broker/subscriptions/count"])
+	assert.Equal(t, "0", values["$SYS/broker/publish/messages/dropped"])
+	assert.Contains(t, values["$SYS/broker/uptime"], "seconds")
+
+	// paho routes on the client side too, so use a new client for the next filter
+	loadClient := connect(t, "tcp://"+l.Addr().String(), "load", nil)
+	defer loadClient.Disconnect(0)
+	sysLoad := subscribe(t, loadClient, "$SYS/broker/load/connections/1min", 0)
+	assert.Equal(t, "$SYS/broker/load/connections/1min", receive(t, sysLoad).Topic())
+}
+
+func TestLoadAverage(t *testing.T) {
+	la := &loadAverage{}
+	la.update(60, time.Minute)
+	assert.InDelta(t, 60*(1-math.Exp(-1)), la.loads[0], 0.001)
+	assert.InDelta(t, 60*(1-math.Exp(-0.2)), la.loads[1], 0.001)
+
+	for i := 0; i < 100; i++ {
+		la.update(60+int64(i+1)*30, time.Minute)
+	}
+	assert.InDelta(t, 30, la.loads[0], 0.001)
+}
+
+// attachTestConnection gives the broker a connected session without a
+// writer, so the test can look at what is queued
+func attachTestConnection(b *Broker, clientID string) (*session, *connection) {
+	c := newConnection(b, nil)
+	s, _ := b.attach(c, clientID, true)
+	return s, c
+}
+
+func queuedPublishes(c *connection) []*packets.PublishPacket {
+	var pubs []*packets.PublishPacket
+	for len(c.out) > 0 {
+		if pub, ok := (<-c.out).(*packets.PublishPacket); ok {
+			pubs = append(pubs, pub)
+		}
+	}
+	return pubs
+}
+
+func TestRetainedOverlappingFilters(t *testing.T) {
+	b := New()
+	s, c := attachTestConnection(b, "client")
+
+	retained := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	retained.TopicName = "a/b"
+	retained.Payload = []byte("on")
+	retained.Qos = 2
+	retained.Retain = true
+	b.publish(retained)
+
+	filters := []string{"a/+", "a/#", "b/#"}
+	codes := b.subscribe(s, filters, []byte{0, 1, 2})
+	b.sendRetained(s, filters, codes)
+
+	pubs := queuedPublishes(c)
+	require.Len(t, pubs, 1)
+	assert.Equal(t, "a/b", pubs[0].TopicName)
+	assert.Equal(t, byte(1), pubs[0].Qos)
+	assert.True(t, pubs[0].Retain)
+	assert.Len(t, s.inflight, 1)
+}
+
+func TestDeliverFullQueue(t *testing.T) {
+	b := New()
+	s, c := attachTestConnection(b, "slow")
+	b.subscribe(s, []string{"q1", "q0"}, []byte{1, 0})
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = "q1"
+	pub.Qos = 1
+	sent := cap(c.out) + 10
+	for i := 0; i < sent; i++ {
+		pub.Payload = []byte(strconv.Itoa(i))
+		b.publish(pub)
+	}
+
+	// QoS 0 is dropped when there is no room
+	pub.TopicName = "q0"
+	pub.Qos = 0
+	b.publish(pub)
+	assert.Equal(t, int64(1), b.stats.get(&b.stats.publishDropped))
+
+	// the QoS 1 messages that did not fit are kept and sent in order once
+	// the writer has made room
+	assert.Len(t, s.inflight, sent)
+	assert.True(t, s.backlog)
+	assert.Len(t, c.retry, 1)
+	first := queuedPublishes(c)
+	assert.Len(t, first, cap(c.out))
+
+	b.retry(c)
+	assert.False(t, s.backlog)
+	rest := queuedPublishes(c)
+	require.Len(t, rest, 10)
+	for i, p := range append(first, rest...) {
+		assert.Equal(t, strconv.Itoa(i), string(p.Payload))
+		assert.False(t, p.Dup)
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright © 2017 Ray Johnson <ray.johnson@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package broker
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/rayjohnson/zap/output"
+)
+
+// connectTimeout is how long a new connection has to send CONNECT
+const connectTimeout = 10 * time.Second
+
+// connection is one network connection from a client
+type connection struct {
+	b       *Broker
+	conn    net.Conn
+	session *session
+
+	keepalive time.Duration
+	will      *packets.PublishPacket
+	out       chan packets.ControlPacket
+	retry     chan struct{}
+	done      chan struct{}
+	written   chan struct{}
+}
+
+func newConnection(b *Broker, conn net.Conn) *connection {
+	return &connection{
+		b:       b,
+		conn:    conn,
+		out:     make(chan packets.ControlPacket, 256),
+		retry:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		written: make(chan struct{}),
+	}
+}
+
+// send queues a packet for the writer, waiting if the queue is full
+func (c *connection) send(pkt packets.ControlPacket) {
+	select {
+	case c.out <- pkt:
+	case <-c.done:
+	}
+}
+
+// trySend queues a packet without waiting and returns false if the
+// client is not keeping up.  It is used while holding the broker lock.
+func (c *connection) trySend(pkt packets.ControlPacket) bool {
+	select {
+	case c.out <- pkt:
+		return true
+	default:
+		return false
+	}
+}
+
+// wakeRetry has the writer send the messages of the session that did not
+// fit in the queue
+func (c *connection) wakeRetry() {
+	select {
+	case c.retry <- struct{}{}:
+	default:
+	}
+}
+
+func (c *connection) serve() {
+	defer c.conn.Close()
+
+	r := bufio.NewReader(countingReader{c.conn, c.b})
+	c.conn.SetReadDeadline(time.Now().Add(connectTimeout))
+	pkt, err := packets.ReadPacket(r)
+	if err != nil {
+		return
+	}
+	c.b.stats.add(&c.b.stats.messagesReceived, 1)
+	connect, ok := pkt.(*packets.ConnectPacket)
+	if !ok {
+		return
+	}
+
+	go c.writer()
+	defer func() {
+		// let the writer send what is queued, like a refused CONNACK
+		c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		close(c.done)
+		<-c.written
+	}()
+
+	if !c.connect(connect) {
+		return
+	}
+	defer c.b.detach(c)
+	output.VERBOSE.Printf("Client %s connected from %s\n", c.session.clientID, c.conn.RemoteAddr())
+
+	graceful := c.readLoop(r)
+	if !graceful && c.will != nil {
+		c.b.publish(c.will)
+	}
+	output.VERBOSE.Printf("Client %s disconnected\n", c.session.clientID)
+}
+
+// connect checks the CONNECT packet and sends the CONNACK
+func (c *connection) connect(connect *packets.ConnectPacket) bool {
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.ReturnCode = connect.Validate()
+	if connack.ReturnCode == packets.Accepted && connect.WillFlag &&
+		(!validTopicName(connect.WillTopic) || connect.WillQos > 2) {
+		connack.ReturnCode = packets.ErrProtocolViolation
+	}
+	if connack.ReturnCode != packets.Accepted {
+		if connack.ReturnCode != packets.ErrProtocolViolation {
+			c.send(connack)
+		}
+		return false
+	}
+
+	if connect.WillFlag {
+		c.will = packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		c.will.TopicName = connect.WillTopic
+		c.will.Payload = connect.WillMessage
+		c.will.Qos = connect.WillQos
+		c.will.Retain = connect.WillRetain
+	}
+	c.keepalive = time.Duration(connect.Keepalive) * time.Second
+
+	s, present := c.b.attach(c, connect.ClientIdentifier, connect.CleanSession)
+	if s == nil {
+		connack.ReturnCode = packets.ErrRefusedServerUnavailable
+		c.send(connack)
+		return false
+	}
+	connack.SessionPresent = present
+	c.send(connack)
+	c.b.resume(s)
+	return true
+}
+
+// readLoop handles packets until the client disconnects and returns
+// true if it sent a DISCONNECT
+func (c *connection) readLoop(r *bufio.Reader) bool {
+	for {
+		if c.keepalive > 0 {
+			// the spec allows one and a half keep alive periods
+			c.conn.SetReadDeadline(time.Now().Add(c.keepalive * 3 / 2))
+		} else {
+			c.conn.SetReadDeadline(time.Time{})
+		}
+
+		pkt, err := packets.ReadPacket(r)
+		if err != nil {
+			return false
+		}
+		c.b.stats.add(&c.b.stats.messagesReceived, 1)
+
+		switch p := pkt.(type) {
+		case *packets.PublishPacket:
+			if !c.handlePublish(p) {
+				return false
+			}
+		case *packets.PubackPacket:
+			c.b.acknowledge(c.session, packets.Puback, p.MessageID)
+		case *packets.PubrecPacket:
+			c.b.acknowledge(c.session, packets.Pubrec, p.MessageID)
+			rel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+			rel.MessageID = p.MessageID
+			c.send(rel)
+		case *packets.PubrelPacket:
+			c.b.released(c.session, p.MessageID)
+			comp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			comp.MessageID = p.MessageID
+			c.send(comp)
+		case *packets.PubcompPacket:
+			c.b.acknowledge(c.session, packets.Pubcomp, p.MessageID)
+		case *packets.SubscribePacket:
+			codes := c.b.subscribe(c.session, p.Topics, p.Qoss)
+			suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			suback.MessageID = p.MessageID
+			suback.ReturnCodes = codes
+			c.send(suback)
+			c.b.sendRetained(c.session, p.Topics, codes)
+		case *packets.UnsubscribePacket:
+			c.b.unsubscribe(c.session, p.Topics)
+			unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			unsuback.MessageID = p.MessageID
+			c.send(unsuback)
+		case *packets.PingreqPacket:
+			c.send(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return true
+		default:
+			// a second CONNECT or a packet only a server sends
+			return false
+		}
+	}
+}
+
+// handlePublish acknowledges and routes a message from the client.  It
+// returns false if the client broke the protocol.
+func (c *connection) handlePublish(p *packets.PublishPacket) bool {
+	if !validTopicName(p.TopicName) || p.Qos > 2 {
+		return false
+	}
+	c.b.stats.add(&c.b.stats.publishReceived, 1)
+
+	// only the broker itself publishes statistics
+	route := !strings.HasPrefix(p.TopicName, "$SYS/")
+
+	switch p.Qos {
+	case 1:
+		ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		ack.MessageID = p.MessageID
+		c.send(ack)
+	case 2:
+		// the message is routed when it first arrives, a resend with the
+		// same id before the PUBREL is only acknowledged again
+		route = route && c.b.receivedQos2(c.session, p.MessageID)
+		rec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		rec.MessageID = p.MessageID
+		c.send(rec)
+	}
+
+	if route {
+		c.b.publish(p)
+	}
+	return true
+}
+
+// writer sends queued packets until the connection is done
+func (c *connection) writer() {
+	defer close(c.written)
+
+	w := bufio.NewWriter(countingWriter{c.conn, c.b})
+	write := func(pkt packets.ControlPacket) error {
+		if err := pkt.Write(w); err != nil {
+			return err
+		}
+		c.b.stats.add(&c.b.stats.messagesSent, 1)
+		if _, ok := pkt.(*packets.PublishPacket); ok {
+			c.b.stats.add(&c.b.stats.publishSent, 1)
+		}
+		return nil
+	}
+
+	for {
+		select {
+		case pkt := <-c.out:
+			if err := write(pkt); err != nil {
+				c.conn.Close()
+				return
+			}
+			// batch up writes while more packets are waiting
+			if len(c.out) == 0 {
+				if err := w.Flush(); err != nil {
+					c.conn.Close()
+					return
+				}
+			}
+		case <-c.retry:
+			c.b.retry(c)
+		case <-c.done:
+			for len(c.out) > 0 {
+				if write(<-c.out) != nil {
+					return
+				}
+			}
+			w.Flush()
+			return
+		}
+	}
+}
+
+type countingReader struct {
+	conn net.Conn
+	b    *Broker
+}
+
+func (cr countingReader) Read(p []byte) (int, error) {
+	n, err := cr.conn.Read(p)
+	cr.b.stats.add(&cr.b.stats.bytesReceived, int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	conn net.Conn
+	b    *Broker
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.conn.Write(p)
+	cw.b.stats.add(&cw.b.stats.bytesSent, int64(n))
+	return n, err
+}
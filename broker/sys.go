@@ -0,0 +1,192 @@
+// Copyright © 2017 Ray Johnson <ray.johnson@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package broker
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// counters are updated from many goroutines so they are only touched
+// through the atomic helpers
+type counters struct {
+	messagesReceived int64
+	messagesSent     int64
+	publishReceived  int64
+	publishSent      int64
+	publishDropped   int64
+	bytesReceived    int64
+	bytesSent        int64
+	sockets          int64
+	connections      int64
+	clientsMaximum   int64
+	heapMaximum      int64
+}
+
+func (c *counters) add(counter *int64, n int64) {
+	atomic.AddInt64(counter, n)
+}
+
+func (c *counters) get(counter *int64) int64 {
+	return atomic.LoadInt64(counter)
+}
+
+func (c *counters) set(counter *int64, n int64) {
+	atomic.StoreInt64(counter, n)
+}
+
+// loadAverage is an exponentially decaying per minute rate over 1, 5 and
+// 15 minutes, computed the same way mosquitto does for $SYS/broker/load
+type loadAverage struct {
+	topic   string
+	counter *int64
+	last    int64
+	loads   [3]float64
+}
+
+var loadWindows = [3]struct {
+	name    string
+	minutes float64
+}{{"1min", 1}, {"5min", 5}, {"15min", 15}}
+
+func (la *loadAverage) update(current int64, interval time.Duration) {
+	perMinute := float64(current-la.last) * float64(time.Minute) / float64(interval)
+	la.last = current
+	for i, window := range loadWindows {
+		decay := math.Exp(-interval.Minutes() / window.minutes)
+		la.loads[i] = perMinute + decay*(la.loads[i]-perMinute)
+	}
+}
+
+// publishSysStats publishes the statistics every SysInterval until the
+// broker is closed
+func (b *Broker) publishSysStats() {
+	defer b.wg.Done()
+
+	loads := []*loadAverage{
+		{topic: "messages/received", counter: &b.stats.messagesReceived},
+		{topic: "messages/sent", counter: &b.stats.messagesSent},
+		{topic: "publish/received", counter: &b.stats.publishReceived},
+		{topic: "publish/sent", counter: &b.stats.publishSent},
+		{topic: "publish/dropped", counter: &b.stats.publishDropped},
+		{topic: "bytes/received", counter: &b.stats.bytesReceived},
+		{topic: "bytes/sent", counter: &b.stats.bytesSent},
+		{topic: "sockets", counter: &b.stats.sockets},
+		{topic: "connections", counter: &b.stats.connections},
+	}
+
+	b.sysStats(loads)
+	ticker := time.NewTicker(b.SysInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, la := range loads {
+				la.update(b.stats.get(la.counter), b.SysInterval)
+			}
+			b.sysStats(loads)
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// sysStats publishes one round of $SYS statistics as retained messages
+func (b *Broker) sysStats(loads []*loadAverage) {
+	values := b.Stats()
+	for _, la := range loads {
+		for i, window := range loadWindows {
+			values["$SYS/broker/load/"+la.topic+"/"+window.name] = fmt.Sprintf("%.2f", la.loads[i])
+		}
+	}
+
+	var topics []string
+	for topic := range values {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	for _, topic := range topics {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = topic
+		pub.Payload = []byte(values[topic])
+		pub.Retain = true
+		b.publish(pub)
+	}
+}
+
+// Stats returns the current $SYS statistics other than the load
+// averages, keyed by topic
+func (b *Broker) Stats() map[string]string {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	heap := int64(mem.HeapAlloc)
+	if heap > b.stats.get(&b.stats.heapMaximum) {
+		b.stats.set(&b.stats.heapMaximum, heap)
+	}
+
+	b.mu.Lock()
+	var connected, disconnected, subscriptions, inflight, stored int64
+	for _, s := range b.sessions {
+		subscriptions += int64(len(s.subscriptions))
+		if s.conn != nil {
+			connected++
+			inflight += int64(len(s.inflight))
+		} else {
+			disconnected++
+			stored += int64(len(s.inflight))
+		}
+	}
+	retained := int64(len(b.retained))
+	b.mu.Unlock()
+
+	itoa := func(n int64) string { return strconv.FormatInt(n, 10) }
+	return map[string]string{
+		"$SYS/broker/version":                   b.Version,
+		"$SYS/broker/uptime":                    itoa(int64(time.Since(b.startTime)/time.Second)) + " seconds",
+		"$SYS/broker/time":                      time.Now().Format(time.RFC3339),
+		"$SYS/broker/clients/total":             itoa(connected + disconnected),
+		"$SYS/broker/clients/connected":         itoa(connected),
+		"$SYS/broker/clients/disconnected":      itoa(disconnected),
+		"$SYS/broker/clients/maximum":           itoa(b.stats.get(&b.stats.clientsMaximum)),
+		"$SYS/broker/clients/expired":           "0",
+		"$SYS/broker/heap/current size":         itoa(heap),
+		"$SYS/broker/heap/maximum size":         itoa(b.stats.get(&b.stats.heapMaximum)),
+		"$SYS/broker/messages/received":         itoa(b.stats.get(&b.stats.messagesReceived)),
+		"$SYS/broker/messages/sent":             itoa(b.stats.get(&b.stats.messagesSent)),
+		"$SYS/broker/messages/inflight":         itoa(inflight),
+		"$SYS/broker/messages/stored":           itoa(retained + stored),
+		"$SYS/broker/messages/publish/received": itoa(b.stats.get(&b.stats.publishReceived)),
+		"$SYS/broker/messages/publish/sent":     itoa(b.stats.get(&b.stats.publishSent)),
+		"$SYS/broker/publish/messages/dropped":  itoa(b.stats.get(&b.stats.publishDropped)),
+		"$SYS/broker/retained messages/count":   itoa(retained),
+		"$SYS/broker/subscriptions/count":       itoa(subscriptions),
+		"$SYS/broker/load/bytes/received":       itoa(b.stats.get(&b.stats.bytesReceived)),
+		"$SYS/broker/load/bytes/sent":           itoa(b.stats.get(&b.stats.bytesSent)),
+	}
+}
@@ -0,0 +1,24 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidTopics(t *testing.T) {
+	assert.True(t, validTopicName("a/b/c"))
+	assert.True(t, validTopicName("/finance"))
+	assert.False(t, validTopicName(""))
+	assert.False(t, validTopicName("a/+/c"))
+	assert.False(t, validTopicName("a/#"))
+
+	assert.True(t, validTopicFilter("#"))
+	assert.True(t, validTopicFilter("a/+/c"))
+	assert.True(t, validTopicFilter("+/+"))
+	assert.True(t, validTopicFilter("a/#"))
+	assert.False(t, validTopicFilter(""))
+	assert.False(t, validTopicFilter("a/#/c"))
+	assert.False(t, validTopicFilter("a/b#"))
+	assert.False(t, validTopicFilter("a+/c"))
+}
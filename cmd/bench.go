@@ -0,0 +1,255 @@
+// Copyright © 2017 Ray Johnson <ray.johnson@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rayjohnson/zap/output"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+type benchOptions struct {
+	clients int
+	count   int
+	size    int
+	rate    float64
+	qos     int
+	topic   string
+}
+
+// benchResults collects what happened to each message across all clients
+type benchResults struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	errors    int
+	lastErr   error
+}
+
+func newBenchCommand() *cobra.Command {
+	var zapOpts *zapOptions
+	benchOpts := &benchOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "bench",
+		Args:  cobra.NoArgs,
+		Short: "Load test an MQTT broker by publishing many messages",
+		Long: `Load test an MQTT broker by publishing many messages
+
+The bench command opens several connections to the broker and publishes
+messages as fast as possible (or at the given rate) on each of them.  When
+done it reports the throughput, the publish latency and any errors.  The
+latency is the time until the publish completes - for qos 1 and 2 that
+includes the acknowledgement from the broker.`,
+		Example: `.nf
+Publish 1000 messages of 1k on each of 10 connections at qos 1:
+.RS
+zap bench \-\-clients 10 \-\-count 1000 \-\-size 1024 \-\-qos 1
+.RE
+.fi`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runBench(cmd.Flags(), zapOpts, benchOpts)
+		},
+		SilenceUsage:      true,
+		DisableAutoGenTag: true,
+	}
+	annotations := make(map[string]string)
+	annotations["man-files-section"] = filesManInfo
+	cmd.Annotations = annotations
+
+	flags := cmd.Flags()
+	flags.IntVar(&benchOpts.clients, "clients", 1, "Number of connections publishing at the same time")
+	flags.IntVar(&benchOpts.count, "count", 100, "Number of messages each connection publishes")
+	flags.IntVar(&benchOpts.size, "size", 100, "Size of each message in bytes")
+	flags.Float64Var(&benchOpts.rate, "rate", 0, "Messages per second for each connection, 0 is as fast as possible")
+	flags.IntVar(&benchOpts.qos, "qos", 0, "The qos setting for outbound messages")
+	flags.StringVar(&benchOpts.topic, "topic", "zap/bench", "Topic prefix, each connection publishes to topic/<number>")
+
+	annotation := []string{"0|1|2"}
+	flags.SetAnnotation("qos", "man-arg-hints", annotation)
+	annotation = []string{"topic path"}
+	flags.SetAnnotation("topic", "man-arg-hints", annotation)
+	annotation = []string{"bytes"}
+	flags.SetAnnotation("size", "man-arg-hints", annotation)
+	annotation = []string{"msgs/sec"}
+	flags.SetAnnotation("rate", "man-arg-hints", annotation)
+
+	zapOpts = buildZapFlags(flags)
+	zapOpts.conOpts = addConnectionFlags(flags)
+
+	return cmd
+}
+
+func (benchOpts *benchOptions) validateOptions() error {
+	if benchOpts.clients < 1 {
+		return fmt.Errorf("--clients must be at least 1")
+	}
+	if benchOpts.count < 1 {
+		return fmt.Errorf("--count must be at least 1")
+	}
+	if benchOpts.size < 0 {
+		return fmt.Errorf("--size can not be negative")
+	}
+	if benchOpts.rate < 0 {
+		return fmt.Errorf("--rate can not be negative")
+	}
+	if benchOpts.rate > 0 && benchOpts.interval() <= 0 {
+		return fmt.Errorf("--rate is too high, use 0 to publish as fast as possible")
+	}
+	if benchOpts.qos < 0 || benchOpts.qos > 2 {
+		return fmt.Errorf("--qos value must or 0, 1 or 2")
+	}
+
+	return nil
+}
+
+func runBench(flags *pflag.FlagSet, zapOpts *zapOptions, benchOpts *benchOptions) error {
+	if err := zapOpts.processOptions(flags); err != nil {
+		return err
+	}
+	if err := benchOpts.validateOptions(); err != nil {
+		return err
+	}
+
+	// connect everyone before starting the clock
+	clients := make([]mqttClient, benchOpts.clients)
+	for i := range clients {
+		clients[i] = zapOpts.newClientWithID(zapOpts.clientOpts.ClientID + "-" + strconv.Itoa(i))
+		if token := clients[i].Connect(); token.Wait() && token.Error() != nil {
+			return fmt.Errorf("could not connect client %d: %s", i, token.Error())
+		}
+		defer clients[i].Disconnect(250)
+	}
+	output.VERBOSE.Printf("Connected %d clients to %s\n", len(clients), zapOpts.clientOpts.Servers[0])
+
+	results := &benchResults{}
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i, client := range clients {
+		wg.Add(1)
+		go func(i int, client mqttClient) {
+			defer wg.Done()
+			benchClient(client, benchOpts, fmt.Sprintf("%s/%d", benchOpts.topic, i), results)
+		}(i, client)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	results.print(benchOpts, elapsed)
+	return nil
+}
+
+// interval is the time between messages of a connection for --rate, 0 is
+// as fast as possible
+func (benchOpts *benchOptions) interval() time.Duration {
+	if benchOpts.rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / benchOpts.rate)
+}
+
+// benchClient publishes all the messages for one connection and waits
+// for them to complete
+func benchClient(client mqttClient, benchOpts *benchOptions, topic string, results *benchResults) {
+	payload := bytes.Repeat([]byte("x"), benchOpts.size)
+
+	var ticker *time.Ticker
+	if interval := benchOpts.interval(); interval > 0 {
+		ticker = time.NewTicker(interval)
+		defer ticker.Stop()
+	}
+
+	var wg sync.WaitGroup
+	for n := 0; n < benchOpts.count; n++ {
+		if ticker != nil {
+			<-ticker.C
+		}
+
+		sent := time.Now()
+		token := client.Publish(topic, byte(benchOpts.qos), false, payload)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token.Wait()
+			results.add(time.Since(sent), token.Error())
+		}()
+	}
+	wg.Wait()
+}
+
+func (results *benchResults) add(latency time.Duration, err error) {
+	results.mu.Lock()
+	defer results.mu.Unlock()
+
+	if err != nil {
+		results.errors++
+		results.lastErr = err
+		return
+	}
+	results.latencies = append(results.latencies, latency)
+}
+
+func (results *benchResults) print(benchOpts *benchOptions, elapsed time.Duration) {
+	sort.Slice(results.latencies, func(i, j int) bool { return results.latencies[i] < results.latencies[j] })
+
+	sent := len(results.latencies)
+	secs := elapsed.Seconds()
+	fmt.Printf("Clients:      %d\n", benchOpts.clients)
+	fmt.Printf("Messages:     %d sent, %d errors\n", sent, results.errors)
+	fmt.Printf("Duration:     %s\n", elapsed.Round(time.Millisecond))
+	if secs > 0 {
+		fmt.Printf("Throughput:   %.1f msgs/sec, %.1f bytes/sec\n", float64(sent)/secs, float64(sent*benchOpts.size)/secs)
+	}
+	if sent > 0 {
+		fmt.Printf("Latency:      min %s, p50 %s, p90 %s, p99 %s, max %s\n",
+			results.latencies[0],
+			percentile(results.latencies, 50),
+			percentile(results.latencies, 90),
+			percentile(results.latencies, 99),
+			results.latencies[sent-1])
+	}
+	if results.lastErr != nil {
+		fmt.Printf("Last error:   %s\n", results.lastErr)
+	}
+}
+
+// percentile returns the p-th percentile of sorted durations using
+// the nearest rank method
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPercentile(t *testing.T) {
+	assert.Equal(t, time.Duration(0), percentile(nil, 50))
+
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, time.Millisecond, percentile(sorted, 0))
+	assert.Equal(t, 50*time.Millisecond, percentile(sorted, 50))
+	assert.Equal(t, 99*time.Millisecond, percentile(sorted, 99))
+	assert.Equal(t, 100*time.Millisecond, percentile(sorted, 100))
+}
+
+func TestValidateBenchOptions(t *testing.T) {
+	benchOpts := &benchOptions{clients: 0, count: 1}
+	assert.Equal(t, "--clients must be at least 1", benchOpts.validateOptions().Error())
+
+	benchOpts = &benchOptions{clients: 1, count: 1, qos: 3}
+	assert.Equal(t, "--qos value must or 0, 1 or 2", benchOpts.validateOptions().Error())
+
+	benchOpts = &benchOptions{clients: 1, count: 1, rate: -1}
+	assert.Equal(t, "--rate can not be negative", benchOpts.validateOptions().Error())
+
+	benchOpts = &benchOptions{clients: 1, count: 1, rate: 2e9}
+	assert.Equal(t, "--rate is too high, use 0 to publish as fast as possible", benchOpts.validateOptions().Error())
+
+	benchOpts = &benchOptions{clients: 1, count: 1, rate: math.Inf(1)}
+	assert.Equal(t, "--rate is too high, use 0 to publish as fast as possible", benchOpts.validateOptions().Error())
+
+	benchOpts = &benchOptions{rate: 1e9}
+	assert.Equal(t, time.Nanosecond, benchOpts.interval())
+	benchOpts = &benchOptions{rate: 4}
+	assert.Equal(t, 250*time.Millisecond, benchOpts.interval())
+
+	benchOpts = &benchOptions{clients: 4, count: 10, size: 1024, rate: 100, qos: 1}
+	assert.Nil(t, benchOpts.validateOptions())
+}
@@ -0,0 +1,131 @@
+// Copyright © 2017 Ray Johnson <ray.johnson@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rayjohnson/zap/broker"
+	"github.com/rayjohnson/zap/output"
+
+	"github.com/spf13/cobra"
+)
+
+type brokerOptions struct {
+	listen      string
+	sysInterval time.Duration
+	verbose     bool
+}
+
+func newBrokerCommand(version string) *cobra.Command {
+	brokerOpts := &brokerOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "broker",
+		Args:  cobra.NoArgs,
+		Short: "Run a minimal MQTT broker for testing",
+		Long: `Run a minimal MQTT broker for testing
+
+The broker command runs a small MQTT 3.1.1 broker in the zap process so
+publish, subscribe and stats can be tried on a machine with no broker.
+It supports QoS 0, 1 and 2, retained messages, wild cards, persistent
+sessions and wills, and publishes $SYS statistics that zap stats can show.
+It has no authentication, TLS or persistence and is not meant for
+production use.  It runs until Ctrl-C is hit.`,
+		Example: `.nf
+Run a broker and watch it from another terminal:
+.RS
+zap broker \-\-listen :1883
+zap stats \-\-server tcp://127.0.0.1:1883
+.RE
+.fi`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runBroker(version, brokerOpts)
+		},
+		SilenceUsage:      true,
+		DisableAutoGenTag: true,
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&brokerOpts.listen, "listen", ":1883", "Address to listen for clients on")
+	flags.DurationVar(&brokerOpts.sysInterval, "sys-interval", 10*time.Second, "Time between $SYS statistics updates, 0 turns them off")
+	flags.BoolVar(&brokerOpts.verbose, "verbose", false, "Log clients connecting and disconnecting")
+
+	annotation := []string{"[host]:port"}
+	flags.SetAnnotation("listen", "man-arg-hints", annotation)
+	annotation = []string{"duration"}
+	flags.SetAnnotation("sys-interval", "man-arg-hints", annotation)
+
+	return cmd
+}
+
+func (brokerOpts *brokerOptions) validateOptions() error {
+	if brokerOpts.listen == "" {
+		return fmt.Errorf("--listen is required")
+	}
+	if brokerOpts.sysInterval < 0 {
+		return fmt.Errorf("--sys-interval can not be negative")
+	}
+
+	return nil
+}
+
+func runBroker(version string, brokerOpts *brokerOptions) error {
+	if err := brokerOpts.validateOptions(); err != nil {
+		return err
+	}
+	if brokerOpts.verbose {
+		output.VERBOSE = log.New(os.Stdout, "", 0)
+	}
+
+	b := broker.New()
+	b.Version = "zap version " + version
+	b.SysInterval = brokerOpts.sysInterval
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+
+	l, err := net.Listen("tcp", brokerOpts.listen)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Broker listening on %s\n", l.Addr())
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- b.Serve(l)
+	}()
+
+	select {
+	case err := <-errChan:
+		b.Close()
+		return err
+	case <-quit:
+	}
+
+	return b.Close()
+}
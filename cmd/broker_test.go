@@ -0,0 +1,20 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateBrokerOptions(t *testing.T) {
+	brokerOpts := &brokerOptions{listen: ":1883", sysInterval: 10 * time.Second}
+	assert.NoError(t, brokerOpts.validateOptions())
+
+	brokerOpts.sysInterval = -time.Second
+	assert.EqualError(t, brokerOpts.validateOptions(), "--sys-interval can not be negative")
+
+	brokerOpts.sysInterval = 0
+	brokerOpts.listen = ""
+	assert.EqualError(t, brokerOpts.validateOptions(), "--listen is required")
+}
@@ -0,0 +1,133 @@
+// Copyright © 2017 Ray Johnson <ray.johnson@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// captureRecord is one line of a capture file written by --record.  The
+// file is JSON lines so it is easy to grep, edit or generate by hand.
+type captureRecord struct {
+	Time     time.Time `json:"time"`
+	Topic    string    `json:"topic"`
+	Payload  string    `json:"payload"`
+	Encoding string    `json:"encoding,omitempty"` // "base64" if the payload is not utf-8 text
+	Qos      byte      `json:"qos"`
+	Retained bool      `json:"retained"`
+}
+
+func newCaptureRecord(msg MQTT.Message, received time.Time) captureRecord {
+	rec := captureRecord{
+		Time:     received,
+		Topic:    msg.Topic(),
+		Qos:      msg.Qos(),
+		Retained: msg.Retained(),
+	}
+
+	payload := msg.Payload()
+	if utf8.Valid(payload) {
+		rec.Payload = string(payload)
+	} else {
+		rec.Payload = base64.StdEncoding.EncodeToString(payload)
+		rec.Encoding = "base64"
+	}
+
+	return rec
+}
+
+// payloadBytes returns the original payload of the record
+func (rec *captureRecord) payloadBytes() ([]byte, error) {
+	if rec.Encoding == "base64" {
+		return base64.StdEncoding.DecodeString(rec.Payload)
+	}
+	return []byte(rec.Payload), nil
+}
+
+// captureWriter appends records to a capture file
+type captureWriter struct {
+	mu  sync.Mutex
+	out io.WriteCloser
+	enc *json.Encoder
+}
+
+func newCaptureWriter(path string) (*captureWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	enc := json.NewEncoder(f)
+	enc.SetEscapeHTML(false)
+	return &captureWriter{out: f, enc: enc}, nil
+}
+
+func (cw *captureWriter) write(rec captureRecord) error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	return cw.enc.Encode(rec)
+}
+
+func (cw *captureWriter) Close() error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	return cw.out.Close()
+}
+
+// readCapture calls fn for each record in a capture file, in order
+func readCapture(path string, fn func(rec captureRecord) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	// payloads can be much bigger than the default 64k line limit
+	scanner.Buffer(make([]byte, 64*1024), 256*1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec captureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testMessage implements MQTT.Message for tests
+type testMessage struct {
+	topic    string
+	payload  []byte
+	qos      byte
+	retained bool
+}
+
+func (m *testMessage) Duplicate() bool   { return false }
+func (m *testMessage) Qos() byte         { return m.qos }
+func (m *testMessage) Retained() bool    { return m.retained }
+func (m *testMessage) Topic() string     { return m.topic }
+func (m *testMessage) MessageID() uint16 { return 0 }
+func (m *testMessage) Payload() []byte   { return m.payload }
+func (m *testMessage) Ack()              {}
+
+func TestCaptureWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	cw, err := newCaptureWriter(path)
+	assert.NoError(t, err)
+
+	now := time.Date(2017, 12, 6, 22, 38, 52, 0, time.UTC)
+	cw.write(newCaptureRecord(&testMessage{topic: "a/b", payload: []byte("hello"), qos: 1, retained: true}, now))
+	cw.write(newCaptureRecord(&testMessage{topic: "a/c", payload: []byte{0xff, 0x00}}, now))
+	assert.NoError(t, cw.Close())
+
+	f, _ := os.Open(path)
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+
+	scanner.Scan()
+	assert.Equal(t, `{"time":"2017-12-06T22:38:52Z","topic":"a/b","payload":"hello","qos":1,"retained":true}`, scanner.Text())
+
+	scanner.Scan()
+	var rec captureRecord
+	assert.NoError(t, json.Unmarshal(scanner.Bytes(), &rec))
+	assert.Equal(t, "base64", rec.Encoding)
+	payload, err := rec.payloadBytes()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0xff, 0x00}, payload)
+
+	var topics []string
+	err = readCapture(path, func(rec captureRecord) error {
+		topics = append(topics, rec.Topic)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a/b", "a/c"}, topics)
+}
@@ -0,0 +1,182 @@
+// Copyright © 2017 Ray Johnson <ray.johnson@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v4"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// payloadDecoder turns the raw payload of a message into the value
+// the template engine sees as .Decoded
+type payloadDecoder func(payload []byte) (interface{}, error)
+
+var decoderNames = []string{"json", "text", "hex", "base64", "msgpack", "cbor", "protobuf"}
+
+// newPayloadDecoder returns the decoder for the --decode option.  The
+// protobuf decoder needs the descriptor set and message name.
+func newPayloadDecoder(name string, protoDescriptor string, protoMessage string) (payloadDecoder, error) {
+	switch name {
+	case "", "json":
+		return decodeJSON, nil
+	case "text":
+		return decodeText, nil
+	case "hex":
+		return decodeHex, nil
+	case "base64":
+		return decodeBase64, nil
+	case "msgpack":
+		return decodeMsgpack, nil
+	case "cbor":
+		return decodeCBOR, nil
+	case "protobuf":
+		return newProtobufDecoder(protoDescriptor, protoMessage)
+	}
+
+	return nil, fmt.Errorf("--decode must be one of %s", strings.Join(decoderNames, ", "))
+}
+
+func decodeJSON(payload []byte) (interface{}, error) {
+	var v interface{}
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func decodeText(payload []byte) (interface{}, error) {
+	if !utf8.Valid(payload) {
+		return nil, fmt.Errorf("payload is not valid utf-8 text")
+	}
+	return string(payload), nil
+}
+
+// decodeHex decodes a payload that was sent as hex text
+func decodeHex(payload []byte) (interface{}, error) {
+	data, err := hex.DecodeString(strings.TrimSpace(string(payload)))
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// decodeBase64 decodes a payload that was sent as base64 text
+func decodeBase64(payload []byte) (interface{}, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(payload)))
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func decodeMsgpack(payload []byte) (interface{}, error) {
+	var v interface{}
+	if err := msgpack.Unmarshal(payload, &v); err != nil {
+		return nil, err
+	}
+	return normalizeDecoded(v), nil
+}
+
+func decodeCBOR(payload []byte) (interface{}, error) {
+	var v interface{}
+	if err := cbor.Unmarshal(payload, &v); err != nil {
+		return nil, err
+	}
+	return normalizeDecoded(v), nil
+}
+
+func newProtobufDecoder(protoDescriptor string, protoMessage string) (payloadDecoder, error) {
+	if protoDescriptor == "" || protoMessage == "" {
+		return nil, fmt.Errorf("--decode protobuf requires --proto-descriptor and --proto-message")
+	}
+
+	buf, err := ioutil.ReadFile(protoDescriptor)
+	if err != nil {
+		return nil, err
+	}
+	fdSet := &descriptorpb.FileDescriptorSet{}
+	if err = proto.Unmarshal(buf, fdSet); err != nil {
+		return nil, fmt.Errorf("could not read descriptor set %s: %s", protoDescriptor, err)
+	}
+	files, err := protodesc.NewFiles(fdSet)
+	if err != nil {
+		return nil, fmt.Errorf("could not read descriptor set %s: %s", protoDescriptor, err)
+	}
+	desc, err := files.FindDescriptorByName(protoreflect.FullName(protoMessage))
+	if err != nil {
+		return nil, fmt.Errorf("message %s not found in %s", protoMessage, protoDescriptor)
+	}
+	msgDesc, ok := desc.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a message in %s", protoMessage, protoDescriptor)
+	}
+
+	return func(payload []byte) (interface{}, error) {
+		msg := dynamicpb.NewMessage(msgDesc)
+		if err := proto.Unmarshal(payload, msg); err != nil {
+			return nil, err
+		}
+		// go through json so templates see the same maps as for --decode json
+		data, err := protojson.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		return decodeJSON(data)
+	}, nil
+}
+
+// normalizeDecoded converts maps with non-string keys, as produced by
+// msgpack and cbor, into the map[string]interface{} that json produces
+func normalizeDecoded(v interface{}) interface{} {
+	switch node := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(node))
+		for key, value := range node {
+			m[fmt.Sprint(key)] = normalizeDecoded(value)
+		}
+		return m
+	case map[string]interface{}:
+		for key, value := range node {
+			node[key] = normalizeDecoded(value)
+		}
+		return node
+	case []interface{}:
+		for i, value := range node {
+			node[i] = normalizeDecoded(value)
+		}
+		return node
+	}
+	return v
+}
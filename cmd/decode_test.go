@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+func decodeWith(t *testing.T, name string, payload []byte) (interface{}, error) {
+	decoder, err := newPayloadDecoder(name, "", "")
+	assert.NoError(t, err)
+	return decoder(payload)
+}
+
+func TestDecoders(t *testing.T) {
+	v, err := decodeWith(t, "json", []byte(`{"a": 1}`))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"a": 1.0}, v)
+
+	_, err = decodeWith(t, "json", []byte("not json"))
+	assert.Error(t, err)
+
+	v, err = decodeWith(t, "text", []byte("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", v)
+
+	_, err = decodeWith(t, "text", []byte{0xff, 0xfe})
+	assert.Equal(t, "payload is not valid utf-8 text", err.Error())
+
+	v, err = decodeWith(t, "hex", []byte("68656c6c6f\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", v)
+
+	v, err = decodeWith(t, "base64", []byte("aGVsbG8="))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", v)
+
+	payload, _ := msgpack.Marshal(map[string]interface{}{"temp": 31, "tags": []string{"a"}})
+	v, err = decodeWith(t, "msgpack", payload)
+	assert.NoError(t, err)
+	m := v.(map[string]interface{})
+	assert.EqualValues(t, 31, m["temp"])
+	assert.Equal(t, []interface{}{"a"}, m["tags"])
+
+	payload, _ = cbor.Marshal(map[int]string{1: "one"})
+	v, err = decodeWith(t, "cbor", payload)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"1": "one"}, v)
+}
+
+func TestBadDecoder(t *testing.T) {
+	_, err := newPayloadDecoder("xml", "", "")
+	assert.Equal(t, "--decode must be one of json, text, hex, base64, msgpack, cbor, protobuf", err.Error(), "error message not right")
+
+	_, err = newPayloadDecoder("protobuf", "", "")
+	assert.Equal(t, "--decode protobuf requires --proto-descriptor and --proto-message", err.Error(), "error message not right")
+
+	_, err = newPayloadDecoder("protobuf", "noFile", "my.Message")
+	assert.Equal(t, "open noFile: no such file or directory", err.Error(), "error message not right")
+}
+
+func TestProtobufDecoder(t *testing.T) {
+	decoder, err := newPayloadDecoder("protobuf", "testdata/reading.pb", "zap.test.Reading")
+	assert.NoError(t, err)
+
+	// sensor: "kitchen", temp: 21.5, count: 3, tags: ["a", "b"]
+	payload := []byte{
+		0x0a, 0x07, 'k', 'i', 't', 'c', 'h', 'e', 'n',
+		0x11, 0x00, 0x00, 0x00, 0x00, 0x00, 0x80, 0x35, 0x40,
+		0x18, 0x03,
+		0x22, 0x01, 'a',
+		0x22, 0x01, 'b',
+	}
+	v, err := decoder(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"sensor": "kitchen",
+		"temp":   21.5,
+		"count":  3.0,
+		"tags":   []interface{}{"a", "b"},
+	}, v)
+
+	_, err = decoder([]byte{0x0a, 0x07, 'k'})
+	assert.Error(t, err)
+
+	_, err = newPayloadDecoder("protobuf", "testdata/reading.pb", "zap.test.Missing")
+	assert.Equal(t, "message zap.test.Missing not found in testdata/reading.pb", err.Error(), "error message not right")
+
+	_, err = newPayloadDecoder("protobuf", "testdata/reading.proto", "zap.test.Reading")
+	assert.Error(t, err)
+}
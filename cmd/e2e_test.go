@@ -0,0 +1,537 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rayjohnson/zap/broker"
+	"github.com/rayjohnson/zap/viewstats"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The tests in this file run the commands against an in-process broker
+// to check messages really flow, not just that the flags parse.
+
+type e2eHarness struct {
+	t      *testing.T
+	broker *broker.Broker
+	server string
+	config string
+	runs   int32
+}
+
+func newE2EHarness(t *testing.T, sysInterval time.Duration) *e2eHarness {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	b := broker.New()
+	b.Version = "zap e2e"
+	b.SysInterval = sysInterval
+	go b.Serve(l)
+
+	// an empty config file so the user's ~/.zap.toml is not used
+	config, err := ioutil.TempFile("", "zap-e2e")
+	require.NoError(t, err)
+	config.Close()
+
+	return &e2eHarness{t: t, broker: b, server: "tcp://" + l.Addr().String(), config: config.Name()}
+}
+
+func (h *e2eHarness) Close() {
+	h.broker.Close()
+	os.Remove(h.config)
+}
+
+// run executes a zap command against the broker.  Every run gets its own
+// client id as the default one is the same for the whole process.
+func (h *e2eHarness) run(cmd *cobra.Command, args ...string) error {
+	id := fmt.Sprintf("e2e-%d", atomic.AddInt32(&h.runs, 1))
+	cmd.SetArgs(append([]string{"--server", h.server, "--config", h.config, "--id", id}, args...))
+	cmd.SetOutput(ioutil.Discard)
+	return cmd.Execute()
+}
+
+// start runs a zap command in the background, the returned channel gets
+// its result
+func (h *e2eHarness) start(cmd *cobra.Command, args ...string) chan error {
+	result := make(chan error, 1)
+	go func() {
+		result <- h.run(cmd, args...)
+	}()
+	return result
+}
+
+func (h *e2eHarness) publish(args ...string) {
+	require.NoError(h.t, h.run(newPublishCommand(), args...))
+}
+
+// waitForStat waits until a $SYS statistic of the broker has the value
+func (h *e2eHarness) waitForStat(topic string, value string) {
+	waitFor(h.t, topic+" == "+value, func() bool {
+		return h.broker.Stats()[topic] == value
+	})
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func waitForResult(t *testing.T, result chan error) error {
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("command did not finish")
+	}
+	return nil
+}
+
+func nextConnection(t *testing.T, connections chan bool) bool {
+	select {
+	case isConnected := <-connections:
+		return isConnected
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection did not change")
+	}
+	return false
+}
+
+// stdoutCapture collects what the commands print to stdout
+type stdoutCapture struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	stdout *os.File
+	w      *os.File
+	done   chan struct{}
+}
+
+func captureStdout(t *testing.T) *stdoutCapture {
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+
+	c := &stdoutCapture{stdout: os.Stdout, w: w, done: make(chan struct{})}
+	os.Stdout = w
+	go func() {
+		defer close(c.done)
+		buf := make([]byte, 4096)
+		for {
+			n, err := r.Read(buf)
+			c.mu.Lock()
+			c.buf.Write(buf[:n])
+			c.mu.Unlock()
+			if err == io.EOF {
+				return
+			}
+		}
+	}()
+	return c
+}
+
+func (c *stdoutCapture) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.String()
+}
+
+// stop restores stdout and returns everything that was printed
+func (c *stdoutCapture) stop() string {
+	os.Stdout = c.stdout
+	c.w.Close()
+	<-c.done
+	return c.String()
+}
+
+const e2eTemplate = "{{.Topic}} {{.Message}}\n"
+
+func TestE2EPublishSubscribe(t *testing.T) {
+	h := newE2EHarness(t, 0)
+	defer h.Close()
+
+	out := captureStdout(t)
+	result := h.start(newSubscribeCommand(), "--topic", "e2e/#", "--qos", "1", "--count", "3", "--template", e2eTemplate)
+	h.waitForStat("$SYS/broker/subscriptions/count", "1")
+
+	for _, msg := range []string{"one", "two", "three", "four"} {
+		h.publish("--topic", "e2e/"+msg, "--qos", "1", "-m", msg)
+	}
+	assert.NoError(t, waitForResult(t, result))
+
+	// --count stops after three messages
+	assert.Equal(t, "e2e/one one\ne2e/two two\ne2e/three three\n", out.stop())
+}
+
+func TestE2ESkipRetained(t *testing.T) {
+	h := newE2EHarness(t, 0)
+	defer h.Close()
+
+	h.publish("--topic", "e2e/status", "--retain", "-m", "retained")
+
+	out := captureStdout(t)
+	result := h.start(newSubscribeCommand(), "--topic", "e2e/#", "--count", "1", "--template", e2eTemplate)
+	assert.NoError(t, waitForResult(t, result))
+	assert.Equal(t, "e2e/status retained\n", out.stop())
+	h.waitForStat("$SYS/broker/subscriptions/count", "0")
+
+	out = captureStdout(t)
+	result = h.start(newSubscribeCommand(), "--topic", "e2e/#", "--count", "1", "--skip-retained", "--template", e2eTemplate)
+	h.waitForStat("$SYS/broker/subscriptions/count", "1")
+	h.publish("--topic", "e2e/status", "-m", "live")
+	assert.NoError(t, waitForResult(t, result))
+	assert.Equal(t, "e2e/status live\n", out.stop())
+}
+
+func TestE2ESubscribeReconnect(t *testing.T) {
+	h := newE2EHarness(t, 0)
+	defer h.Close()
+
+	out := captureStdout(t)
+	result := h.start(newSubscribeCommand(), "--id", "e2e-sub", "--clean-session=false",
+		"--topic", "e2e/queue", "--qos", "1", "--count", "2", "--template", e2eTemplate)
+	h.waitForStat("$SYS/broker/subscriptions/count", "1")
+
+	h.publish("--topic", "e2e/queue", "--qos", "1", "-m", "before")
+	waitFor(t, "first message", func() bool { return strings.Contains(out.String(), "before") })
+
+	// the session survives the network failure so the subscription does too
+	require.True(t, h.broker.DropClient("e2e-sub"))
+	h.publish("--topic", "e2e/queue", "--qos", "1", "-m", "after")
+
+	assert.NoError(t, waitForResult(t, result))
+	assert.Equal(t, "e2e/queue before\ne2e/queue after\n", out.stop())
+}
+
+func TestE2EStats(t *testing.T) {
+	h := newE2EHarness(t, 20*time.Millisecond)
+	defer h.Close()
+
+	// replace the terminal display with one that records connection changes
+	done := make(chan struct{})
+	connections := make(chan bool, 16)
+	defer func(display func(chan viewstats.ConnectHandler)) { statsDisplay = display }(statsDisplay)
+	statsDisplay = func(connectionChan chan viewstats.ConnectHandler) {
+		forward := make(chan viewstats.ConnectHandler, 16)
+		go func() {
+			for {
+				select {
+				case conn := <-connectionChan:
+					connections <- conn.IsConnected
+					forward <- conn
+				case <-done:
+					return
+				}
+			}
+		}()
+		viewstats.CollectStats(forward, done)
+	}
+
+	// clear what earlier tests collected
+	viewstats.PrepViewer()
+	result := h.start(newStatsCommand(), "--id", "e2e-stats")
+	waitFor(t, "broker version", func() bool { return viewstats.GetStat(0, "Broker Version") == "zap e2e" })
+	waitFor(t, "clients connected", func() bool { return viewstats.GetStat(0, "Clients Connected") == "1" })
+	assert.True(t, nextConnection(t, connections))
+
+	// stats keep coming after the connection is lost and comes back
+	require.True(t, h.broker.DropClient("e2e-stats"))
+	assert.False(t, nextConnection(t, connections))
+	assert.True(t, nextConnection(t, connections))
+	sent := viewstats.GetStat(0, "Messages Sent")
+	waitFor(t, "stats after reconnect", func() bool { return viewstats.GetStat(0, "Messages Sent") != sent })
+
+	close(done)
+	assert.NoError(t, waitForResult(t, result))
+}
+
+func TestE2EStatsOnce(t *testing.T) {
+	h := newE2EHarness(t, 20*time.Millisecond)
+	defer h.Close()
+
+	viewstats.PrepViewer()
+	out := captureStdout(t)
+	assert.NoError(t, h.run(newStatsCommand(), "--once", "--format", "prometheus"))
+	metrics := out.stop()
+	assert.Contains(t, metrics, "\nmqtt_broker_info{version=\"zap e2e\"} 1\n")
+	assert.Contains(t, metrics, "\nmqtt_broker_clients_connected 1\n")
+	assert.Contains(t, metrics, "\nmqtt_broker_load_sockets_15min ")
+}
+
+func TestE2EStatsOnceTimeout(t *testing.T) {
+	// the broker publishes no $SYS stats at all
+	h := newE2EHarness(t, 0)
+	defer h.Close()
+
+	viewstats.PrepViewer()
+	err := h.run(newStatsCommand(), "--once", "--timeout", "200ms")
+	assert.EqualError(t, err, "no stats received from the broker within 200ms")
+}
+
+func TestE2EStatsServe(t *testing.T) {
+	h := newE2EHarness(t, 20*time.Millisecond)
+	defer h.Close()
+
+	// find a free port for the metrics
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	quit := make(chan chan<- os.Signal, 1)
+	defer func(notify func(chan<- os.Signal)) { notifyQuit = notify }(notifyQuit)
+	notifyQuit = func(c chan<- os.Signal) { quit <- c }
+
+	viewstats.PrepViewer()
+	out := captureStdout(t)
+	result := h.start(newStatsCommand(), "--serve", addr)
+
+	var metrics string
+	waitFor(t, "metrics", func() bool {
+		resp, err := http.Get("http://" + addr + "/metrics")
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		metrics = string(body)
+		return strings.Contains(metrics, "mqtt_broker_load_sockets_1min")
+	})
+	assert.Contains(t, metrics, "\nmqtt_broker_connected 1\n")
+	assert.Contains(t, metrics, "\nmqtt_broker_info{version=\"zap e2e\"} 1\n")
+
+	(<-quit) <- syscall.SIGTERM
+	assert.NoError(t, waitForResult(t, result))
+	assert.Equal(t, "Serving metrics on http://"+addr+"/metrics\n", out.stop())
+}
+
+func TestE2EStatsManyBrokers(t *testing.T) {
+	h1 := newE2EHarness(t, 20*time.Millisecond)
+	defer h1.Close()
+	h2 := newE2EHarness(t, 20*time.Millisecond)
+	defer h2.Close()
+
+	config, err := ioutil.TempFile("", "zap-e2e")
+	require.NoError(t, err)
+	defer os.Remove(config.Name())
+	fmt.Fprintf(config, "[one]\nserver = \"%s\"\n[two]\nserver = \"%s\"\n", h1.server, h2.server)
+	config.Close()
+
+	out := captureStdout(t)
+	cmd := newStatsCommand()
+	cmd.SetArgs([]string{"--config", config.Name(), "--id", "e2e-many", "-b", "one", "-b", "two", "--once", "--format", "prometheus"})
+	cmd.SetOutput(ioutil.Discard)
+	assert.NoError(t, cmd.Execute())
+	metrics := out.stop()
+	assert.Contains(t, metrics, "\nmqtt_broker_info{broker=\"one\",version=\"zap e2e\"} 1\n")
+	assert.Contains(t, metrics, "\nmqtt_broker_info{broker=\"two\",version=\"zap e2e\"} 1\n")
+	assert.Contains(t, metrics, "\nmqtt_broker_clients_connected{broker=\"one\"} 1\nmqtt_broker_clients_connected{broker=\"two\"} 1\n")
+}
+
+func TestE2EStatsBrokerDown(t *testing.T) {
+	h := newE2EHarness(t, 20*time.Millisecond)
+	defer h.Close()
+
+	// nothing listens on the port of the second broker
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	down := "tcp://" + l.Addr().String()
+	l.Close()
+
+	config, err := ioutil.TempFile("", "zap-e2e")
+	require.NoError(t, err)
+	defer os.Remove(config.Name())
+	fmt.Fprintf(config, "[up]\nserver = \"%s\"\n[down]\nserver = \"%s\"\n", h.server, down)
+	config.Close()
+
+	cmd := newStatsCommand()
+	cmd.SetArgs([]string{"--config", config.Name(), "--id", "e2e-down", "-b", "up", "-b", "down", "--once", "--timeout", "200ms"})
+	cmd.SetOutput(ioutil.Discard)
+	assert.EqualError(t, cmd.Execute(), "no stats received from broker down within 200ms")
+}
+
+func TestE2EExploreReconnect(t *testing.T) {
+	h := newE2EHarness(t, 0)
+	defer h.Close()
+
+	connections := make(chan bool, 16)
+	stop := make(chan struct{})
+	defer func(explorer func(chan viewstats.ConnectHandler, func(string) string)) { startExplorer = explorer }(startExplorer)
+	startExplorer = func(connectionChan chan viewstats.ConnectHandler, format func(string) string) {
+		for {
+			select {
+			case conn := <-connectionChan:
+				connections <- conn.IsConnected
+			case <-stop:
+				return
+			}
+		}
+	}
+
+	result := h.start(newExploreCommand(), "--id", "e2e-explore")
+	assert.True(t, nextConnection(t, connections))
+	h.waitForStat("$SYS/broker/subscriptions/count", "1")
+
+	// the clean session loses the subscription, it is made again on reconnect
+	require.True(t, h.broker.DropClient("e2e-explore"))
+	assert.False(t, nextConnection(t, connections))
+	assert.True(t, nextConnection(t, connections))
+	h.waitForStat("$SYS/broker/subscriptions/count", "1")
+
+	close(stop)
+	assert.NoError(t, waitForResult(t, result))
+}
+
+func TestE2ERetained(t *testing.T) {
+	h := newE2EHarness(t, 0)
+	defer h.Close()
+
+	h.publish("--topic", "site/a/status", "--retain", "-m", "up")
+	h.publish("--topic", "site/b/status", "--retain", "-m", "down")
+	h.publish("--topic", "other", "--retain", "-m", "keep")
+	h.publish("--topic", "site/live", "-m", "not retained")
+
+	out := captureStdout(t)
+	assert.NoError(t, h.run(newRetainedListCommand(), "site/#", "--wait", "100ms"))
+	assert.Equal(t, "site\n  a\n    status (2 B)\n  b\n    status (4 B)\n2 retained messages, 6 B\n", out.stop())
+
+	out = captureStdout(t)
+	assert.NoError(t, h.run(newRetainedClearCommand(), "site/#", "--wait", "100ms", "--dry-run"))
+	assert.Equal(t, "would clear site/a/status\nwould clear site/b/status\n2 retained messages would be cleared\n", out.stop())
+	h.waitForStat("$SYS/broker/retained messages/count", "3")
+
+	out = captureStdout(t)
+	assert.NoError(t, h.run(newRetainedClearCommand(), "site/#", "--wait", "100ms"))
+	assert.Equal(t, "cleared site/a/status\ncleared site/b/status\n2 retained messages cleared\n", out.stop())
+	h.waitForStat("$SYS/broker/retained messages/count", "1")
+}
+
+func TestE2ERequestIgnoresRetained(t *testing.T) {
+	h := newE2EHarness(t, 0)
+	defer h.Close()
+
+	h.publish("--topic", "e2e/reply", "--retain", "-m", "stale")
+
+	err := h.run(newRequestCommand(), "--topic", "e2e/cmd", "--response-topic", "e2e/reply", "-m", "status", "--timeout", "300ms")
+	assert.EqualError(t, err, "no response on e2e/reply after 300ms")
+}
+
+func TestE2ENoReconnectWithProtocolVersion5(t *testing.T) {
+	h := newE2EHarness(t, 0)
+	defer h.Close()
+
+	err := h.run(newStatsCommand(), "--protocol-version", "5", "--once")
+	assert.EqualError(t, err, "--protocol-version 5 can not be used with stats as the MQTT 5 client does not reconnect")
+
+	err = h.run(newExploreCommand(), "--protocol-version", "5", "--topic", "#")
+	assert.EqualError(t, err, "--protocol-version 5 can not be used with explore as the MQTT 5 client does not reconnect")
+}
+
+func TestE2EReplayInterrupted(t *testing.T) {
+	h := newE2EHarness(t, 0)
+	defer h.Close()
+
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	require.NoError(t, ioutil.WriteFile(path, []byte(
+		`{"time":"2017-12-06T22:38:52Z","topic":"e2e/a","payload":"one","qos":1,"retained":false}`+"\n"+
+			`{"time":"2017-12-06T22:38:52.02Z","topic":"e2e/b","payload":"two","qos":1,"retained":false}`+"\n"), 0644))
+
+	quit := make(chan chan<- os.Signal, 1)
+	defer func(notify func(chan<- os.Signal)) { notifyQuit = notify }(notifyQuit)
+	notifyQuit = func(c chan<- os.Signal) { quit <- c }
+
+	out := captureStdout(t)
+	result := h.start(newReplayCommand(), path, "--loop")
+	waitFor(t, "the capture to loop", func() bool {
+		received, _ := strconv.Atoi(h.broker.Stats()["$SYS/broker/messages/received"])
+		return received > 2
+	})
+
+	(<-quit) <- syscall.SIGTERM
+	assert.NoError(t, waitForResult(t, result))
+	assert.Equal(t, "signal received, exiting\n", out.stop())
+	h.waitForStat("$SYS/broker/clients/connected", "0")
+}
+
+func TestE2EStatsCheck(t *testing.T) {
+	h := newE2EHarness(t, 20*time.Millisecond)
+	defer h.Close()
+
+	require.NoError(t, ioutil.WriteFile(h.config, []byte("[stats-alerts]\nwarning = [\"clients.connected < 10\"]\n"), 0600))
+	viewstats.PrepViewer()
+	out := captureStdout(t)
+	err := h.run(newStatsCommand(), "--check")
+	assert.Equal(t, &exitError{checkWarning}, err)
+	assert.Equal(t, "MQTT WARNING - clients.connected < 10 (is 1) | clients_connected=1 reconnects=0\n", out.stop())
+
+	require.NoError(t, ioutil.WriteFile(h.config, []byte("[stats-alerts]\ncritical = [\"clients.connected > 10\"]\n"), 0600))
+	out = captureStdout(t)
+	assert.NoError(t, h.run(newStatsCommand(), "--check"))
+	assert.Equal(t, "MQTT OK - all stats alerts passed | clients_connected=1 reconnects=0\n", out.stop())
+
+	require.NoError(t, ioutil.WriteFile(h.config, nil, 0600))
+	out = captureStdout(t)
+	assert.Equal(t, &exitError{checkUnknown}, h.run(newStatsCommand(), "--check"))
+	assert.Equal(t, "MQTT UNKNOWN - there are no stats-alerts rules in the config file\n", out.stop())
+
+	// a broken config file or bad options are UNKNOWN too
+	require.NoError(t, ioutil.WriteFile(h.config, []byte("[stats-alerts]\nwarning = [\"clients.connected <\"]\n"), 0600))
+	out = captureStdout(t)
+	assert.Equal(t, &exitError{checkUnknown}, h.run(newStatsCommand(), "--check"))
+	assert.Equal(t, "MQTT UNKNOWN - stats alert \"clients.connected <\" must look like clients.connected < 10\n", out.stop())
+
+	out = captureStdout(t)
+	assert.Equal(t, &exitError{checkUnknown}, h.run(newStatsCommand(), "--check", "--once"))
+	assert.Equal(t, "MQTT UNKNOWN - only one of --once, --check, --serve or --no-ui can be used\n", out.stop())
+}
+
+func TestE2EStatsLog(t *testing.T) {
+	h := newE2EHarness(t, 20*time.Millisecond)
+	defer h.Close()
+
+	dir, err := ioutil.TempDir("", "zap-e2e")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.jsonl")
+
+	quit := make(chan chan<- os.Signal, 1)
+	defer func(notify func(chan<- os.Signal)) { notifyQuit = notify }(notifyQuit)
+	notifyQuit = func(c chan<- os.Signal) { quit <- c }
+
+	viewstats.PrepViewer()
+	result := h.start(newStatsCommand(), "--no-ui", "--log", path, "--interval", "50ms")
+	waitFor(t, "two lines logged", func() bool {
+		data, _ := ioutil.ReadFile(path)
+		return strings.Count(string(data), "\n") >= 2
+	})
+
+	(<-quit) <- syscall.SIGTERM
+	assert.NoError(t, waitForResult(t, result))
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	line := strings.SplitN(string(data), "\n", 2)[0]
+	var values map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(line), &values))
+	assert.Equal(t, "zap e2e", values["version"])
+	assert.Contains(t, values, "timestamp")
+}
@@ -0,0 +1,171 @@
+// Copyright © 2017 Ray Johnson <ray.johnson@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rayjohnson/zap/output"
+	"github.com/rayjohnson/zap/viewstats"
+	"github.com/rayjohnson/zap/viewtopics"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+type exploreOptions struct {
+	topic string
+	qos   int
+}
+
+func newExploreCommand() *cobra.Command {
+	var zapOpts *zapOptions
+	exploreOpts := &exploreOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "explore",
+		Args:  cobra.NoArgs,
+		Short: "Browse a live tree of the topics on the broker",
+		Long: `Browse a live tree of the topics on the broker
+
+The explore command subscribes to a topic filter and shows every topic it
+sees as a tree with the number of messages, the rate over the last ten
+seconds and R for topics with a retained message.  The last payload of the
+selected topic is shown on the right, pretty printed if it is JSON.
+
+Use the arrow keys (or h, j, k and l) to move around, enter or space to
+open and close a level, e and c to expand or collapse everything and q to
+quit.`,
+		Example: `.nf
+Explore everything under home:
+.RS
+zap explore \-\-topic 'home/#'
+.RE
+.fi`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runExplore(cmd.Flags(), zapOpts, exploreOpts)
+		},
+		SilenceUsage:      true,
+		DisableAutoGenTag: true,
+	}
+	annotations := make(map[string]string)
+	annotations["man-files-section"] = filesManInfo
+	cmd.Annotations = annotations
+
+	flags := cmd.Flags()
+	flags.StringVar(&exploreOpts.topic, "topic", "#", "The topic filter to explore")
+	flags.IntVar(&exploreOpts.qos, "qos", 0, "The qos setting for inbound messages")
+
+	annotation := []string{"topic path"}
+	flags.SetAnnotation("topic", "man-arg-hints", annotation)
+	annotation = []string{"0|1|2"}
+	flags.SetAnnotation("qos", "man-arg-hints", annotation)
+
+	zapOpts = buildZapFlags(flags)
+	zapOpts.conOpts = addConnectionFlags(flags)
+
+	return cmd
+}
+
+func (exploreOpts *exploreOptions) validateOptions() error {
+	if exploreOpts.topic == "" {
+		return fmt.Errorf("--topic is required")
+	}
+	if exploreOpts.qos < 0 || exploreOpts.qos > 2 {
+		return fmt.Errorf("--qos value must or 0, 1 or 2")
+	}
+
+	return nil
+}
+
+func runExplore(flags *pflag.FlagSet, zapOpts *zapOptions, exploreOpts *exploreOptions) error {
+	if err := zapOpts.processOptions(flags); err != nil {
+		return err
+	}
+	if err := zapOpts.rejectProtocolVersion5("explore"); err != nil {
+		return err
+	}
+	if err := exploreOpts.validateOptions(); err != nil {
+		return err
+	}
+	clientOpts := zapOpts.clientOpts
+
+	var client mqttClient
+	connectChan := make(chan viewstats.ConnectHandler, 1)
+	done := make(chan struct{})
+	// once the explorer is gone nobody reads connectChan
+	sendConnection := func(conn viewstats.ConnectHandler) {
+		select {
+		case connectChan <- conn:
+		case <-done:
+		}
+	}
+	subscribed := make(chan error, 1)
+
+	clientOpts.OnConnectionLost = func(_ MQTT.Client, reason error) {
+		sendConnection(viewstats.ConnectHandler{
+			IsConnected: false,
+			Err:         reason,
+		})
+	}
+	// a clean session loses the subscription with the connection, so it is
+	// made again every time paho reconnects
+	clientOpts.OnConnect = func(_ MQTT.Client) {
+		var err error
+		if token := client.Subscribe(exploreOpts.topic, byte(exploreOpts.qos), func(_ MQTT.Client, msg MQTT.Message) {
+			viewtopics.AddMessage(msg.Topic(), msg.Payload(), msg.Retained())
+		}); token.Wait() && token.Error() != nil {
+			err = fmt.Errorf("could not subscribe: %s", token.Error())
+		}
+
+		select {
+		case subscribed <- err:
+		default:
+			// only the first connect is waited for
+		}
+		sendConnection(viewstats.ConnectHandler{
+			IsConnected: err == nil,
+			Err:         err,
+		})
+	}
+
+	client = zapOpts.newClient()
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("could not connect: %s", token.Error())
+	}
+	defer client.Disconnect(250)
+	defer close(done)
+
+	output.VERBOSE.Printf("Connected to %s\n", clientOpts.Servers[0])
+
+	if err := <-subscribed; err != nil {
+		return err
+	}
+	defer client.Unsubscribe(exploreOpts.topic)
+
+	startExplorer(connectChan, prettyJSON)
+	return nil
+}
+
+// startExplorer shows the topics until the user quits, tests replace it
+// with one that does not need a terminal
+var startExplorer = viewtopics.StartExplorer
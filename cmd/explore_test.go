@@ -0,0 +1,18 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateExploreOptions(t *testing.T) {
+	exploreOpts := &exploreOptions{topic: "#"}
+	assert.NoError(t, exploreOpts.validateOptions())
+
+	exploreOpts.qos = 3
+	assert.EqualError(t, exploreOpts.validateOptions(), "--qos value must or 0, 1 or 2")
+
+	exploreOpts = &exploreOptions{}
+	assert.EqualError(t, exploreOpts.validateOptions(), "--topic is required")
+}
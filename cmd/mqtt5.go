@@ -0,0 +1,351 @@
+// Copyright © 2017 Ray Johnson <ray.johnson@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// v5Client wraps the paho MQTT 5 client so it looks like the paho v3 client
+// to the rest of zap.  It does not reconnect on its own, see
+// rejectProtocolVersion5.
+type v5Client struct {
+	clientOpts *MQTT.ClientOptions
+	keepAlive  int
+	pubProps   *paho.PublishProperties
+
+	mu      sync.Mutex
+	client  *paho.Client // nil until Connect succeeds
+	router  *paho.StandardRouter
+	pending sync.WaitGroup
+}
+
+func newV5Client(clientOpts *MQTT.ClientOptions, keepAlive int, pubOpts *publishOptions) *v5Client {
+	c := &v5Client{
+		clientOpts: clientOpts,
+		keepAlive:  keepAlive,
+		router:     paho.NewStandardRouter(),
+	}
+	if pubOpts != nil {
+		c.pubProps = pubOpts.publishProperties()
+	}
+	return c
+}
+
+// publishProperties converts the MQTT 5 publish options into paho properties
+func (pubOpts *publishOptions) publishProperties() *paho.PublishProperties {
+	if !pubOpts.hasProperties() {
+		return nil
+	}
+
+	props := &paho.PublishProperties{
+		ContentType:   pubOpts.contentType,
+		ResponseTopic: pubOpts.responseTopic,
+	}
+	if pubOpts.correlationData != "" {
+		props.CorrelationData = []byte(pubOpts.correlationData)
+	}
+	if pubOpts.messageExpiry > 0 {
+		expiry := uint32(pubOpts.messageExpiry)
+		props.MessageExpiry = &expiry
+	}
+	for _, prop := range pubOpts.userProperties {
+		kv := strings.SplitN(prop, "=", 2)
+		props.User = append(props.User, paho.UserProperty{Key: kv[0], Value: kv[1]})
+	}
+
+	return props
+}
+
+func (c *v5Client) dial() (net.Conn, error) {
+	server := c.clientOpts.Servers[0]
+	timeout := c.clientOpts.ConnectTimeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+
+	switch server.Scheme {
+	case "tcp", "mqtt":
+		return dialer.Dial("tcp", server.Host)
+	case "ssl", "tls", "tcps", "mqtts":
+		tlsConfig := c.clientOpts.TLSConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		return tls.DialWithDialer(dialer, "tcp", server.Host, tlsConfig)
+	}
+
+	return nil, fmt.Errorf("scheme %s is not supported with --protocol-version 5", server.Scheme)
+}
+
+func (c *v5Client) Connect() MQTT.Token {
+	return runV5Token(func() error {
+		conn, err := c.dial()
+		if err != nil {
+			return err
+		}
+
+		client := paho.NewClient(paho.ClientConfig{
+			ClientID: c.clientOpts.ClientID,
+			Conn:     conn,
+			Router:   c.router,
+			OnClientError: func(err error) {
+				c.connectionLost(err)
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				c.connectionLost(fmt.Errorf("server disconnected with reason code %d", d.ReasonCode))
+			},
+		})
+
+		cp := &paho.Connect{
+			ClientID:   c.clientOpts.ClientID,
+			KeepAlive:  uint16(c.keepAlive),
+			CleanStart: c.clientOpts.CleanSession,
+		}
+		if c.clientOpts.Username != "" {
+			cp.Username = c.clientOpts.Username
+			cp.UsernameFlag = true
+		}
+		if c.clientOpts.Password != "" {
+			cp.Password = []byte(c.clientOpts.Password)
+			cp.PasswordFlag = true
+		}
+
+		ca, err := client.Connect(context.Background(), cp)
+		if err != nil {
+			return err
+		}
+		if ca.ReasonCode != 0 {
+			return fmt.Errorf("connection refused with reason code %d", ca.ReasonCode)
+		}
+
+		c.mu.Lock()
+		c.client = client
+		c.mu.Unlock()
+
+		if c.clientOpts.OnConnect != nil {
+			go c.clientOpts.OnConnect(nil)
+		}
+		return nil
+	})
+}
+
+// connected returns the paho client, or nil if Connect has not succeeded
+func (c *v5Client) connected() *paho.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client
+}
+
+// notConnected is the token for work asked of a client that is not
+// connected, with the same error the paho v3 client gives
+func notConnected() *v5Token {
+	return &v5Token{err: MQTT.ErrNotConnected, done: closedChan()}
+}
+
+func (c *v5Client) connectionLost(err error) {
+	if c.clientOpts.OnConnectionLost != nil {
+		go c.clientOpts.OnConnectionLost(nil, err)
+	}
+}
+
+// Disconnect waits up to quiesce milliseconds for outstanding publishes
+func (c *v5Client) Disconnect(quiesce uint) {
+	done := make(chan struct{})
+	go func() {
+		c.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Duration(quiesce) * time.Millisecond):
+	}
+
+	if client := c.connected(); client != nil {
+		client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+	}
+}
+
+func (c *v5Client) Publish(topic string, qos byte, retained bool, payload interface{}) MQTT.Token {
+	var data []byte
+	switch p := payload.(type) {
+	case string:
+		data = []byte(p)
+	case []byte:
+		data = p
+	default:
+		return &v5Token{err: fmt.Errorf("unknown payload type %T", payload), done: closedChan()}
+	}
+	client := c.connected()
+	if client == nil {
+		return notConnected()
+	}
+
+	c.pending.Add(1)
+	return runV5Token(func() error {
+		defer c.pending.Done()
+		_, err := client.Publish(context.Background(), &paho.Publish{
+			Topic:      topic,
+			QoS:        qos,
+			Retain:     retained,
+			Payload:    data,
+			Properties: c.pubProps,
+		})
+		return err
+	})
+}
+
+func (c *v5Client) Subscribe(topic string, qos byte, callback MQTT.MessageHandler) MQTT.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+func (c *v5Client) SubscribeMultiple(filters map[string]byte, callback MQTT.MessageHandler) MQTT.Token {
+	client := c.connected()
+	if client == nil {
+		return notConnected()
+	}
+
+	sub := &paho.Subscribe{}
+	for topic, qos := range filters {
+		sub.Subscriptions = append(sub.Subscriptions, paho.SubscribeOptions{Topic: topic, QoS: qos})
+		c.router.RegisterHandler(topic, func(p *paho.Publish) {
+			callback(nil, &v5Message{publish: p})
+		})
+	}
+
+	return runV5Token(func() error {
+		sa, err := client.Subscribe(context.Background(), sub)
+		if err != nil {
+			return err
+		}
+		for _, reason := range sa.Reasons {
+			if reason >= 0x80 {
+				return fmt.Errorf("subscription refused with reason code %d", reason)
+			}
+		}
+		return nil
+	})
+}
+
+func (c *v5Client) Unsubscribe(topics ...string) MQTT.Token {
+	client := c.connected()
+	if client == nil {
+		return notConnected()
+	}
+
+	for _, topic := range topics {
+		c.router.UnregisterHandler(topic)
+	}
+
+	return runV5Token(func() error {
+		_, err := client.Unsubscribe(context.Background(), &paho.Unsubscribe{Topics: topics})
+		return err
+	})
+}
+
+// v5Token implements MQTT.Token for work done by the MQTT 5 client
+type v5Token struct {
+	done chan struct{}
+	err  error
+}
+
+func runV5Token(f func() error) *v5Token {
+	t := &v5Token{done: make(chan struct{})}
+	go func() {
+		t.err = f()
+		close(t.done)
+	}()
+	return t
+}
+
+func closedChan() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}
+
+func (t *v5Token) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *v5Token) WaitTimeout(d time.Duration) bool {
+	select {
+	case <-t.done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+func (t *v5Token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// v5Message implements MQTT.Message for a received MQTT 5 publish
+type v5Message struct {
+	publish *paho.Publish
+}
+
+func (m *v5Message) Duplicate() bool   { return false }
+func (m *v5Message) Qos() byte         { return m.publish.QoS }
+func (m *v5Message) Retained() bool    { return m.publish.Retain }
+func (m *v5Message) Topic() string     { return m.publish.Topic }
+func (m *v5Message) MessageID() uint16 { return m.publish.PacketID }
+func (m *v5Message) Payload() []byte   { return m.publish.Payload }
+func (m *v5Message) Ack()              {}
+
+// properties converts the paho properties into what the templates see
+func (m *v5Message) properties() MqttProperties {
+	result := MqttProperties{UserProperties: map[string]string{}}
+
+	props := m.publish.Properties
+	if props == nil {
+		return result
+	}
+
+	result.ContentType = props.ContentType
+	result.ResponseTopic = props.ResponseTopic
+	result.CorrelationData = string(props.CorrelationData)
+	if props.MessageExpiry != nil {
+		result.MessageExpiry = *props.MessageExpiry
+	}
+	for _, prop := range props.User {
+		result.UserProperties[prop.Key] = prop.Value
+	}
+
+	return result
+}
@@ -0,0 +1,27 @@
+package cmd
+
+import (
+	"testing"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestV5ClientNotConnected(t *testing.T) {
+	clientOpts := MQTT.NewClientOptions().AddBroker("tcp://127.0.0.1:1883")
+	client := newV5Client(clientOpts, 60, nil)
+
+	handler := func(MQTT.Client, MQTT.Message) {}
+	for _, token := range []MQTT.Token{
+		client.Publish("a/b", 1, false, "hello"),
+		client.Subscribe("a/#", 1, handler),
+		client.SubscribeMultiple(map[string]byte{"a/#": 0}, handler),
+		client.Unsubscribe("a/#"),
+	} {
+		assert.True(t, token.Wait())
+		assert.Equal(t, MQTT.ErrNotConnected, token.Error())
+	}
+
+	// nothing is left to wait for
+	client.Disconnect(0)
+}
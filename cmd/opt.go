@@ -10,6 +10,7 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
@@ -31,11 +32,14 @@ type connectionOptions struct {
 	certFile     string
 	keyFile      string
 	caFile       string
+
+	protocolVersion int
 }
 
 type zapOptions struct {
 	configFile string
 	broker     string
+	brokers    []string
 	verbose    bool
 	conOpts    *connectionOptions
 	clientOpts *MQTT.ClientOptions
@@ -43,6 +47,7 @@ type zapOptions struct {
 	subOpts    *subscribeOptions
 
 	configTree *toml.Tree
+	configRoot *toml.Tree // the whole config file, configTree may be a section of it
 }
 
 // these are really global flags - but the struct will hold pointers to all other types
@@ -51,7 +56,7 @@ func buildZapFlags(fs *pflag.FlagSet) *zapOptions {
 
 	fs.StringVar(&zapOpts.configFile, "config", "", "Config file path (default is $HOME/.zap.toml)")
 	fs.BoolVar(&zapOpts.verbose, "verbose", false, "Give more verbose information")
-	fs.StringVarP(&zapOpts.broker, "broker", "b", "", "Specifies a section of the config file to use")
+	fs.StringArrayVarP(&zapOpts.brokers, "broker", "b", nil, "Specifies a section of the config file to use")
 
 	annotation := []string{"path"}
 	fs.SetAnnotation("config", "man-arg-hints", annotation)
@@ -75,6 +80,7 @@ func addConnectionFlags(fs *pflag.FlagSet) *connectionOptions {
 	fs.StringVar(&conOpts.certFile, "tls-cert", "", "Path to TLS certificate file")
 	fs.StringVar(&conOpts.keyFile, "tls-key", "", "Path to TLS key file")
 	fs.BoolVar(&conOpts.insecure, "tls-skip-verify", false, "Skips verification for TLS")
+	fs.IntVar(&conOpts.protocolVersion, "protocol-version", 0, "MQTT protocol version to use: 3 (3.1), 4 (3.1.1) or 5 (default is 3.1.1, falling back to 3.1)")
 
 	annotation := []string{"url"}
 	fs.SetAnnotation("server", "man-arg-hints", annotation)
@@ -90,6 +96,8 @@ func addConnectionFlags(fs *pflag.FlagSet) *connectionOptions {
 	fs.SetAnnotation("tls-key", "man-arg-hints", annotation)
 	annotation = []string{"path"}
 	fs.SetAnnotation("tls-cacert", "man-arg-hints", annotation)
+	annotation = []string{"3|4|5"}
+	fs.SetAnnotation("protocol-version", "man-arg-hints", annotation)
 
 	return conOpts
 }
@@ -119,6 +127,7 @@ func loadConfigFile(zapOpts *zapOptions) error {
 		return fmt.Errorf("error loading config file: %s", err.Error())
 	}
 
+	zapOpts.configRoot = configTree
 	if zapOpts.broker != "" {
 		if configTree.Has(zapOpts.broker) {
 			configTree = configTree.Get(zapOpts.broker).(*toml.Tree)
@@ -136,18 +145,57 @@ func getValueFromConfig(fs *pflag.FlagSet, configTree *toml.Tree, key string, de
 		return def // value was passed as command line option no change needed
 	}
 	if configTree.Has(key) {
-		return configTree.Get(key)
+		value := configTree.Get(key)
+		// toml integers are always int64 but our flags are int
+		if i, ok := value.(int64); ok {
+			if _, isInt := def.(int); isInt {
+				return int(i)
+			}
+		}
+		return value
 	}
 
 	// If not set by command line option this will be default value
 	return def
 }
 
+// getStringsFromConfig is like getValueFromConfig but the config file
+// may hold either a single string or an array of strings.
+func getStringsFromConfig(fs *pflag.FlagSet, configTree *toml.Tree, key string, def []string) ([]string, error) {
+	switch value := getValueFromConfig(fs, configTree, key, def).(type) {
+	case []string:
+		return value, nil
+	case string:
+		return []string{value}, nil
+	case []interface{}:
+		var result []string
+		for _, v := range value {
+			str, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s in config file must be an array of strings", key)
+			}
+			result = append(result, str)
+		}
+		return result, nil
+	}
+
+	return nil, fmt.Errorf("%s in config file must be a string or an array of strings", key)
+}
+
 func (zapOpts *zapOptions) processOptions(fs *pflag.FlagSet) error {
 	if zapOpts.verbose {
 		output.VERBOSE = log.New(os.Stdout, "", 0)
 	}
 
+	// only stats can watch more than one broker, it makes a zapOptions
+	// for each with forBroker
+	if len(zapOpts.brokers) > 1 {
+		return fmt.Errorf("only one --broker can be used with this command")
+	}
+	if len(zapOpts.brokers) == 1 {
+		zapOpts.broker = zapOpts.brokers[0]
+	}
+
 	var err error
 	if err = loadConfigFile(zapOpts); err != nil {
 		return err
@@ -166,6 +214,7 @@ func (zapOpts *zapOptions) processOptions(fs *pflag.FlagSet) error {
 		conOpts.certFile = getValueFromConfig(fs, zapOpts.configTree, "tls-cert", conOpts.certFile).(string)
 		conOpts.keyFile = getValueFromConfig(fs, zapOpts.configTree, "tls-key", conOpts.keyFile).(string)
 		conOpts.insecure = getValueFromConfig(fs, zapOpts.configTree, "tls-skip-verify", conOpts.insecure).(bool)
+		conOpts.protocolVersion = getValueFromConfig(fs, zapOpts.configTree, "protocol-version", conOpts.protocolVersion).(int)
 
 		if zapOpts.subOpts != nil {
 			subOpts := zapOpts.subOpts
@@ -178,13 +227,33 @@ func (zapOpts *zapOptions) processOptions(fs *pflag.FlagSet) error {
 			// subscribe and publish share the same --topic flag but have different defaults
 			// so in the config file this requires you to specify subscribe-topic as the value for --topic
 			// TODO - need to figure out how to get topic to be different in config
-			subOpts.topic = getValueFromConfig(fs, zapOpts.configTree, "topic", subOpts.topic).(string)
+			if subOpts.topics, err = getStringsFromConfig(fs, zapOpts.configTree, "topic", subOpts.topics); err != nil {
+				return err
+			}
+			if subOpts.filterOut, err = getStringsFromConfig(fs, zapOpts.configTree, "filter-out", subOpts.filterOut); err != nil {
+				return err
+			}
+			if subOpts.filterOutRegexp, err = getStringsFromConfig(fs, zapOpts.configTree, "filter-out-regexp", subOpts.filterOutRegexp); err != nil {
+				return err
+			}
+			subOpts.decode = getValueFromConfig(fs, zapOpts.configTree, "decode", subOpts.decode).(string)
+			subOpts.protoDescriptor = getValueFromConfig(fs, zapOpts.configTree, "proto-descriptor", subOpts.protoDescriptor).(string)
+			subOpts.protoMessage = getValueFromConfig(fs, zapOpts.configTree, "proto-message", subOpts.protoMessage).(string)
+			if subOpts.where, err = getStringsFromConfig(fs, zapOpts.configTree, "where", subOpts.where); err != nil {
+				return err
+			}
 		}
 		if zapOpts.pubOpts != nil {
 			pubOpts := zapOpts.pubOpts
 			// Flags like --message, etc. I do not think make sense to specify in config file - skip them
 			pubOpts.qos = getValueFromConfig(fs, zapOpts.configTree, "qos", pubOpts.qos).(int)
-			pubOpts.topic = getValueFromConfig(fs, zapOpts.configTree, "topic", pubOpts.topic).(string)
+			if topic, ok := getValueFromConfig(fs, zapOpts.configTree, "topic", pubOpts.topic).(string); ok {
+				pubOpts.topic = topic
+			} else {
+				return fmt.Errorf("topic in config file must be a single topic when publishing")
+			}
+			pubOpts.contentType = getValueFromConfig(fs, zapOpts.configTree, "content-type", pubOpts.contentType).(string)
+			pubOpts.messageExpiry = getValueFromConfig(fs, zapOpts.configTree, "message-expiry", pubOpts.messageExpiry).(int)
 		}
 	}
 
@@ -194,10 +263,14 @@ func (zapOpts *zapOptions) processOptions(fs *pflag.FlagSet) error {
 	}
 
 	if zapOpts.pubOpts != nil {
+		zapOpts.pubOpts.repeatSet = fs.Changed("repeat") || fs.Changed("interval")
 		err := zapOpts.pubOpts.validateOptions()
 		if err != nil {
 			return err
 		}
+		if conOpts.protocolVersion != 5 && zapOpts.pubOpts.hasProperties() {
+			return fmt.Errorf("--user-property, --content-type, --response-topic, --correlation-data and --message-expiry require --protocol-version 5")
+		}
 	}
 
 	if zapOpts.subOpts != nil {
@@ -237,6 +310,18 @@ func (conOpts *connectionOptions) buildAndValidateClientOpts() (*MQTT.ClientOpti
 	}
 	clientOpts.AddBroker(conOpts.server)
 
+	switch conOpts.protocolVersion {
+	case 0:
+		// paho tries 3.1.1 and falls back to 3.1 for older brokers
+	case 3, 4:
+		clientOpts.SetProtocolVersion(uint(conOpts.protocolVersion))
+	case 5:
+		// MQTT 5 connections are made by newV5Client - the paho v3 client
+		// does not understand the version so leave it unset here
+	default:
+		return nil, fmt.Errorf("--protocol-version must be 3, 4 or 5")
+	}
+
 	// tls set up
 	tlsConfig := tls.Config{InsecureSkipVerify: conOpts.insecure}
 	// if either option is set
@@ -272,6 +357,58 @@ func (conOpts *connectionOptions) buildAndValidateClientOpts() (*MQTT.ClientOpti
 
 }
 
+// mqttClient is the part of the paho client that zap uses.  Both the
+// paho v3 client and our MQTT 5 client satisfy it.
+type mqttClient interface {
+	Connect() MQTT.Token
+	Disconnect(quiesce uint)
+	Publish(topic string, qos byte, retained bool, payload interface{}) MQTT.Token
+	Subscribe(topic string, qos byte, callback MQTT.MessageHandler) MQTT.Token
+	SubscribeMultiple(filters map[string]byte, callback MQTT.MessageHandler) MQTT.Token
+	Unsubscribe(topics ...string) MQTT.Token
+}
+
+// newClient creates a client for the protocol version asked for.  It must
+// be called after processOptions.
+func (zapOpts *zapOptions) newClient() mqttClient {
+	return zapOpts.newClientWithOptions(zapOpts.clientOpts)
+}
+
+// rejectProtocolVersion5 is for the commands that need the client to
+// reconnect after the connection is lost, which the MQTT 5 client does not
+// do.
+func (zapOpts *zapOptions) rejectProtocolVersion5(command string) error {
+	if zapOpts.conOpts.protocolVersion == 5 {
+		return fmt.Errorf("--protocol-version 5 can not be used with %s as the MQTT 5 client does not reconnect", command)
+	}
+	return nil
+}
+
+// newClientWithID creates another client with the same options but a
+// different client id, for commands that need more than one connection.
+func (zapOpts *zapOptions) newClientWithID(clientID string) mqttClient {
+	clientOpts := *zapOpts.clientOpts
+	clientOpts.ClientID = clientID
+	return zapOpts.newClientWithOptions(&clientOpts)
+}
+
+func (zapOpts *zapOptions) newClientWithOptions(clientOpts *MQTT.ClientOptions) mqttClient {
+	if zapOpts.conOpts.protocolVersion == 5 {
+		return newV5Client(clientOpts, zapOpts.conOpts.keepAlive, zapOpts.pubOpts)
+	}
+	return MQTT.NewClient(clientOpts)
+}
+
+// forBroker copies the options for one of the brokers given with --broker,
+// the copy is processed on its own so the config file sections do not mix
+func (zapOpts *zapOptions) forBroker(broker string) *zapOptions {
+	opts := *zapOpts
+	conOpts := *zapOpts.conOpts
+	opts.conOpts = &conOpts
+	opts.brokers = []string{broker}
+	return &opts
+}
+
 // PrintConnectionInfo will so all the args used if verbose is on
 func (zapOpts *zapOptions) PrintConnectionInfo() {
 	output.VERBOSE.Println("Connecting to server with following parameters")
@@ -279,6 +416,9 @@ func (zapOpts *zapOptions) PrintConnectionInfo() {
 		output.VERBOSE.Println("  From broker config: ", zapOpts.broker)
 	}
 	output.VERBOSE.Println("  Server: ", zapOpts.conOpts.server)
+	if zapOpts.conOpts.protocolVersion != 0 {
+		output.VERBOSE.Println("  Protocol Version: ", zapOpts.conOpts.protocolVersion)
+	}
 	if zapOpts.conOpts.keyFile != "" {
 		output.VERBOSE.Println("  TLS Key path: ", zapOpts.conOpts.keyFile)
 		output.VERBOSE.Println("  TLS Cert path: ", zapOpts.conOpts.certFile)
@@ -294,7 +434,7 @@ func (zapOpts *zapOptions) PrintConnectionInfo() {
 	output.VERBOSE.Println("  Password: ", zapOpts.conOpts.password)
 	if zapOpts.subOpts != nil {
 		output.VERBOSE.Println("  QOS: ", zapOpts.subOpts.qos)
-		output.VERBOSE.Println("  Topic: ", zapOpts.subOpts.topic)
+		output.VERBOSE.Println("  Topics: ", strings.Join(zapOpts.subOpts.topics, ", "))
 	}
 	if zapOpts.pubOpts != nil {
 		output.VERBOSE.Println("  QOS: ", zapOpts.pubOpts.qos)
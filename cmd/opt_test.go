@@ -50,6 +50,9 @@ func TestLoadConfig(t *testing.T) {
 	err = parseMustError(t, "--config ../examples/example.zap.toml -b bad_broker")
 	assert.Equal(t, "broker \"bad_broker\" does not exist in config file: ../examples/example.zap.toml", err.Error(), "error message not right")
 
+	err = parseMustError(t, "--config ../examples/example.zap.toml -b mosquitto -b mosquitto-skip-vefify")
+	assert.Equal(t, "only one --broker can be used with this command", err.Error(), "error message not right")
+
 	f, _ := os.Create("bad.toml")
 	f.WriteString(`[broke
 bad := toml_syntax
@@ -88,7 +91,7 @@ func TestOptions(t *testing.T) {
 	assert.Equal(t, "tcp://localhost:1883", clientOpts.Servers[0].String(), "they should be equal")
 
 	err := parseMustError(t, "--server foo")
-	assert.Equal(t, "parse foo: invalid URI for request", err.Error())
+	assert.Equal(t, `parse "foo": invalid URI for request`, err.Error())
 }
 
 func TestCertOptions(t *testing.T) {
@@ -105,3 +108,21 @@ func TestCertOptions(t *testing.T) {
 	err = parseMustError(t, "--tls-cacert noCaFile")
 	assert.Equal(t, "open noCaFile: no such file or directory", err.Error())
 }
+
+func TestProtocolVersion(t *testing.T) {
+	// left to paho so it can fall back to 3.1
+	clientOpts := mustParse(t, "")
+	assert.Equal(t, uint(0), clientOpts.ProtocolVersion)
+
+	clientOpts = mustParse(t, "--protocol-version 4")
+	assert.Equal(t, uint(4), clientOpts.ProtocolVersion)
+
+	clientOpts = mustParse(t, "--protocol-version 3")
+	assert.Equal(t, uint(3), clientOpts.ProtocolVersion)
+
+	clientOpts = mustParse(t, "--protocol-version 5")
+	assert.Equal(t, uint(0), clientOpts.ProtocolVersion)
+
+	err := parseMustError(t, "--protocol-version 6")
+	assert.Equal(t, "--protocol-version must be 3, 4 or 5", err.Error())
+}
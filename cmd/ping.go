@@ -0,0 +1,286 @@
+// Copyright © 2017 Ray Johnson <ray.johnson@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rayjohnson/zap/output"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+type pingOptions struct {
+	count    int
+	interval time.Duration
+	timeout  time.Duration
+	qos      int
+	topic    string
+}
+
+// pingProbe is the payload of each probe message
+type pingProbe struct {
+	Seq  int   `json:"seq"`
+	Sent int64 `json:"sent"`
+}
+
+// pingStats keeps the round trip times of the probes
+type pingStats struct {
+	sent    int
+	rtts    []time.Duration
+	pending map[int]time.Time // when each probe still waiting for a reply was sent
+}
+
+func newPingCommand() *cobra.Command {
+	var zapOpts *zapOptions
+	pingOpts := &pingOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "ping",
+		Args:  cobra.NoArgs,
+		Short: "Measure the round trip time through an MQTT broker",
+		Long: `Measure the round trip time through an MQTT broker
+
+The ping command subscribes to a probe topic and then publishes timestamped
+messages to it.  It reports the time for each message to come back and a
+summary of the round trip times and lost messages, much like ping does for
+a network host.  It exits with an error if no probes came back.`,
+		Example: `.nf
+Check the broker in the config named production:
+.RS
+zap ping \-b production \-\-count 5
+.RE
+.fi`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runPing(cmd.Flags(), zapOpts, pingOpts)
+		},
+		SilenceUsage:      true,
+		DisableAutoGenTag: true,
+	}
+	annotations := make(map[string]string)
+	annotations["man-files-section"] = filesManInfo
+	cmd.Annotations = annotations
+
+	flags := cmd.Flags()
+	flags.IntVarP(&pingOpts.count, "count", "c", 0, "Stop after sending count probes (default is until Ctrl-C)")
+	flags.DurationVar(&pingOpts.interval, "interval", time.Second, "Time between probes")
+	flags.DurationVar(&pingOpts.timeout, "timeout", 5*time.Second, "Time to wait for a probe before counting it as lost")
+	flags.IntVar(&pingOpts.qos, "qos", 0, "The qos setting for probe messages")
+	flags.StringVar(&pingOpts.topic, "topic", "", "Topic to send probes on (default is zap/ping/<client id>)")
+
+	annotation := []string{"0|1|2"}
+	flags.SetAnnotation("qos", "man-arg-hints", annotation)
+	annotation = []string{"topic path"}
+	flags.SetAnnotation("topic", "man-arg-hints", annotation)
+	annotation = []string{"int"}
+	flags.SetAnnotation("count", "man-arg-hints", annotation)
+	annotation = []string{"duration"}
+	flags.SetAnnotation("interval", "man-arg-hints", annotation)
+	flags.SetAnnotation("timeout", "man-arg-hints", annotation)
+
+	zapOpts = buildZapFlags(flags)
+	zapOpts.conOpts = addConnectionFlags(flags)
+
+	return cmd
+}
+
+func (pingOpts *pingOptions) validateOptions() error {
+	if pingOpts.count < 0 {
+		return fmt.Errorf("--count can not be negative")
+	}
+	if pingOpts.interval <= 0 {
+		return fmt.Errorf("--interval must be greater than 0")
+	}
+	if pingOpts.timeout <= 0 {
+		return fmt.Errorf("--timeout must be greater than 0")
+	}
+	if pingOpts.qos < 0 || pingOpts.qos > 2 {
+		return fmt.Errorf("--qos value must or 0, 1 or 2")
+	}
+
+	return nil
+}
+
+func runPing(flags *pflag.FlagSet, zapOpts *zapOptions, pingOpts *pingOptions) error {
+	if err := zapOpts.processOptions(flags); err != nil {
+		return err
+	}
+	if err := pingOpts.validateOptions(); err != nil {
+		return err
+	}
+	clientOpts := zapOpts.clientOpts
+
+	topic := pingOpts.topic
+	if topic == "" {
+		topic = "zap/ping/" + clientOpts.ClientID
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+
+	client := zapOpts.newClient()
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("could not connect: %s", token.Error())
+	}
+	defer client.Disconnect(250)
+
+	output.VERBOSE.Printf("Connected to %s\n", clientOpts.Servers[0])
+
+	replies := make(chan pingProbe, 16)
+	if token := client.Subscribe(topic, byte(pingOpts.qos), func(client MQTT.Client, msg MQTT.Message) {
+		var probe pingProbe
+		if err := json.Unmarshal(msg.Payload(), &probe); err == nil {
+			// replies coming after we stopped listening are dropped
+			select {
+			case replies <- probe:
+			default:
+			}
+		}
+	}); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("could not subscribe: %s", token.Error())
+	}
+	defer client.Unsubscribe(topic)
+
+	fmt.Printf("PING %s on topic %s\n", clientOpts.Servers[0], topic)
+
+	stats := &pingStats{pending: make(map[int]time.Time)}
+	ticker := time.NewTicker(pingOpts.interval)
+	defer ticker.Stop()
+	var doneSending <-chan time.Time
+
+	send := func() error {
+		probe, _ := json.Marshal(stats.newProbe(time.Now()))
+		return publishMessage(client, topic, byte(pingOpts.qos), false, probe)
+	}
+	expire := func() {
+		for _, seq := range stats.expire(time.Now(), pingOpts.timeout) {
+			fmt.Printf("no reply from %s: seq=%d\n", clientOpts.Servers[0].Host, seq)
+		}
+	}
+	if err := send(); err != nil {
+		return err
+	}
+
+loop:
+	for {
+		if pingOpts.count > 0 && stats.sent >= pingOpts.count && doneSending == nil {
+			ticker.Stop()
+			doneSending = time.After(pingOpts.timeout)
+		}
+
+		select {
+		case <-ticker.C:
+			expire()
+			if err := send(); err != nil {
+				return err
+			}
+		case probe := <-replies:
+			rtt, ok := stats.reply(probe, time.Now())
+			if !ok {
+				continue
+			}
+			fmt.Printf("reply from %s: seq=%d time=%s\n", clientOpts.Servers[0].Host, probe.Seq, rtt.Round(time.Microsecond))
+			if doneSending != nil && len(stats.pending) == 0 {
+				break loop
+			}
+		case <-doneSending:
+			expire()
+			break loop
+		case <-quit:
+			break loop
+		}
+	}
+
+	fmt.Printf("\n--- %s ping statistics ---\n", clientOpts.Servers[0])
+	fmt.Print(stats.summary())
+
+	if len(stats.rtts) == 0 {
+		return fmt.Errorf("no replies received")
+	}
+	return nil
+}
+
+// newProbe numbers the next probe and waits for its reply
+func (stats *pingStats) newProbe(now time.Time) pingProbe {
+	stats.sent++
+	stats.pending[stats.sent] = now
+	return pingProbe{Seq: stats.sent, Sent: now.UnixNano()}
+}
+
+// reply records the round trip time of a probe.  It returns false for a
+// probe we are not waiting for: a duplicate, one already counted as lost
+// or one sent by someone else.
+func (stats *pingStats) reply(probe pingProbe, now time.Time) (time.Duration, bool) {
+	sent, ok := stats.pending[probe.Seq]
+	if !ok || sent.UnixNano() != probe.Sent {
+		return 0, false
+	}
+	delete(stats.pending, probe.Seq)
+	rtt := now.Sub(sent)
+	stats.rtts = append(stats.rtts, rtt)
+	return rtt, true
+}
+
+// expire stops waiting for the probes sent more than timeout ago, they
+// count as lost, and returns their seqs in order
+func (stats *pingStats) expire(now time.Time, timeout time.Duration) []int {
+	var lost []int
+	for seq, sent := range stats.pending {
+		if now.Sub(sent) >= timeout {
+			lost = append(lost, seq)
+			delete(stats.pending, seq)
+		}
+	}
+	sort.Ints(lost)
+	return lost
+}
+
+func (stats *pingStats) summary() string {
+	received := len(stats.rtts)
+	loss := 0.0
+	if stats.sent > 0 {
+		loss = float64(stats.sent-received) / float64(stats.sent) * 100
+	}
+	str := fmt.Sprintf("%d probes sent, %d received, %.1f%% loss\n", stats.sent, received, loss)
+	if received == 0 {
+		return str
+	}
+
+	sorted := append([]time.Duration(nil), stats.rtts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var total time.Duration
+	for _, rtt := range sorted {
+		total += rtt
+	}
+	avg := total / time.Duration(received)
+
+	return str + fmt.Sprintf("round-trip min/avg/max/p99 = %s/%s/%s/%s\n",
+		sorted[0].Round(time.Microsecond), avg.Round(time.Microsecond),
+		sorted[received-1].Round(time.Microsecond), percentile(sorted, 99).Round(time.Microsecond))
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPingSummary(t *testing.T) {
+	stats := &pingStats{sent: 4}
+	assert.Equal(t, "4 probes sent, 0 received, 100.0% loss\n", stats.summary())
+
+	stats.rtts = []time.Duration{3 * time.Millisecond, time.Millisecond, 2 * time.Millisecond}
+	assert.Equal(t, "4 probes sent, 3 received, 25.0% loss\nround-trip min/avg/max/p99 = 1ms/2ms/3ms/3ms\n", stats.summary())
+}
+
+func TestPingReplies(t *testing.T) {
+	start := time.Now()
+	stats := &pingStats{pending: make(map[int]time.Time)}
+	first := stats.newProbe(start)
+	second := stats.newProbe(start.Add(time.Second))
+	third := stats.newProbe(start.Add(2 * time.Second))
+
+	rtt, ok := stats.reply(first, start.Add(3*time.Millisecond))
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Millisecond, rtt)
+
+	// a redelivery, a probe of another zap and an unknown seq are ignored
+	_, ok = stats.reply(first, start.Add(4*time.Millisecond))
+	assert.False(t, ok)
+	_, ok = stats.reply(pingProbe{Seq: 2, Sent: start.UnixNano()}, start.Add(time.Second))
+	assert.False(t, ok)
+	_, ok = stats.reply(pingProbe{Seq: 9, Sent: start.UnixNano()}, start.Add(time.Second))
+	assert.False(t, ok)
+
+	// a probe is lost once the timeout passes, a late reply is ignored
+	assert.Equal(t, []int{2}, stats.expire(start.Add(6*time.Second), 5*time.Second))
+	_, ok = stats.reply(second, start.Add(6*time.Second))
+	assert.False(t, ok)
+
+	_, ok = stats.reply(third, start.Add(6*time.Second))
+	assert.True(t, ok)
+	assert.Empty(t, stats.pending)
+	assert.Equal(t, "3 probes sent, 2 received, 33.3% loss\nround-trip min/avg/max/p99 = 3ms/2.0015s/4s/4s\n", stats.summary())
+}
+
+func TestValidatePingOptions(t *testing.T) {
+	pingOpts := &pingOptions{interval: time.Second, timeout: time.Second, qos: 5}
+	assert.Equal(t, "--qos value must or 0, 1 or 2", pingOpts.validateOptions().Error())
+
+	pingOpts = &pingOptions{interval: 0, timeout: time.Second}
+	assert.Equal(t, "--interval must be greater than 0", pingOpts.validateOptions().Error())
+
+	pingOpts = &pingOptions{count: 5, interval: time.Second, timeout: time.Second}
+	assert.Nil(t, pingOpts.validateOptions())
+}
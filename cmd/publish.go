@@ -26,8 +26,11 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"os/signal"
+	"strings"
+	"text/template"
+	"time"
 
-	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/rayjohnson/zap/output"
 
 	"github.com/spf13/cobra"
@@ -40,9 +43,23 @@ type publishOptions struct {
 	doNullMsg   bool
 	message     string
 	filePath    string
+	templateStr string
+	repeat      int
+	interval    time.Duration
+	repeatSet   bool // --repeat or --interval was given
 	retain      bool
 	topic       string
 	qos         int
+
+	// MQTT 5 only properties
+	userProperties  []string
+	contentType     string
+	responseTopic   string
+	correlationData string
+	messageExpiry   int
+
+	messageTemplate *template.Template
+	quit            <-chan os.Signal // stops sending the template messages
 }
 
 func newPublishCommand() *cobra.Command {
@@ -56,7 +73,14 @@ func newPublishCommand() *cobra.Command {
 		Long: `The publish command allows you to send a message on an MQTT topic
 
 Multiple options are available to send a single argument, a whole file, or
-data coming from stdin.`,
+data coming from stdin.
+
+With \-\-template each message is built from a go template, which makes
+it easy to simulate a device sending telemetry.  Along with the functions
+of the subscribe templates it can use {{.Seq}}, the number of the message
+starting at 1, {{.Topic}}, and the functions now, unix, unixMilli, uuid,
+randInt, randFloat and randChoice.  \-\-repeat sends that many messages,
+0 sending until Ctrl-C, waiting \-\-interval between them.`,
 		Example: `.nf
 Publish to public mqtt server a test:
 .RS
@@ -68,6 +92,11 @@ Publish to the broker in config named mosquitto data from a file:
 zap publish \-\-config examples/example.zap.toml \-b mosquitto
 \-\-file examples/README.txt
 .RE
+Send 10 readings of a simulated sensor, one a second:
+.RS
+zap publish \-b mosquitto \-\-topic sensors/1 \-\-repeat 10 \-\-interval 1s
+\-\-template '{"id":{{.Seq}},"ts":"{{now}}","v":{{randFloat 0 100}}}'
+.RE
 .fi`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return runPublish(cmd.Flags(), zapOpts)
@@ -84,20 +113,44 @@ zap publish \-\-config examples/example.zap.toml \-b mosquitto
 	flags.BoolVarP(&pubOpts.doStdinFile, "stdin-file", "s", false, "Read stdin until EOF and send all as one message")
 	flags.StringVarP(&pubOpts.message, "message", "m", "", "Send the argument to the topic and exit")
 	flags.StringVarP(&pubOpts.filePath, "file", "f", "", "Send contents of the file to the topic and exit")
+	flags.StringVar(&pubOpts.templateStr, "template", "", "Build each message from the go template")
+	flags.IntVar(&pubOpts.repeat, "repeat", 1, "Number of messages to send with --template, 0 sends until Ctrl-C")
+	flags.DurationVar(&pubOpts.interval, "interval", 0, "Time to wait between the messages sent with --template")
 	flags.BoolVarP(&pubOpts.retain, "retain", "r", false, "Retain as the last good message")
 	flags.BoolVarP(&pubOpts.doNullMsg, "null-message", "n", false, "Send a null (zero length) message")
 	flags.StringVar(&pubOpts.topic, "topic", "sample", "Topic string for mqtt, should not use wild cards")
 	flags.IntVar(&pubOpts.qos, "qos", 0, "The qos setting for outbound messages")
+	flags.StringArrayVar(&pubOpts.userProperties, "user-property", nil, "Add a user property to the message, may be repeated (MQTT 5 only)")
+	flags.StringVar(&pubOpts.contentType, "content-type", "", "Content type of the message (MQTT 5 only)")
+	flags.StringVar(&pubOpts.responseTopic, "response-topic", "", "Topic the receiver should send a response to (MQTT 5 only)")
+	flags.StringVar(&pubOpts.correlationData, "correlation-data", "", "Correlation data sent with the message (MQTT 5 only)")
+	flags.IntVar(&pubOpts.messageExpiry, "message-expiry", 0, "Seconds until the broker discards an undelivered message (MQTT 5 only)")
 
 	// Flag annotations to help make docs more clear
 	annotation := []string{"path"}
 	flags.SetAnnotation("file", "man-arg-hints", annotation)
 	annotation = []string{"data"}
 	flags.SetAnnotation("message", "man-arg-hints", annotation)
+	annotation = []string{"go template"}
+	flags.SetAnnotation("template", "man-arg-hints", annotation)
+	annotation = []string{"count"}
+	flags.SetAnnotation("repeat", "man-arg-hints", annotation)
+	annotation = []string{"duration"}
+	flags.SetAnnotation("interval", "man-arg-hints", annotation)
 	annotation = []string{"topic path"}
 	flags.SetAnnotation("topic", "man-arg-hints", annotation)
 	annotation = []string{"0|1|2"}
 	flags.SetAnnotation("qos", "man-arg-hints", annotation)
+	annotation = []string{"key=value"}
+	flags.SetAnnotation("user-property", "man-arg-hints", annotation)
+	annotation = []string{"mime type"}
+	flags.SetAnnotation("content-type", "man-arg-hints", annotation)
+	annotation = []string{"topic path"}
+	flags.SetAnnotation("response-topic", "man-arg-hints", annotation)
+	annotation = []string{"data"}
+	flags.SetAnnotation("correlation-data", "man-arg-hints", annotation)
+	annotation = []string{"seconds"}
+	flags.SetAnnotation("message-expiry", "man-arg-hints", annotation)
 
 	zapOpts = buildZapFlags(flags)
 	zapOpts.conOpts = addConnectionFlags(flags)
@@ -128,22 +181,58 @@ func (pubOpts *publishOptions) validateOptions() error {
 	if pubOpts.doStdinFile {
 		count++
 	}
+	if pubOpts.templateStr != "" {
+		count++
+	}
 
 	if count == 0 {
-		return fmt.Errorf("must specify one of --message, --file, --stdin-line, --stdin-file, or --null-message to send any data")
+		return fmt.Errorf("must specify one of --message, --file, --stdin-line, --stdin-file, --template, or --null-message to send any data")
 	}
 
 	if count > 1 {
-		return fmt.Errorf("only one of --message, --file, --stdin-line, --stdin-file, or --null-message can be used")
+		return fmt.Errorf("only one of --message, --file, --stdin-line, --stdin-file, --template, or --null-message can be used")
+	}
+
+	if pubOpts.templateStr != "" {
+		if pubOpts.repeat < 0 {
+			return fmt.Errorf("--repeat can not be negative")
+		}
+		if pubOpts.interval < 0 {
+			return fmt.Errorf("--interval can not be negative")
+		}
+
+		var err error
+		pubOpts.messageTemplate, err = newPublishTemplate(pubOpts.templateStr)
+		if err != nil {
+			return err
+		}
+	} else if pubOpts.repeatSet {
+		return fmt.Errorf("--repeat and --interval can only be used with --template")
 	}
 
 	if pubOpts.qos < 0 || pubOpts.qos > 2 {
 		return fmt.Errorf("--qos value must or 0, 1 or 2")
 	}
 
+	for _, prop := range pubOpts.userProperties {
+		if !strings.Contains(prop, "=") {
+			return fmt.Errorf("--user-property must be of the form key=value: %s", prop)
+		}
+	}
+
+	if pubOpts.messageExpiry < 0 {
+		return fmt.Errorf("--message-expiry can not be negative")
+	}
+
 	return nil
 }
 
+// hasProperties returns true if any of the MQTT 5 only options are in use
+func (pubOpts *publishOptions) hasProperties() bool {
+	return len(pubOpts.userProperties) > 0 || pubOpts.contentType != "" || pubOpts.responseTopic != "" ||
+		pubOpts.correlationData != "" || pubOpts.messageExpiry != 0
+}
+
 func runPublish(flags *pflag.FlagSet, zapOpts *zapOptions) error {
 	pubOpts := zapOpts.pubOpts
 
@@ -152,7 +241,16 @@ func runPublish(flags *pflag.FlagSet, zapOpts *zapOptions) error {
 	}
 	clientOpts := zapOpts.clientOpts
 
-	client := MQTT.NewClient(clientOpts)
+	// only the template messages can go on until Ctrl-C, the other ways
+	// of sending keep the default handling of the signals
+	if pubOpts.messageTemplate != nil {
+		quit := make(chan os.Signal, 1)
+		notifyQuit(quit)
+		defer signal.Stop(quit)
+		pubOpts.quit = quit
+	}
+
+	client := zapOpts.newClient()
 	if token := client.Connect(); token.Wait() && token.Error() != nil {
 		return fmt.Errorf("could not connect: %s", token.Error())
 	}
@@ -160,14 +258,30 @@ func runPublish(flags *pflag.FlagSet, zapOpts *zapOptions) error {
 
 	output.VERBOSE.Printf("Connected to %s\n", clientOpts.Servers[0])
 
+	if err := sendPublishData(client, pubOpts); err != nil {
+		return err
+	}
+
+	output.VERBOSE.Printf("message sent\n")
+
+	return nil
+}
+
+// sendPublishData sends whichever of --message, --null-message, --file,
+// --stdin-line or --stdin-file was asked for on a connected client
+func sendPublishData(client mqttClient, pubOpts *publishOptions) error {
 	if pubOpts.message != "" {
 		// send a single message
-		client.Publish(pubOpts.topic, byte(pubOpts.qos), pubOpts.retain, pubOpts.message)
+		if err := publishMessage(client, pubOpts.topic, byte(pubOpts.qos), pubOpts.retain, pubOpts.message); err != nil {
+			return err
+		}
 	}
 
 	if pubOpts.doNullMsg {
 		// send a null message (actually an empty string)
-		client.Publish(pubOpts.topic, byte(pubOpts.qos), pubOpts.retain, "")
+		if err := publishMessage(client, pubOpts.topic, byte(pubOpts.qos), pubOpts.retain, ""); err != nil {
+			return err
+		}
 	}
 
 	if pubOpts.filePath != "" {
@@ -177,7 +291,9 @@ func runPublish(flags *pflag.FlagSet, zapOpts *zapOptions) error {
 			return err
 		}
 
-		client.Publish(pubOpts.topic, byte(pubOpts.qos), pubOpts.retain, string(buf))
+		if err := publishMessage(client, pubOpts.topic, byte(pubOpts.qos), pubOpts.retain, string(buf)); err != nil {
+			return err
+		}
 	}
 
 	if pubOpts.doStdinLine {
@@ -189,7 +305,15 @@ func runPublish(flags *pflag.FlagSet, zapOpts *zapOptions) error {
 			if err == io.EOF {
 				break
 			}
-			client.Publish(pubOpts.topic, byte(pubOpts.qos), pubOpts.retain, message)
+			if err := publishMessage(client, pubOpts.topic, byte(pubOpts.qos), pubOpts.retain, message); err != nil {
+				return err
+			}
+		}
+	}
+
+	if pubOpts.messageTemplate != nil {
+		if err := sendTemplateMessages(client, pubOpts); err != nil {
+			return err
 		}
 	}
 
@@ -198,10 +322,43 @@ func runPublish(flags *pflag.FlagSet, zapOpts *zapOptions) error {
 		if err != nil {
 			return err
 		}
-		client.Publish(pubOpts.topic, byte(pubOpts.qos), pubOpts.retain, data)
+		if err := publishMessage(client, pubOpts.topic, byte(pubOpts.qos), pubOpts.retain, data); err != nil {
+			return err
+		}
 	}
 
-	output.VERBOSE.Printf("message sent\n")
+	return nil
+}
+
+// sendTemplateMessages sends --repeat messages built from the template,
+// waiting --interval between them, until a signal arrives on quit
+func sendTemplateMessages(client mqttClient, pubOpts *publishOptions) error {
+	for seq := 1; pubOpts.repeat == 0 || seq <= pubOpts.repeat; seq++ {
+		if seq > 1 {
+			select {
+			case <-pubOpts.quit:
+				fmt.Println("signal received, exiting")
+				return nil
+			case <-time.After(pubOpts.interval):
+			}
+		}
 
+		message, err := buildTemplateMessage(pubOpts.messageTemplate, pubOpts.topic, seq)
+		if err != nil {
+			return err
+		}
+		if err := publishMessage(client, pubOpts.topic, byte(pubOpts.qos), pubOpts.retain, message); err != nil {
+			return err
+		}
+		output.VERBOSE.Printf("sent message %d\n", seq)
+	}
+	return nil
+}
+
+// publishMessage sends one message and waits for it to be sent
+func publishMessage(client mqttClient, topic string, qos byte, retain bool, payload interface{}) error {
+	if token := client.Publish(topic, qos, retain, payload); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("could not publish: %s", token.Error())
+	}
 	return nil
 }
@@ -1,8 +1,14 @@
 package cmd
 
 import (
+	"io/ioutil"
+	"os"
+	"regexp"
+	"syscall"
 	"testing"
+	"time"
 
+	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -21,11 +27,11 @@ func TestValidatePublishOptions(t *testing.T) {
 	// The test runs in the cmd dir so the path below exists
 	pubOpts.filePath = "publish_test.go"
 	err = pubOpts.validateOptions()
-	assert.Equal(t, "only one of --message, --file, --stdin-line, --stdin-file, or --null-message can be used", err.Error(), "error message not right")
+	assert.Equal(t, "only one of --message, --file, --stdin-line, --stdin-file, --template, or --null-message can be used", err.Error(), "error message not right")
 
 	pubOpts = publishOptions{}
 	err = pubOpts.validateOptions()
-	assert.Equal(t, "must specify one of --message, --file, --stdin-line, --stdin-file, or --null-message to send any data", err.Error(), "error message not right")
+	assert.Equal(t, "must specify one of --message, --file, --stdin-line, --stdin-file, --template, or --null-message to send any data", err.Error(), "error message not right")
 
 	pubOpts = publishOptions{
 		doNullMsg: true,
@@ -37,6 +43,16 @@ func TestValidatePublishOptions(t *testing.T) {
 	pubOpts.qos = 2
 	err = pubOpts.validateOptions()
 	assert.Nil(t, err)
+	assert.False(t, pubOpts.hasProperties())
+
+	pubOpts.userProperties = []string{"missing-equals"}
+	err = pubOpts.validateOptions()
+	assert.Equal(t, "--user-property must be of the form key=value: missing-equals", err.Error(), "error message not right")
+
+	pubOpts.userProperties = []string{"key=value"}
+	err = pubOpts.validateOptions()
+	assert.Nil(t, err)
+	assert.True(t, pubOpts.hasProperties())
 }
 
 func TestNewPublishCommand(t *testing.T) {
@@ -47,5 +63,118 @@ func TestNewPublishCommand(t *testing.T) {
 	assert.NotNil(t, flags.Lookup("stdin-line"))
 	assert.NotNil(t, flags.Lookup("stdin-file"))
 	assert.NotNil(t, flags.Lookup("null-message"))
+	assert.NotNil(t, flags.Lookup("user-property"))
+	assert.NotNil(t, flags.Lookup("content-type"))
+	assert.NotNil(t, flags.Lookup("response-topic"))
+	assert.NotNil(t, flags.Lookup("correlation-data"))
+	assert.NotNil(t, flags.Lookup("message-expiry"))
+	assert.NotNil(t, flags.Lookup("template"))
+	assert.NotNil(t, flags.Lookup("repeat"))
+	assert.NotNil(t, flags.Lookup("interval"))
 	assert.Nil(t, flags.Lookup("not-an-option"))
 }
+
+func TestValidatePublishTemplate(t *testing.T) {
+	pubOpts := publishOptions{templateStr: "{{.Seq}}", repeat: 3}
+	assert.NoError(t, pubOpts.validateOptions())
+	assert.NotNil(t, pubOpts.messageTemplate)
+
+	pubOpts = publishOptions{templateStr: "{{.Seq}}", repeat: -1}
+	assert.EqualError(t, pubOpts.validateOptions(), "--repeat can not be negative")
+
+	pubOpts = publishOptions{templateStr: "{{.Seq}}", interval: -1}
+	assert.EqualError(t, pubOpts.validateOptions(), "--interval can not be negative")
+
+	pubOpts = publishOptions{templateStr: "{{nope}}"}
+	assert.EqualError(t, pubOpts.validateOptions(), `template: publish:1: function "nope" not defined`)
+
+	pubOpts = publishOptions{message: "hello", repeat: 5, repeatSet: true}
+	assert.EqualError(t, pubOpts.validateOptions(), "--repeat and --interval can only be used with --template")
+
+	// even when what is given looks like the default
+	cmd := newPublishCommand()
+	cmd.SetArgs([]string{"--config", "../examples/example.zap.toml", "-m", "hello", "--repeat", "0"})
+	cmd.SetOutput(ioutil.Discard)
+	assert.EqualError(t, cmd.Execute(), "--repeat and --interval can only be used with --template")
+
+	cmd = newPublishCommand()
+	cmd.SetArgs([]string{"--config", "../examples/example.zap.toml", "-m", "hello", "--interval", "0s"})
+	cmd.SetOutput(ioutil.Discard)
+	assert.EqualError(t, cmd.Execute(), "--repeat and --interval can only be used with --template")
+}
+
+// recordingClient keeps the messages published to it
+type recordingClient struct {
+	mqttClient
+	topics   []string
+	payloads []string
+}
+
+func (c *recordingClient) Publish(topic string, qos byte, retained bool, payload interface{}) MQTT.Token {
+	c.topics = append(c.topics, topic)
+	c.payloads = append(c.payloads, payload.(string))
+	return &v5Token{done: closedChan()}
+}
+
+func TestSendTemplateMessages(t *testing.T) {
+	pubOpts := &publishOptions{
+		topic:       "sensors/1",
+		templateStr: `{"id":{{.Seq}},"topic":{{json .Topic}},"v":{{randInt 5 5}},"name":{{upper "a" | json}}}`,
+		repeat:      3,
+	}
+	assert.NoError(t, pubOpts.validateOptions())
+
+	client := &recordingClient{}
+	assert.NoError(t, sendPublishData(client, pubOpts))
+	assert.Equal(t, []string{
+		`{"id":1,"topic":"sensors/1","v":5,"name":"A"}`,
+		`{"id":2,"topic":"sensors/1","v":5,"name":"A"}`,
+		`{"id":3,"topic":"sensors/1","v":5,"name":"A"}`,
+	}, client.payloads)
+
+	pubOpts = &publishOptions{topic: "t", templateStr: "{{randInt 2 1}}", repeat: 1}
+	assert.NoError(t, pubOpts.validateOptions())
+	err := sendPublishData(&recordingClient{}, pubOpts)
+	assert.Contains(t, err.Error(), "randInt max 1 is less than min 2")
+}
+
+func TestSendTemplateMessagesUntilQuit(t *testing.T) {
+	quit := make(chan os.Signal, 1)
+	pubOpts := &publishOptions{topic: "t", templateStr: "{{.Seq}}", repeat: 0, interval: time.Millisecond, quit: quit}
+	assert.NoError(t, pubOpts.validateOptions())
+
+	client := &recordingClient{}
+	quit <- syscall.SIGTERM
+	assert.NoError(t, sendPublishData(client, pubOpts))
+	assert.Equal(t, []string{"1"}, client.payloads)
+}
+
+func TestGeneratorFunctions(t *testing.T) {
+	id, err := newUUID()
+	assert.NoError(t, err)
+	assert.Regexp(t, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`), id)
+	other, _ := newUUID()
+	assert.NotEqual(t, id, other)
+
+	for i := 0; i < 100; i++ {
+		n, err := randInt(-2, 2)
+		assert.NoError(t, err)
+		assert.True(t, n >= -2 && n <= 2)
+
+		f, err := randFloat(10, 20)
+		assert.NoError(t, err)
+		assert.True(t, f >= 10 && f <= 20)
+		assert.Equal(t, f, float64(int(f*100+0.5))/100)
+	}
+	_, err = randFloat(1, 0)
+	assert.EqualError(t, err, "randFloat max 0 is less than min 1")
+
+	choice, err := randChoice("on")
+	assert.NoError(t, err)
+	assert.Equal(t, "on", choice)
+	_, err = randChoice()
+	assert.EqualError(t, err, "randChoice needs something to choose from")
+
+	assert.Regexp(t, `^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ$`, now())
+	assert.Regexp(t, `^\d{4}$`, now("2006"))
+}
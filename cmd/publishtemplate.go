@@ -0,0 +1,111 @@
+// Copyright © 2017 Ray Johnson <ray.johnson@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"fmt"
+	"math"
+	"math/rand"
+	"text/template"
+	"time"
+)
+
+// templateData is what a --template message is built from
+type templateData struct {
+	Seq   int    // the number of the message, starting at 1
+	Topic string // the topic the message is sent to
+}
+
+// generatorFunctions make up the values of simulated messages
+var generatorFunctions = template.FuncMap{
+	"now":        now,
+	"unix":       func() int64 { return time.Now().Unix() },
+	"unixMilli":  func() int64 { return time.Now().UnixNano() / int64(time.Millisecond) },
+	"uuid":       newUUID,
+	"randInt":    randInt,
+	"randFloat":  randFloat,
+	"randChoice": randChoice,
+}
+
+var random = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// newPublishTemplate parses a --template, it can use the functions of
+// the subscribe templates as well as the generators
+func newPublishTemplate(text string) (*template.Template, error) {
+	return template.New("publish").Funcs(basicFunctions).Funcs(generatorFunctions).Parse(text)
+}
+
+// buildTemplateMessage fills in the template for message number seq
+func buildTemplateMessage(tmpl *template.Template, topic string, seq int) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, templateData{Seq: seq, Topic: topic}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// now returns the time in UTC formatted as RFC 3339, or with the layout
+// given
+func now(layout ...string) string {
+	if len(layout) > 0 {
+		return time.Now().UTC().Format(layout[0])
+	}
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() (string, error) {
+	var u [16]byte
+	if _, err := crand.Read(u[:]); err != nil {
+		return "", err
+	}
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:]), nil
+}
+
+// randInt returns a random integer from min up to and including max
+func randInt(min, max int) (int, error) {
+	if max < min {
+		return 0, fmt.Errorf("randInt max %d is less than min %d", max, min)
+	}
+	return min + random.Intn(max-min+1), nil
+}
+
+// randFloat returns a random number from min up to max, rounded to two
+// decimals so it reads like a sensor value
+func randFloat(min, max float64) (float64, error) {
+	if max < min {
+		return 0, fmt.Errorf("randFloat max %g is less than min %g", max, min)
+	}
+	v := min + random.Float64()*(max-min)
+	return math.Floor(v*100+0.5) / 100, nil
+}
+
+// randChoice returns one of its arguments at random
+func randChoice(choices ...interface{}) (interface{}, error) {
+	if len(choices) == 0 {
+		return nil, fmt.Errorf("randChoice needs something to choose from")
+	}
+	return choices[random.Intn(len(choices))], nil
+}
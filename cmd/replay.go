@@ -0,0 +1,161 @@
+// Copyright © 2017 Ray Johnson <ray.johnson@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/rayjohnson/zap/output"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+type replayOptions struct {
+	speed       float64
+	topicPrefix string
+	loop        bool
+}
+
+func newReplayCommand() *cobra.Command {
+	var zapOpts *zapOptions
+	replayOpts := &replayOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "replay <capture file>",
+		Args:  cobra.ExactArgs(1),
+		Short: "Republish messages from a capture file",
+		Long: `Republish the messages in a capture file made with zap subscribe --record
+
+Messages are sent with their original topic, qos and retained flag and with
+the same delay between them as when they were recorded.`,
+		Example: `.nf
+Replay a capture at twice the original speed under a test topic:
+.RS
+zap replay capture.jsonl \-\-speed 2 \-\-topic\-prefix test/
+.RE
+.fi`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runReplay(cmd.Flags(), zapOpts, replayOpts, args[0])
+		},
+		SilenceUsage:      true,
+		DisableAutoGenTag: true,
+	}
+	annotations := make(map[string]string)
+	annotations["man-files-section"] = filesManInfo
+	cmd.Annotations = annotations
+
+	flags := cmd.Flags()
+	flags.Float64Var(&replayOpts.speed, "speed", 1, "Multiplier for the replay speed, 0 sends as fast as possible")
+	flags.StringVar(&replayOpts.topicPrefix, "topic-prefix", "", "Prefix added to the topic of each message")
+	flags.BoolVar(&replayOpts.loop, "loop", false, "Start over at the end of the capture until Ctrl-C")
+
+	annotation := []string{"multiplier"}
+	flags.SetAnnotation("speed", "man-arg-hints", annotation)
+	annotation = []string{"topic path"}
+	flags.SetAnnotation("topic-prefix", "man-arg-hints", annotation)
+
+	zapOpts = buildZapFlags(flags)
+	zapOpts.conOpts = addConnectionFlags(flags)
+
+	return cmd
+}
+
+func (replayOpts *replayOptions) validateOptions() error {
+	if replayOpts.speed < 0 {
+		return fmt.Errorf("--speed can not be negative")
+	}
+
+	return nil
+}
+
+// delay returns how long to wait before sending a message recorded at
+// the given time when the previous one was recorded at prev
+func (replayOpts *replayOptions) delay(prev time.Time, next time.Time) time.Duration {
+	if replayOpts.speed == 0 || prev.IsZero() || !next.After(prev) {
+		return 0
+	}
+	return time.Duration(float64(next.Sub(prev)) / replayOpts.speed)
+}
+
+// errReplayStopped stops reading the capture when zap is interrupted
+var errReplayStopped = errors.New("replay stopped")
+
+func runReplay(flags *pflag.FlagSet, zapOpts *zapOptions, replayOpts *replayOptions, path string) error {
+	if err := zapOpts.processOptions(flags); err != nil {
+		return err
+	}
+	if err := replayOpts.validateOptions(); err != nil {
+		return err
+	}
+	clientOpts := zapOpts.clientOpts
+
+	quit := make(chan os.Signal, 1)
+	notifyQuit(quit)
+	defer signal.Stop(quit)
+
+	client := zapOpts.newClient()
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("could not connect: %s", token.Error())
+	}
+	defer client.Disconnect(250)
+
+	output.VERBOSE.Printf("Connected to %s\n", clientOpts.Servers[0])
+
+	for {
+		var prev time.Time
+		count := 0
+		err := readCapture(path, func(rec captureRecord) error {
+			select {
+			case <-quit:
+				return errReplayStopped
+			case <-time.After(replayOpts.delay(prev, rec.Time)):
+			}
+			prev = rec.Time
+
+			payload, err := rec.payloadBytes()
+			if err != nil {
+				return err
+			}
+			count++
+			return publishMessage(client, replayOpts.topicPrefix+rec.Topic, rec.Qos, rec.Retained, payload)
+		})
+		if err == errReplayStopped {
+			// the deferred Disconnect lets the messages in flight finish
+			fmt.Println("signal received, exiting")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		output.VERBOSE.Printf("replayed %d messages\n", count)
+
+		if !replayOpts.loop || count == 0 {
+			break
+		}
+	}
+
+	return nil
+}
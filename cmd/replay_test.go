@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayDelay(t *testing.T) {
+	start := time.Date(2017, 12, 6, 22, 38, 52, 0, time.UTC)
+	replayOpts := &replayOptions{speed: 1}
+
+	assert.Equal(t, time.Duration(0), replayOpts.delay(time.Time{}, start))
+	assert.Equal(t, 2*time.Second, replayOpts.delay(start, start.Add(2*time.Second)))
+	assert.Equal(t, time.Duration(0), replayOpts.delay(start, start.Add(-time.Second)))
+
+	replayOpts.speed = 4
+	assert.Equal(t, 500*time.Millisecond, replayOpts.delay(start, start.Add(2*time.Second)))
+
+	replayOpts.speed = 0
+	assert.Equal(t, time.Duration(0), replayOpts.delay(start, start.Add(2*time.Second)))
+
+	replayOpts.speed = -1
+	assert.Equal(t, "--speed can not be negative", replayOpts.validateOptions().Error())
+}
+
+func TestNewReplayCommand(t *testing.T) {
+	cmd := newReplayCommand()
+	flags := cmd.Flags()
+	assert.NotNil(t, flags.Lookup("speed"))
+	assert.NotNil(t, flags.Lookup("topic-prefix"))
+	assert.NotNil(t, flags.Lookup("loop"))
+	assert.NotNil(t, flags.Lookup("server"))
+}
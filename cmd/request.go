@@ -0,0 +1,250 @@
+// Copyright © 2017 Ray Johnson <ray.johnson@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rayjohnson/zap/output"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+type requestOptions struct {
+	topic          string
+	responseTopic  string
+	correlationID  string
+	message        string
+	timeout        time.Duration
+	qos            int
+	templateString string
+
+	messageTemplate *template.Template
+	stdoutTemplate  *template.Template
+}
+
+// requestData is passed to the template engine to build the request message
+type requestData struct {
+	ResponseTopic string
+	CorrelationID string
+}
+
+func newRequestCommand() *cobra.Command {
+	var zapOpts *zapOptions
+	reqOpts := &requestOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "request",
+		Args:  cobra.NoArgs,
+		Short: "Send a request and wait for the response",
+		Long: `Send a request message and wait for the response
+
+The request command subscribes to the response topic, publishes the message
+and prints the first matching response using the same --template as the
+subscribe command.  It exits with an error if no response arrives in time.
+
+With --protocol-version 5 the response topic and correlation id are sent as
+MQTT 5 properties and a response matches if it has the same correlation data.
+Older protocols have no place for them so the message is a template that can
+use {{.ResponseTopic}} and {{.CorrelationID}} to tell the responder where to
+reply.  If the message contains the correlation id only responses containing
+it will match.  Retained messages on the response topic are never taken as
+the response.`,
+		Example: `.nf
+Call a device using MQTT 5:
+.RS
+zap request \-\-protocol\-version 5 \-\-topic cmd/device1 \-m '{"cmd":"status"}'
+.RE
+Call a device that expects the reply topic in the message:
+.RS
+zap request \-\-topic cmd/device1
+\-m '{"cmd":"status","replyTo":"{{.ResponseTopic}}","id":"{{.CorrelationID}}"}'
+.RE
+.fi`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runRequest(cmd.Flags(), zapOpts, reqOpts)
+		},
+		SilenceUsage:      true,
+		DisableAutoGenTag: true,
+	}
+	annotations := make(map[string]string)
+	annotations["man-files-section"] = filesManInfo
+	cmd.Annotations = annotations
+
+	flags := cmd.Flags()
+	flags.StringVar(&reqOpts.topic, "topic", "", "Topic to send the request to")
+	flags.StringVar(&reqOpts.responseTopic, "response-topic", "", "Topic to wait for the response on (default is reply/zap-<client id>)")
+	flags.StringVar(&reqOpts.correlationID, "correlation-id", "", "Id used to match the response to the request (default is generated)")
+	flags.StringVarP(&reqOpts.message, "message", "m", "", "The request message, may use {{.ResponseTopic}} and {{.CorrelationID}}")
+	flags.DurationVar(&reqOpts.timeout, "timeout", 5*time.Second, "Time to wait for the response")
+	flags.IntVar(&reqOpts.qos, "qos", 0, "The qos setting for the request and response")
+	flags.StringVar(&reqOpts.templateString, "template", builtinTemplate, "Template to use for printing the response")
+
+	annotation := []string{"topic path"}
+	flags.SetAnnotation("topic", "man-arg-hints", annotation)
+	flags.SetAnnotation("response-topic", "man-arg-hints", annotation)
+	annotation = []string{"id"}
+	flags.SetAnnotation("correlation-id", "man-arg-hints", annotation)
+	annotation = []string{"data"}
+	flags.SetAnnotation("message", "man-arg-hints", annotation)
+	annotation = []string{"duration"}
+	flags.SetAnnotation("timeout", "man-arg-hints", annotation)
+	annotation = []string{"0|1|2"}
+	flags.SetAnnotation("qos", "man-arg-hints", annotation)
+	annotation = []string{"go template"}
+	flags.SetAnnotation("template", "man-arg-hints", annotation)
+
+	zapOpts = buildZapFlags(flags)
+	zapOpts.conOpts = addConnectionFlags(flags)
+
+	return cmd
+}
+
+func (reqOpts *requestOptions) validateOptions() error {
+	var err error
+
+	if reqOpts.topic == "" {
+		return fmt.Errorf("--topic is required")
+	}
+	if strings.ContainsAny(reqOpts.topic, "+#") || strings.ContainsAny(reqOpts.responseTopic, "+#") {
+		return fmt.Errorf("--topic and --response-topic can not use wild cards")
+	}
+	if reqOpts.timeout <= 0 {
+		return fmt.Errorf("--timeout must be greater than 0")
+	}
+	if reqOpts.qos < 0 || reqOpts.qos > 2 {
+		return fmt.Errorf("--qos value must or 0, 1 or 2")
+	}
+
+	reqOpts.messageTemplate, err = template.New("message").Funcs(basicFunctions).Parse(reqOpts.message)
+	if err != nil {
+		return err
+	}
+	reqOpts.stdoutTemplate, err = template.New("stdout").Funcs(basicFunctions).Parse(reqOpts.templateString)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// buildMessage fills in the message template
+func (reqOpts *requestOptions) buildMessage() (string, error) {
+	var buf bytes.Buffer
+	data := requestData{ResponseTopic: reqOpts.responseTopic, CorrelationID: reqOpts.correlationID}
+	if err := reqOpts.messageTemplate.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// isResponse decides if a message on the response topic answers our request
+func (reqOpts *requestOptions) isResponse(msg MQTT.Message, checkPayload bool) bool {
+	// a retained message was left on the topic before our request was sent
+	if msg.Retained() {
+		return false
+	}
+	if v5Msg, ok := msg.(*v5Message); ok {
+		return v5Msg.properties().CorrelationData == reqOpts.correlationID
+	}
+	if checkPayload {
+		return bytes.Contains(msg.Payload(), []byte(reqOpts.correlationID))
+	}
+	return true
+}
+
+func runRequest(flags *pflag.FlagSet, zapOpts *zapOptions, reqOpts *requestOptions) error {
+	if err := zapOpts.processOptions(flags); err != nil {
+		return err
+	}
+	clientOpts := zapOpts.clientOpts
+
+	if reqOpts.responseTopic == "" {
+		reqOpts.responseTopic = "reply/zap-" + clientOpts.ClientID
+	}
+	if reqOpts.correlationID == "" {
+		reqOpts.correlationID = clientOpts.ClientID + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	if err := reqOpts.validateOptions(); err != nil {
+		return err
+	}
+
+	message, err := reqOpts.buildMessage()
+	if err != nil {
+		return err
+	}
+	// without MQTT 5 the only way to match a response is the payload
+	checkPayload := strings.Contains(message, reqOpts.correlationID)
+
+	// with MQTT 5 the client sends these as properties on every publish
+	zapOpts.pubOpts = &publishOptions{
+		responseTopic:   reqOpts.responseTopic,
+		correlationData: reqOpts.correlationID,
+	}
+
+	client := zapOpts.newClient()
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("could not connect: %s", token.Error())
+	}
+	defer client.Disconnect(250)
+
+	output.VERBOSE.Printf("Connected to %s\n", clientOpts.Servers[0])
+
+	responses := make(chan MQTT.Message, 1)
+	if token := client.Subscribe(reqOpts.responseTopic, byte(reqOpts.qos), func(client MQTT.Client, msg MQTT.Message) {
+		if reqOpts.isResponse(msg, checkPayload) {
+			select {
+			case responses <- msg:
+			default:
+				// we already have our response
+			}
+		}
+	}); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("could not subscribe: %s", token.Error())
+	}
+	defer client.Unsubscribe(reqOpts.responseTopic)
+
+	output.VERBOSE.Printf("Sending request to %s, waiting on %s for %s\n", reqOpts.topic, reqOpts.responseTopic, reqOpts.correlationID)
+	if err := publishMessage(client, reqOpts.topic, byte(reqOpts.qos), false, message); err != nil {
+		return err
+	}
+
+	select {
+	case msg := <-responses:
+		var buf bytes.Buffer
+		data := newMqttMessage(msg, "", decodeJSON)
+		if err := reqOpts.stdoutTemplate.Execute(&buf, data); err != nil {
+			return fmt.Errorf("error using template: %s", err)
+		}
+		fmt.Printf("%s", buf.String())
+	case <-time.After(reqOpts.timeout):
+		return fmt.Errorf("no response on %s after %s", reqOpts.responseTopic, reqOpts.timeout)
+	}
+
+	return nil
+}
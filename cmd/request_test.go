@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateRequestOptions(t *testing.T) {
+	reqOpts := &requestOptions{timeout: time.Second}
+	assert.Equal(t, "--topic is required", reqOpts.validateOptions().Error())
+
+	reqOpts = &requestOptions{topic: "cmd/+", timeout: time.Second}
+	assert.Equal(t, "--topic and --response-topic can not use wild cards", reqOpts.validateOptions().Error())
+
+	reqOpts = &requestOptions{topic: "cmd/device1", timeout: time.Second, message: "{{"}
+	assert.Contains(t, reqOpts.validateOptions().Error(), "template: message:1:")
+}
+
+func TestRequestMessage(t *testing.T) {
+	reqOpts := &requestOptions{
+		topic:          "cmd/device1",
+		responseTopic:  "reply/zap-1",
+		correlationID:  "abc123",
+		message:        `{"replyTo":"{{.ResponseTopic}}","id":"{{.CorrelationID}}"}`,
+		timeout:        time.Second,
+		templateString: builtinTemplate,
+	}
+	assert.Nil(t, reqOpts.validateOptions())
+
+	message, err := reqOpts.buildMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"replyTo":"reply/zap-1","id":"abc123"}`, message)
+
+	assert.True(t, reqOpts.isResponse(&testMessage{topic: "reply/zap-1", payload: []byte(`{"id":"abc123"}`)}, true))
+	assert.False(t, reqOpts.isResponse(&testMessage{topic: "reply/zap-1", payload: []byte(`{"id":"other"}`)}, true))
+	assert.True(t, reqOpts.isResponse(&testMessage{topic: "reply/zap-1", payload: []byte(`{"id":"other"}`)}, false))
+
+	// a stale retained message never answers the request
+	stale := &testMessage{topic: "reply/zap-1", payload: []byte(`{"id":"abc123"}`), retained: true}
+	assert.False(t, reqOpts.isResponse(stale, true))
+	assert.False(t, reqOpts.isResponse(stale, false))
+}
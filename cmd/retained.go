@@ -0,0 +1,403 @@
+// Copyright © 2017 Ray Johnson <ray.johnson@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rayjohnson/zap/output"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+type retainedOptions struct {
+	wait      time.Duration
+	timeField string
+	dryRun    bool
+	qos       int
+}
+
+// retainedMessage is a retained message collected from the broker
+type retainedMessage struct {
+	topic   string
+	payload []byte
+}
+
+// retainedNode is one level of the topic tree printed by retained list
+type retainedNode struct {
+	name     string
+	children map[string]*retainedNode
+	msg      *retainedMessage
+}
+
+func newRetainedCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "retained",
+		Args:  cobra.NoArgs,
+		Short: "List or clear retained messages",
+		Long: `List or clear the retained messages on a broker
+
+The retained commands subscribe to a topic filter for a moment and only
+look at the messages the broker sends because they are retained.  They
+stop once no more retained messages arrive for the --wait time.`,
+		DisableAutoGenTag: true,
+	}
+
+	cmd.AddCommand(
+		newRetainedListCommand(),
+		newRetainedClearCommand(),
+	)
+
+	return cmd
+}
+
+func newRetainedListCommand() *cobra.Command {
+	var zapOpts *zapOptions
+	retOpts := &retainedOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "list [filter]",
+		Args:  cobra.MaximumNArgs(1),
+		Short: "Show a tree of the retained messages",
+		Long: `Show a tree of the retained messages matching a topic filter
+
+Each topic with a retained message shows the size of the payload.  MQTT
+does not record when a message was published, so the age is only shown
+if the payload is JSON with a timestamp in the --time-field field, either
+as RFC 3339 text or as seconds or milliseconds since the epoch.  The
+filter defaults to #.`,
+		Example: `.nf
+Show everything retained under sensors:
+.RS
+zap retained list 'sensors/#'
+.RE
+.fi`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runRetainedList(cmd.Flags(), zapOpts, retOpts, retainedFilter(args))
+		},
+		SilenceUsage:      true,
+		DisableAutoGenTag: true,
+	}
+	annotations := make(map[string]string)
+	annotations["man-files-section"] = filesManInfo
+	cmd.Annotations = annotations
+
+	flags := cmd.Flags()
+	addRetainedWaitFlag(flags, retOpts)
+	flags.StringVar(&retOpts.timeField, "time-field", "timestamp", "JSON field of the payload holding the time it was published")
+
+	annotation := []string{"field"}
+	flags.SetAnnotation("time-field", "man-arg-hints", annotation)
+
+	zapOpts = buildZapFlags(flags)
+	zapOpts.conOpts = addConnectionFlags(flags)
+
+	return cmd
+}
+
+func newRetainedClearCommand() *cobra.Command {
+	var zapOpts *zapOptions
+	retOpts := &retainedOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "clear <filter>",
+		Args:  cobra.ExactArgs(1),
+		Short: "Clear the retained messages matching a topic filter",
+		Long: `Clear the retained messages matching a topic filter
+
+Each topic with a retained message is sent a zero length retained message,
+which is how MQTT removes it.  Use --dry-run first to see what would be
+cleared.`,
+		Example: `.nf
+See what would be cleared under a decommissioned site:
+.RS
+zap retained clear 'site/old/#' \-\-dry\-run
+.RE
+.fi`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runRetainedClear(cmd.Flags(), zapOpts, retOpts, args[0])
+		},
+		SilenceUsage:      true,
+		DisableAutoGenTag: true,
+	}
+	annotations := make(map[string]string)
+	annotations["man-files-section"] = filesManInfo
+	cmd.Annotations = annotations
+
+	flags := cmd.Flags()
+	addRetainedWaitFlag(flags, retOpts)
+	flags.BoolVar(&retOpts.dryRun, "dry-run", false, "Only print the topics that would be cleared")
+	flags.IntVar(&retOpts.qos, "qos", 1, "The qos setting for the messages that clear the topics")
+
+	annotation := []string{"0|1|2"}
+	flags.SetAnnotation("qos", "man-arg-hints", annotation)
+
+	zapOpts = buildZapFlags(flags)
+	zapOpts.conOpts = addConnectionFlags(flags)
+
+	return cmd
+}
+
+func addRetainedWaitFlag(flags *pflag.FlagSet, retOpts *retainedOptions) {
+	flags.DurationVar(&retOpts.wait, "wait", time.Second, "Stop once no retained message has arrived for this long")
+
+	annotation := []string{"duration"}
+	flags.SetAnnotation("wait", "man-arg-hints", annotation)
+}
+
+func retainedFilter(args []string) string {
+	if len(args) == 0 {
+		return "#"
+	}
+	return args[0]
+}
+
+func (retOpts *retainedOptions) validateOptions() error {
+	if retOpts.wait <= 0 {
+		return fmt.Errorf("--wait must be greater than 0")
+	}
+	if retOpts.qos < 0 || retOpts.qos > 2 {
+		return fmt.Errorf("--qos value must or 0, 1 or 2")
+	}
+
+	return nil
+}
+
+// connectForRetained processes the options and connects to the broker
+func connectForRetained(flags *pflag.FlagSet, zapOpts *zapOptions, retOpts *retainedOptions) (mqttClient, error) {
+	if err := zapOpts.processOptions(flags); err != nil {
+		return nil, err
+	}
+	if err := retOpts.validateOptions(); err != nil {
+		return nil, err
+	}
+
+	client := zapOpts.newClient()
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, fmt.Errorf("could not connect: %s", token.Error())
+	}
+
+	output.VERBOSE.Printf("Connected to %s\n", zapOpts.clientOpts.Servers[0])
+	return client, nil
+}
+
+func runRetainedList(flags *pflag.FlagSet, zapOpts *zapOptions, retOpts *retainedOptions, filter string) error {
+	client, err := connectForRetained(flags, zapOpts, retOpts)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(250)
+
+	msgs, err := collectRetained(client, filter, retOpts.wait)
+	if err != nil {
+		return err
+	}
+
+	printRetainedTree(os.Stdout, buildRetainedTree(msgs), retOpts.timeField, time.Now())
+
+	var total int
+	for _, msg := range msgs {
+		total += len(msg.payload)
+	}
+	fmt.Printf("%d retained messages, %s\n", len(msgs), formatSize(total))
+
+	return nil
+}
+
+func runRetainedClear(flags *pflag.FlagSet, zapOpts *zapOptions, retOpts *retainedOptions, filter string) error {
+	client, err := connectForRetained(flags, zapOpts, retOpts)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(250)
+
+	msgs, err := collectRetained(client, filter, retOpts.wait)
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		if retOpts.dryRun {
+			fmt.Printf("would clear %s\n", msg.topic)
+			continue
+		}
+
+		// the same as zap publish --null-message --retain
+		pubOpts := &publishOptions{topic: msg.topic, qos: retOpts.qos, retain: true, doNullMsg: true}
+		if err := sendPublishData(client, pubOpts); err != nil {
+			return err
+		}
+		fmt.Printf("cleared %s\n", msg.topic)
+	}
+
+	if retOpts.dryRun {
+		fmt.Printf("%d retained messages would be cleared\n", len(msgs))
+	} else {
+		fmt.Printf("%d retained messages cleared\n", len(msgs))
+	}
+	return nil
+}
+
+// collectRetained subscribes to the filter and returns the retained
+// messages sent by the broker, sorted by topic.  It stops once none have
+// arrived for the wait time.
+func collectRetained(client mqttClient, filter string, wait time.Duration) ([]retainedMessage, error) {
+	var mu sync.Mutex
+	found := make(map[string]retainedMessage)
+	arrived := make(chan bool, 1)
+
+	if token := client.Subscribe(filter, 1, func(client MQTT.Client, msg MQTT.Message) {
+		if !msg.Retained() {
+			return
+		}
+		mu.Lock()
+		if len(msg.Payload()) == 0 {
+			delete(found, msg.Topic())
+		} else {
+			found[msg.Topic()] = retainedMessage{topic: msg.Topic(), payload: msg.Payload()}
+		}
+		mu.Unlock()
+
+		select {
+		case arrived <- true:
+		default:
+		}
+	}); token.Wait() && token.Error() != nil {
+		return nil, fmt.Errorf("could not subscribe: %s", token.Error())
+	}
+
+	timer := time.NewTimer(wait)
+loop:
+	for {
+		select {
+		case <-arrived:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(wait)
+		case <-timer.C:
+			break loop
+		}
+	}
+
+	if token := client.Unsubscribe(filter); token.Wait() && token.Error() != nil {
+		return nil, fmt.Errorf("could not unsubscribe: %s", token.Error())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var msgs []retainedMessage
+	for _, msg := range found {
+		msgs = append(msgs, msg)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].topic < msgs[j].topic })
+	return msgs, nil
+}
+
+func buildRetainedTree(msgs []retainedMessage) *retainedNode {
+	root := &retainedNode{children: make(map[string]*retainedNode)}
+	for i := range msgs {
+		node := root
+		for _, level := range strings.Split(msgs[i].topic, "/") {
+			child, ok := node.children[level]
+			if !ok {
+				child = &retainedNode{name: level, children: make(map[string]*retainedNode)}
+				node.children[level] = child
+			}
+			node = child
+		}
+		node.msg = &msgs[i]
+	}
+	return root
+}
+
+// printRetainedTree prints the tree indented two spaces per level
+func printRetainedTree(w io.Writer, root *retainedNode, timeField string, now time.Time) {
+	var walk func(node *retainedNode, indent string)
+	walk = func(node *retainedNode, indent string) {
+		var names []string
+		for name := range node.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			child := node.children[name]
+			label := name
+			if label == "" {
+				label = `""`
+			}
+			if child.msg != nil {
+				info := formatSize(len(child.msg.payload))
+				if published, ok := payloadTime(child.msg.payload, timeField); ok {
+					info += ", " + now.Sub(published).Round(time.Second).String() + " old"
+				}
+				label += " (" + info + ")"
+			}
+			fmt.Fprintf(w, "%s%s\n", indent, label)
+			walk(child, indent+"  ")
+		}
+	}
+	walk(root, "")
+}
+
+// payloadTime finds when a JSON payload says it was published
+func payloadTime(payload []byte, field string) (time.Time, bool) {
+	if field == "" {
+		return time.Time{}, false
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return time.Time{}, false
+	}
+
+	switch v := doc[field].(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339, v)
+		return t, err == nil
+	case float64:
+		// anything this big must be milliseconds
+		if v > 1e11 {
+			return time.Unix(0, int64(v*float64(time.Millisecond))), true
+		}
+		return time.Unix(0, int64(v*float64(time.Second))), true
+	}
+	return time.Time{}, false
+}
+
+func formatSize(size int) string {
+	switch {
+	case size < 1024:
+		return fmt.Sprintf("%d B", size)
+	case size < 1024*1024:
+		return fmt.Sprintf("%.1f KiB", float64(size)/1024)
+	}
+	return fmt.Sprintf("%.1f MiB", float64(size)/(1024*1024))
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetainedTree(t *testing.T) {
+	now := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	msgs := []retainedMessage{
+		{topic: "sensors/kitchen/temp", payload: []byte(`{"temp":21,"timestamp":"2017-10-01T11:58:30Z"}`)},
+		{topic: "sensors/kitchen", payload: []byte("on")},
+		{topic: "sensors/attic/temp", payload: []byte(`{"temp":30,"timestamp":1506859140}`)},
+		{topic: "/leading", payload: make([]byte, 2048)},
+	}
+
+	var buf bytes.Buffer
+	printRetainedTree(&buf, buildRetainedTree(msgs), "timestamp", now)
+	assert.Equal(t, `""
+  leading (2.0 KiB)
+sensors
+  attic
+    temp (34 B, 1m0s old)
+  kitchen (2 B)
+    temp (46 B, 1m30s old)
+`, buf.String())
+}
+
+func TestPayloadTime(t *testing.T) {
+	ts, ok := payloadTime([]byte(`{"ts":1506859140123}`), "ts")
+	assert.True(t, ok)
+	assert.Equal(t, int64(1506859140123), ts.UnixNano()/int64(time.Millisecond))
+
+	_, ok = payloadTime([]byte(`{"ts":"yesterday"}`), "ts")
+	assert.False(t, ok)
+	_, ok = payloadTime([]byte(`not json`), "ts")
+	assert.False(t, ok)
+	_, ok = payloadTime([]byte(`{"ts":1506859140}`), "")
+	assert.False(t, ok)
+}
+
+func TestValidateRetainedOptions(t *testing.T) {
+	retOpts := &retainedOptions{wait: time.Second, qos: 1}
+	assert.NoError(t, retOpts.validateOptions())
+
+	retOpts.wait = 0
+	assert.EqualError(t, retOpts.validateOptions(), "--wait must be greater than 0")
+
+	retOpts = &retainedOptions{wait: time.Second, qos: 3}
+	assert.EqualError(t, retOpts.validateOptions(), "--qos value must or 0, 1 or 2")
+
+	assert.Equal(t, "#", retainedFilter(nil))
+	assert.Equal(t, "a/#", retainedFilter([]string{"a/#"}))
+}
@@ -22,7 +22,7 @@ package cmd
 
 import (
 	"fmt"
-	"github.com/docker/docker/pkg/term"
+	"github.com/moby/term"
 	"github.com/spf13/cobra"
 	"os"
 )
@@ -65,10 +65,23 @@ func Execute(version string, revision string) {
 	rootCmd := SetupRootCommand(version, revision)
 
 	if err := rootCmd.Execute(); err != nil {
+		if exit, ok := err.(*exitError); ok {
+			os.Exit(exit.code)
+		}
 		os.Exit(1)
 	}
 }
 
+// exitError is returned by a command that printed its own result and needs
+// zap to exit with a particular code
+type exitError struct {
+	code int
+}
+
+func (e *exitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
 // SetupRootCommand sets of the cobra data structures for command line processing
 func SetupRootCommand(version string, revision string) *cobra.Command {
 	// rootCmd represents the base command when called without any subcommands
@@ -98,6 +111,13 @@ MQTT message bus`,
 		newSubscribeCommand(),
 		newPublishCommand(),
 		newStatsCommand(),
+		newReplayCommand(),
+		newBenchCommand(),
+		newPingCommand(),
+		newRequestCommand(),
+		newBrokerCommand(version),
+		newRetainedCommand(),
+		newExploreCommand(),
 	)
 	rootCmd.SetUsageTemplate(usageTemplate)
 
@@ -22,8 +22,16 @@ package cmd
 
 import (
 	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"syscall"
+	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pelletier/go-toml"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 
@@ -34,8 +42,23 @@ import (
 const statsTopic = "$SYS/#"
 const statsQos = 0
 
+type statsOptions struct {
+	once    bool
+	check   bool
+	format  string
+	timeout time.Duration
+	serve   string
+	profile string
+
+	log       string
+	logFormat string
+	interval  time.Duration
+	noUI      bool
+}
+
 func newStatsCommand() *cobra.Command {
 	var zapOpts *zapOptions
+	statsOpts := &statsOptions{}
 
 	cmd := &cobra.Command{
 		Use:   "stats",
@@ -45,9 +68,83 @@ func newStatsCommand() *cobra.Command {
 
 The stats command subscribes to the brokers $SYS/# topics to get and
 display statistics for how the broker is running.  Not all brokers show
-the same information and you need to have permission to view those topics.`,
+the same information and you need to have permission to view those topics.
+
+Repeat \-\-broker to watch several brokers from the config file at once.
+The UI then has a tab for each broker, switch between them with Tab, the
+arrow keys or the number of the tab.  A broker that can not be reached is
+shown as disconnected and zap keeps trying to connect to it.
+
+In the UI ? shows the keys.  The up and down arrows, PgUp and PgDn scroll a
+dashboard taller than the terminal, P pauses the updates and R restarts
+the session timer.  On a narrow terminal the columns are stacked.
+
+Brokers lay out their $SYS topics differently.  A profile maps the topics
+of a kind of broker to the stats zap shows; emqx, hivemq, vernemq and
+mosquitto are built in and more can be defined in the config file.  The
+profile is detected from the topics the broker sends, or can be given
+with \-\-profile.  Topics the profile does not know are listed in the
+Unknown Metrics panel.
+
+The panels of the UI, the stats in them, their columns and colors for
+stats that pass a threshold can be set in the stats-layout table of the
+config file.
+
+With \-\-once no terminal UI is used.  Instead zap waits until all the
+stats it knows about have arrived, or the timeout is reached, prints them
+in the chosen format and exits.  This is handy for cron jobs and health
+checks.
+
+With \-\-serve zap runs without the UI and serves the stats as Prometheus
+metrics on /metrics until interrupted.  The name of each broker given
+with \-\-broker is added as a label to every metric.
+
+With \-\-log the stats of each broker are appended to a file every
+\-\-interval, as csv or as a line of json.  This works with the UI,
+with \-\-serve or with \-\-no\-ui, which collects the stats without the UI
+until interrupted.
+
+Alert rules like "clients.connected < 10" can be put in the stats-alerts
+table of the config file.  The UI shows the rules that fire, and the stats
+they are about, in red.  With \-\-check zap instead checks the rules once
+and exits like a Nagios plugin: 0 for OK, 1 for WARNING, 2 for CRITICAL
+and 3 for UNKNOWN, with a line of output saying why.`,
+		Example: `.nf
+Print the stats of the broker in config named mosquitto as json:
+.RS
+zap stats \-b mosquitto \-\-once \-\-format json
+.RE
+Write stats for the node_exporter textfile collector:
+.RS
+zap stats \-\-once \-\-format prometheus > /var/lib/node_exporter/mqtt.prom
+.RE
+Export the stats of the broker in config named mosquitto to Prometheus:
+.RS
+zap stats \-b mosquitto \-\-serve :9234
+.RE
+Log the stats to a csv file every minute overnight without the UI:
+.RS
+zap stats \-b mosquitto \-\-no\-ui \-\-log stats.csv \-\-interval 1m
+.RE
+Check the alert rules of the config file from Nagios:
+.RS
+zap stats \-b mosquitto \-\-check
+.RE
+Watch two brokers from the config file, each in its own tab:
+.RS
+zap stats \-b prod \-b staging
+.RE
+.fi`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runStats(cmd.Flags(), zapOpts)
+			err := runStats(cmd.Flags(), zapOpts, statsOpts)
+			if statsOpts.check {
+				err = checkError(err)
+			}
+			if _, ok := err.(*exitError); ok {
+				// --check has already printed why
+				cmd.SilenceErrors = true
+			}
+			return err
 		},
 		SilenceUsage:      true,
 		DisableAutoGenTag: true,
@@ -57,53 +154,518 @@ the same information and you need to have permission to view those topics.`,
 	cmd.Annotations = annotations
 
 	flags := cmd.Flags()
+	flags.BoolVar(&statsOpts.once, "once", false, "Print a snapshot of the stats and exit instead of showing the UI")
+	flags.BoolVar(&statsOpts.check, "check", false, "Check the stats-alerts rules of the config file like a Nagios plugin and exit")
+	flags.StringVar(&statsOpts.format, "format", "table", "Output format for --once: json, table or prometheus")
+	flags.DurationVar(&statsOpts.timeout, "timeout", 5*time.Second, "How long --once or --check waits for the stats to arrive")
+	flags.StringVar(&statsOpts.serve, "serve", "", "Serve the stats as Prometheus metrics on this address instead of showing the UI")
+	flags.StringVar(&statsOpts.profile, "profile", "", "Profile mapping the $SYS topics of the broker to stats (default is to detect it)")
+	flags.StringVar(&statsOpts.log, "log", "", "Append the stats to this file every --interval")
+	flags.StringVar(&statsOpts.logFormat, "log-format", "", "Format of the --log file: csv or jsonl (default is from the file extension)")
+	flags.DurationVar(&statsOpts.interval, "interval", 10*time.Second, "How often the stats are written to the --log file")
+	flags.BoolVar(&statsOpts.noUI, "no-ui", false, "Collect the stats without showing the UI until interrupted, e.g. for --log")
+
+	// Flag annotations to help make docs more clear
+	annotation := []string{"json|table|prometheus"}
+	flags.SetAnnotation("format", "man-arg-hints", annotation)
+	annotation = []string{"duration"}
+	flags.SetAnnotation("timeout", "man-arg-hints", annotation)
+	annotation = []string{"address"}
+	flags.SetAnnotation("serve", "man-arg-hints", annotation)
+	annotation = []string{"name"}
+	flags.SetAnnotation("profile", "man-arg-hints", annotation)
+	annotation = []string{"file"}
+	flags.SetAnnotation("log", "man-arg-hints", annotation)
+	annotation = []string{"csv|jsonl"}
+	flags.SetAnnotation("log-format", "man-arg-hints", annotation)
+	annotation = []string{"duration"}
+	flags.SetAnnotation("interval", "man-arg-hints", annotation)
+
 	zapOpts = buildZapFlags(flags)
 	zapOpts.conOpts = addConnectionFlags(flags)
 
 	return cmd
 }
 
-func runStats(flags *pflag.FlagSet, zapOpts *zapOptions) error {
-	if err := zapOpts.processOptions(flags); err != nil {
+func (statsOpts *statsOptions) validateOptions() error {
+	if _, ok := statsFormatters[statsOpts.format]; !ok {
+		return fmt.Errorf("--format must be one of json, table or prometheus")
+	}
+	if statsOpts.timeout <= 0 {
+		return fmt.Errorf("--timeout must be greater than 0")
+	}
+	modes := 0
+	for _, set := range []bool{statsOpts.once, statsOpts.check, statsOpts.serve != "", statsOpts.noUI} {
+		if set {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return fmt.Errorf("only one of --once, --check, --serve or --no-ui can be used")
+	}
+	if statsOpts.log != "" && (statsOpts.once || statsOpts.check) {
+		return fmt.Errorf("--log can not be used with --once or --check")
+	}
+	if statsOpts.logFormat != "" && statsOpts.logFormat != "csv" && statsOpts.logFormat != "jsonl" {
+		return fmt.Errorf("--log-format must be one of csv or jsonl")
+	}
+	if statsOpts.interval <= 0 {
+		return fmt.Errorf("--interval must be greater than 0")
+	}
+	return nil
+}
+
+func runStats(flags *pflag.FlagSet, zapOpts *zapOptions, statsOpts *statsOptions) error {
+	// each broker gets its own options from its section of the config file
+	names := zapOpts.brokers
+	brokerOpts := []*zapOptions{zapOpts}
+	if len(names) > 1 {
+		brokerOpts = nil
+		for _, name := range names {
+			brokerOpts = append(brokerOpts, zapOpts.forBroker(name))
+		}
+	}
+	for _, opts := range brokerOpts {
+		if err := opts.processOptions(flags); err != nil {
+			return err
+		}
+		if err := opts.rejectProtocolVersion5("stats"); err != nil {
+			return err
+		}
+	}
+	if err := statsOpts.validateOptions(); err != nil {
+		return err
+	}
+
+	// listen before connecting so a bad address is reported right away
+	var metricsListener net.Listener
+	if statsOpts.serve != "" {
+		l, err := net.Listen("tcp", statsOpts.serve)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		metricsListener = l
+	}
+
+	if err := loadStatsProfiles(zapOpts.configRoot); err != nil {
+		return err
+	}
+	if err := loadStatsLayout(zapOpts.configRoot); err != nil {
+		return err
+	}
+	ruleCount, err := loadStatsAlerts(zapOpts.configRoot)
+	if err != nil {
 		return err
 	}
+	if statsOpts.check && ruleCount == 0 {
+		fmt.Println("MQTT UNKNOWN - there are no stats-alerts rules in the config file")
+		return &exitError{checkUnknown}
+	}
+	viewstats.PrepViewer(names...)
+	for i, opts := range brokerOpts {
+		// a section of the config file can say which profile its broker needs
+		profile := statsOpts.profile
+		if opts.configTree != nil {
+			profile = getValueFromConfig(flags, opts.configTree, "profile", profile).(string)
+		}
+		if profile == "" {
+			continue
+		}
+		if err := viewstats.SetProfile(i, profile); err != nil {
+			return err
+		}
+	}
+
+	connectChan := make(chan viewstats.ConnectHandler, len(brokerOpts))
+	stop := make(chan struct{})
+	defer close(stop)
+	for i, opts := range brokerOpts {
+		client, err := connectStats(i, opts, connectChan)
+		if err != nil {
+			if len(brokerOpts) == 1 {
+				if statsOpts.check {
+					fmt.Printf("MQTT CRITICAL - %s\n", err)
+					return &exitError{checkCritical}
+				}
+				return err
+			}
+			// keep watching the other brokers and show this one as down
+			connectChan <- viewstats.ConnectHandler{IsConnected: false, Err: err, Broker: i}
+			go retryStats(i, opts, connectChan, stop)
+			continue
+		}
+		defer client.Disconnect(250)
+		defer client.Unsubscribe(statsTopic)
+	}
+
+	if len(names) == 0 {
+		names = []string{""}
+	}
+	if statsOpts.once {
+		return printStatsOnce(connectChan, statsOpts, names)
+	}
+	if statsOpts.check {
+		return checkStats(connectChan, statsOpts, names)
+	}
+
+	var logger *statsLogger
+	if statsOpts.log != "" {
+		format := statsLogFormat(statsOpts.log, statsOpts.logFormat)
+		logger, err = startStatsLog(statsOpts.log, format, statsOpts.interval, names)
+		if err != nil {
+			return err
+		}
+	}
+
+	if metricsListener != nil {
+		err = serveStats(connectChan, metricsListener, names)
+	} else if statsOpts.noUI {
+		err = collectStats(connectChan, logger)
+	} else {
+		statsDisplay(connectChan)
+	}
+
+	if logger != nil {
+		if logErr := logger.Close(); err == nil {
+			err = logErr
+		}
+	}
+	return err
+}
+
+// loadStatsProfiles adds the profiles defined in the stats-profiles table
+// of the config file, e.g.
+//
+//	[stats-profiles.acme]
+//	detect-topic = "$SYS/broker/version"
+//	detect-version = "^acme"
+//	[stats-profiles.acme.topics]
+//	"$SYS/acme/+/clients" = "clients_connected"
+func loadStatsProfiles(configRoot *toml.Tree) error {
+	if configRoot == nil || !configRoot.Has("stats-profiles") {
+		return nil
+	}
+	table, ok := configRoot.Get("stats-profiles").(*toml.Tree)
+	if !ok {
+		return fmt.Errorf("stats-profiles in config file must be a table")
+	}
+
+	for _, name := range table.Keys() {
+		def, ok := table.GetPath([]string{name}).(*toml.Tree)
+		if !ok {
+			return fmt.Errorf("stats profile %s in config file must be a table", name)
+		}
+		profile := viewstats.Profile{Name: name, Topics: make(map[string]string)}
+
+		if detectTopic, ok := def.GetPath([]string{"detect-topic"}).(string); ok {
+			profile.DetectTopic = detectTopic
+		}
+		if detectVersion, ok := def.GetPath([]string{"detect-version"}).(string); ok {
+			re, err := regexp.Compile(detectVersion)
+			if err != nil {
+				return fmt.Errorf("stats profile %s has a bad detect-version: %s", name, err)
+			}
+			profile.DetectVersion = re
+		}
+
+		topics, ok := def.GetPath([]string{"topics"}).(*toml.Tree)
+		if !ok {
+			return fmt.Errorf("stats profile %s in config file needs a topics table", name)
+		}
+		for _, topic := range topics.Keys() {
+			stat, ok := topics.GetPath([]string{topic}).(string)
+			if !ok {
+				return fmt.Errorf("stats profile %s must map %s to the name of a stat", name, topic)
+			}
+			profile.Topics[topic] = stat
+		}
+
+		if err := viewstats.AddProfile(profile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadStatsLayout sets the dashboard layout from the stats-layout table of
+// the config file, e.g.
+//
+//	[stats-layout]
+//	columns = 2
+//	[[stats-layout.panel]]
+//	name = "broker"
+//	column = 1
+//	[[stats-layout.panel]]
+//	title = "Load"
+//	column = 2
+//	stats = ["clients_connected", "load_sockets_1min"]
+//	[stats-layout.colors.clients_connected]
+//	yellow = 500
+//	red = 1000
+//
+// Without any panels the default panels are used.
+func loadStatsLayout(configRoot *toml.Tree) error {
+	if configRoot == nil || !configRoot.Has("stats-layout") {
+		return nil
+	}
+	table, ok := configRoot.Get("stats-layout").(*toml.Tree)
+	if !ok {
+		return fmt.Errorf("stats-layout in config file must be a table")
+	}
+
+	layout := viewstats.Layout{Columns: viewstats.DefaultLayout.Columns, Panels: viewstats.DefaultLayout.Panels}
+	if table.Has("columns") {
+		columns, ok := table.Get("columns").(int64)
+		if !ok {
+			return fmt.Errorf("stats-layout columns must be a number")
+		}
+		layout.Columns = int(columns)
+	}
+
+	if table.Has("panel") {
+		panels, ok := table.Get("panel").([]*toml.Tree)
+		if !ok {
+			return fmt.Errorf("stats-layout panel must be an array of tables, i.e. [[stats-layout.panel]]")
+		}
+		layout.Panels = nil
+		for i, def := range panels {
+			panel := viewstats.Panel{}
+			panel.Name, _ = def.Get("name").(string)
+			panel.Title, _ = def.Get("title").(string)
+			if def.Has("column") {
+				column, ok := def.Get("column").(int64)
+				if !ok {
+					return fmt.Errorf("stats-layout panel %d column must be a number", i+1)
+				}
+				panel.Column = int(column)
+			}
+			if def.Has("stats") {
+				stats, ok := def.Get("stats").([]interface{})
+				if !ok {
+					return fmt.Errorf("stats-layout panel %d stats must be a list of stat names", i+1)
+				}
+				for _, stat := range stats {
+					name, ok := stat.(string)
+					if !ok {
+						return fmt.Errorf("stats-layout panel %d stats must be a list of stat names", i+1)
+					}
+					panel.Stats = append(panel.Stats, name)
+				}
+			}
+			layout.Panels = append(layout.Panels, panel)
+		}
+	}
+
+	if table.Has("colors") {
+		colors, ok := table.Get("colors").(*toml.Tree)
+		if !ok {
+			return fmt.Errorf("stats-layout colors must be a table")
+		}
+		layout.Colors = make(map[string][]viewstats.Threshold)
+		for _, stat := range colors.Keys() {
+			thresholds, ok := colors.GetPath([]string{stat}).(*toml.Tree)
+			if !ok {
+				return fmt.Errorf("stats-layout colors for %s must be a table of colors", stat)
+			}
+			for _, color := range thresholds.Keys() {
+				var value float64
+				switch v := thresholds.GetPath([]string{color}).(type) {
+				case int64:
+					value = float64(v)
+				case float64:
+					value = v
+				default:
+					return fmt.Errorf("stats-layout color %s for %s must be a number", color, stat)
+				}
+				layout.Colors[stat] = append(layout.Colors[stat], viewstats.Threshold{Value: value, Color: color})
+			}
+		}
+	}
+
+	return viewstats.SetLayout(layout)
+}
+
+// connectStats connects to one of the brokers and subscribes to its stats
+func connectStats(broker int, zapOpts *zapOptions, connectChan chan viewstats.ConnectHandler) (mqttClient, error) {
 	clientOpts := zapOpts.clientOpts
 
 	// Need this false so we still have subscriptions if we disconnect for
 	// any reason and then reconnect.
 	clientOpts.CleanSession = false
 
-	connectChan := make(chan viewstats.ConnectHandler, 1)
 	clientOpts.OnConnectionLost = func(client MQTT.Client, reason error) {
 		connectChan <- viewstats.ConnectHandler{
 			IsConnected: false,
 			Err:         reason,
+			Broker:      broker,
 		}
 	}
 	clientOpts.OnConnect = func(client MQTT.Client) {
 		connectChan <- viewstats.ConnectHandler{
 			IsConnected: true,
+			Broker:      broker,
 		}
 	}
 
-	client := MQTT.NewClient(clientOpts)
+	client := zapOpts.newClient()
 	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		return fmt.Errorf("could not connect: %s", token.Error())
+		if zapOpts.broker != "" {
+			return nil, fmt.Errorf("could not connect to %s: %s", zapOpts.broker, token.Error())
+		}
+		return nil, fmt.Errorf("could not connect: %s", token.Error())
 	}
-	defer client.Disconnect(250)
 
 	output.VERBOSE.Printf("Connected to %s\n", clientOpts.Servers[0])
 
-	viewstats.PrepViewer()
-	if token := client.Subscribe(statsTopic, statsQos, statsHandler); token.Wait() && token.Error() != nil {
-		return fmt.Errorf("could not subscribe: %s", token.Error())
+	handler := func(client MQTT.Client, msg MQTT.Message) {
+		viewstats.AddBrokerStat(broker, msg.Topic(), string(msg.Payload()))
+	}
+	if token := client.Subscribe(statsTopic, statsQos, handler); token.Wait() && token.Error() != nil {
+		client.Disconnect(250)
+		return nil, fmt.Errorf("could not subscribe: %s", token.Error())
 	}
-	defer client.Unsubscribe(statsTopic)
 
-	viewstats.StartStatsDisplay(connectChan)
+	return client, nil
+}
+
+// statsRetryInterval is how often retryStats tries to connect
+const statsRetryInterval = 5 * time.Second
+
+// retryStats keeps trying to connect to a broker that was down when zap
+// started until stop is closed
+func retryStats(broker int, zapOpts *zapOptions, connectChan chan viewstats.ConnectHandler, stop <-chan struct{}) {
+	ticker := time.NewTicker(statsRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			client, err := connectStats(broker, zapOpts, connectChan)
+			if err != nil {
+				continue
+			}
+			<-stop
+			client.Unsubscribe(statsTopic)
+			client.Disconnect(250)
+			return
+		}
+	}
+}
+
+// printStatsOnce waits for the stats to come in and prints them
+func printStatsOnce(connectChan chan viewstats.ConnectHandler, statsOpts *statsOptions, names []string) error {
+	defer startCollecting(connectChan)()
+
+	deadline := time.Now().Add(statsOpts.timeout)
+	for !viewstats.HaveAllStats() && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	var snapshots []brokerSnapshot
+	for i, name := range names {
+		snap := snapshotBroker(i, name)
+		if len(snap.stats) == 0 {
+			if name == "" {
+				return fmt.Errorf("no stats received from the broker within %s", statsOpts.timeout)
+			}
+			return fmt.Errorf("no stats received from broker %s within %s", name, statsOpts.timeout)
+		}
+		snapshots = append(snapshots, snap)
+	}
+	if !viewstats.HaveAllStats() {
+		output.VERBOSE.Printf("Not all stats were received within %s\n", statsOpts.timeout)
+	}
+
+	return statsFormatters[statsOpts.format](os.Stdout, snapshots)
+}
+
+// startCollecting stores the stats without the UI, the function it
+// returns stops collecting and waits until the stats are no longer touched
+func startCollecting(connectChan chan viewstats.ConnectHandler) func() {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		viewstats.CollectStats(connectChan, done)
+		close(finished)
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// serveStats keeps collecting the stats and serves them as Prometheus
+// metrics until interrupted
+func serveStats(connectChan chan viewstats.ConnectHandler, l net.Listener, names []string) error {
+	defer startCollecting(connectChan)()
+
+	quit := make(chan os.Signal, 1)
+	notifyQuit(quit)
+	defer signal.Stop(quit)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", statsMetricsHandler(names))
+	server := &http.Server{Handler: mux}
+	fmt.Printf("Serving metrics on http://%s/metrics\n", l.Addr())
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- server.Serve(l)
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-quit:
+	}
+
+	return server.Close()
+}
+
+// collectStats keeps collecting the stats without the UI until interrupted
+// or the logger fails
+func collectStats(connectChan chan viewstats.ConnectHandler, logger *statsLogger) error {
+	defer startCollecting(connectChan)()
+
+	quit := make(chan os.Signal, 1)
+	notifyQuit(quit)
+	defer signal.Stop(quit)
+
+	// a nil channel never fires
+	var logDone chan struct{}
+	if logger != nil {
+		logDone = logger.done
+	}
+	select {
+	case <-quit:
+	case <-logDone:
+	}
 	return nil
 }
 
-func statsHandler(client MQTT.Client, msg MQTT.Message) {
-	viewstats.AddStat(msg.Topic(), string(msg.Payload()))
+// statsMetricsHandler writes the latest stats of each broker along with
+// the history of the connection to it
+func statsMetricsHandler(names []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		metrics := newPrometheusMetrics()
+		for i, name := range names {
+			metrics.addSnapshot(snapshotBroker(i, name))
+		}
+		metrics.write(w)
+	})
+}
+
+// notifyQuit arranges for quit to get the signals that stop the commands
+// running until Ctrl-C, tests replace it so they do not need to signal the
+// whole process
+var notifyQuit = func(quit chan<- os.Signal) {
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 }
+
+// statsDisplay shows the stats until the user quits, tests replace it
+// with one that does not need a terminal
+var statsDisplay = viewstats.StartStatsDisplay
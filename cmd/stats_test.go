@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/pelletier/go-toml"
+	"github.com/rayjohnson/zap/viewstats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadStatsProfiles(t *testing.T) {
+	assert.NoError(t, loadStatsProfiles(nil))
+
+	config, err := toml.Load(`
+[stats-profiles.cmd-test]
+detect-topic = "$SYS/broker/version"
+detect-version = "^cmd test"
+[stats-profiles.cmd-test.topics]
+"$SYS/cmd/+/clients" = "clients_connected"
+"$SYS/cmd/uptime.seconds" = "uptime_seconds"
+`)
+	require.NoError(t, err)
+	require.NoError(t, loadStatsProfiles(config))
+	assert.Contains(t, viewstats.ProfileNames(), "cmd-test")
+
+	viewstats.PrepViewer()
+	require.NoError(t, viewstats.SetProfile(0, "cmd-test"))
+	assert.Equal(t, "cmd-test", viewstats.ProfileName(0))
+
+	table := []struct {
+		config string
+		err    string
+	}{
+		{`stats-profiles = 1`, "stats-profiles in config file must be a table"},
+		{"[stats-profiles]\nbad = 1", "stats profile bad in config file must be a table"},
+		{"[stats-profiles.bad]\ndetect-topic = \"x\"", "stats profile bad in config file needs a topics table"},
+		{"[stats-profiles.bad]\ndetect-version = \"(\"", "stats profile bad has a bad detect-version: error parsing regexp: missing closing ): `(`"},
+		{"[stats-profiles.bad.topics]\n\"$SYS/x\" = 1", "stats profile bad must map $SYS/x to the name of a stat"},
+		{"[stats-profiles.bad.topics]\n\"$SYS/x\" = \"nope\"", "stats profile bad maps $SYS/x to unknown stat nope"},
+	}
+	for _, test := range table {
+		config, err := toml.Load(test.config)
+		require.NoError(t, err, test.config)
+		assert.EqualError(t, loadStatsProfiles(config), test.err, test.config)
+	}
+}
+
+func TestLoadStatsLayout(t *testing.T) {
+	defer viewstats.SetLayout(viewstats.DefaultLayout)
+	assert.NoError(t, loadStatsLayout(nil))
+
+	config, err := toml.Load(`
+[stats-layout]
+columns = 3
+[[stats-layout.panel]]
+name = "broker"
+column = 3
+[[stats-layout.panel]]
+title = "Mine"
+stats = ["clients_connected", "uptime_seconds"]
+[stats-layout.colors.clients_connected]
+yellow = 500
+red = 1000.5
+`)
+	require.NoError(t, err)
+	require.NoError(t, loadStatsLayout(config))
+
+	table := []struct {
+		config string
+		err    string
+	}{
+		{`stats-layout = 1`, "stats-layout in config file must be a table"},
+		{"[stats-layout]\ncolumns = \"2\"", "stats-layout columns must be a number"},
+		{"[stats-layout]\npanel = 1", "stats-layout panel must be an array of tables, i.e. [[stats-layout.panel]]"},
+		{"[[stats-layout.panel]]\nname = \"broker\"\ncolumn = \"1\"", "stats-layout panel 1 column must be a number"},
+		{"[[stats-layout.panel]]\nstats = \"clients_connected\"", "stats-layout panel 1 stats must be a list of stat names"},
+		{"[[stats-layout.panel]]\nstats = [1]", "stats-layout panel 1 stats must be a list of stat names"},
+		{"[[stats-layout.panel]]\nname = \"nope\"", "stats layout has unknown panel nope, must be one of broker, clients, connection, load, messages, trends, unknown"},
+		{"[stats-layout]\ncolors = 1", "stats-layout colors must be a table"},
+		{"[stats-layout.colors]\nclients_connected = 1", "stats-layout colors for clients_connected must be a table of colors"},
+		{"[stats-layout.colors.clients_connected]\nred = \"1\"", "stats-layout color red for clients_connected must be a number"},
+		{"[stats-layout.colors.clients_connected]\npink = 1", "stats layout has unknown color pink for clients_connected"},
+	}
+	for _, test := range table {
+		config, err := toml.Load(test.config)
+		require.NoError(t, err, test.config)
+		assert.EqualError(t, loadStatsLayout(config), test.err, test.config)
+	}
+}
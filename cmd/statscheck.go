@@ -0,0 +1,221 @@
+// Copyright © 2017 Ray Johnson <ray.johnson@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml"
+
+	"github.com/rayjohnson/zap/viewstats"
+)
+
+// The exit codes of a Nagios plugin
+const (
+	checkOK       = 0
+	checkWarning  = 1
+	checkCritical = 2
+	checkUnknown  = 3
+)
+
+var checkStates = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// loadStatsAlerts sets the alert rules from the stats-alerts table of the
+// config file, e.g.
+//
+//	[stats-alerts]
+//	warning = ["clients.connected < 10"]
+//	critical = ["load.publish.dropped.1min > 0"]
+//
+// It returns the number of rules.
+func loadStatsAlerts(configRoot *toml.Tree) (int, error) {
+	if configRoot == nil || !configRoot.Has("stats-alerts") {
+		viewstats.SetRules(nil)
+		return 0, nil
+	}
+	table, ok := configRoot.Get("stats-alerts").(*toml.Tree)
+	if !ok {
+		return 0, fmt.Errorf("stats-alerts in config file must be a table")
+	}
+
+	var rules []viewstats.Rule
+	for _, level := range []string{"warning", "critical"} {
+		if !table.Has(level) {
+			continue
+		}
+		texts, ok := table.Get(level).([]interface{})
+		if !ok {
+			return 0, fmt.Errorf("stats-alerts %s must be a list of rules", level)
+		}
+		for _, text := range texts {
+			str, ok := text.(string)
+			if !ok {
+				return 0, fmt.Errorf("stats-alerts %s must be a list of rules", level)
+			}
+			rule, err := viewstats.ParseRule(str, level == "critical")
+			if err != nil {
+				return 0, err
+			}
+			rules = append(rules, rule)
+		}
+	}
+
+	viewstats.SetRules(rules)
+	return len(rules), nil
+}
+
+// checkError turns an error that stopped --check, like a broken config
+// file or bad options, into the UNKNOWN state of a Nagios plugin
+func checkError(err error) error {
+	if _, ok := err.(*exitError); ok || err == nil {
+		return err
+	}
+	fmt.Printf("MQTT %s - %s\n", checkStates[checkUnknown], err)
+	return &exitError{checkUnknown}
+}
+
+// checkStats waits for the stats the alert rules need, prints the result
+// like a Nagios plugin and returns an exitError unless all is well
+func checkStats(connectChan chan viewstats.ConnectHandler, statsOpts *statsOptions, names []string) error {
+	defer startCollecting(connectChan)()
+
+	deadline := time.Now().Add(statsOpts.timeout)
+	for !haveAlertStats(names) && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	var alerts [][]viewstats.Alert
+	var connected []bool
+	for i := range names {
+		alerts = append(alerts, viewstats.Alerts(i))
+		connected = append(connected, viewstats.IsConnected(i))
+	}
+	return checkResult(os.Stdout, names, connected, alerts)
+}
+
+func haveAlertStats(names []string) bool {
+	for i := range names {
+		for _, alert := range viewstats.Alerts(i) {
+			if alert.Missing {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// checkResult prints a line like
+//
+//	MQTT CRITICAL - clients.connected < 10 (is 3) | clients_connected=3
+//
+// the worst state of any broker decides the exit code
+func checkResult(w io.Writer, names []string, connected []bool, alerts [][]viewstats.Alert) error {
+	state := checkOK
+	var messages, perfData []string
+	for i, name := range names {
+		prefix := ""
+		if name != "" {
+			prefix = name + ": "
+		}
+		if !connected[i] {
+			state = worseState(state, checkCritical)
+			messages = append(messages, prefix+"not connected to the broker")
+			continue
+		}
+
+		for _, alert := range alerts[i] {
+			switch {
+			case alert.Missing:
+				state = worseState(state, checkUnknown)
+				messages = append(messages, fmt.Sprintf("%s%s (no value)", prefix, alert.Rule.Text))
+				continue
+			case alert.Rule.Critical:
+				state = worseState(state, checkCritical)
+			default:
+				state = worseState(state, checkWarning)
+			}
+			messages = append(messages, fmt.Sprintf("%s%s (is %s)", prefix, alert.Rule.Text, alert.Value))
+		}
+		perfData = append(perfData, checkPerfData(i, name)...)
+	}
+
+	if state == checkOK {
+		messages = []string{"all stats alerts passed"}
+	}
+	line := fmt.Sprintf("MQTT %s - %s", checkStates[state], strings.Join(messages, ", "))
+	if len(perfData) > 0 {
+		line += " | " + strings.Join(perfData, " ")
+	}
+	fmt.Fprintln(w, line)
+
+	if state == checkOK {
+		return nil
+	}
+	return &exitError{state}
+}
+
+// checkPerfData returns the value of each stat with a rule on it and the
+// number of reconnects
+func checkPerfData(broker int, name string) []string {
+	var perfData []string
+	seen := make(map[string]bool)
+	for _, stat := range viewstats.Snapshot(broker) {
+		if seen[stat.Name] || !hasRule(stat.Name) {
+			continue
+		}
+		seen[stat.Name] = true
+		if num, ok := stat.Number(); ok {
+			perfData = append(perfData, fmt.Sprintf("%s%s=%g", perfPrefix(name), stat.Name, num))
+		}
+	}
+	reconnects := viewstats.ConnectionHistory(broker).Reconnects
+	return append(perfData, fmt.Sprintf("%sreconnects=%d", perfPrefix(name), reconnects))
+}
+
+// perfPrefix tells apart the performance data of each broker
+func perfPrefix(name string) string {
+	if name == "" {
+		return ""
+	}
+	return name + "_"
+}
+
+func hasRule(stat string) bool {
+	for _, rule := range viewstats.Rules() {
+		if rule.Stat == stat {
+			return true
+		}
+	}
+	return false
+}
+
+// worseState orders the states as OK, UNKNOWN, WARNING then CRITICAL
+func worseState(a, b int) int {
+	rank := []int{checkOK: 0, checkUnknown: 1, checkWarning: 2, checkCritical: 3}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
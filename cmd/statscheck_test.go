@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pelletier/go-toml"
+	"github.com/rayjohnson/zap/viewstats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadStatsAlerts(t *testing.T) {
+	defer viewstats.SetRules(nil)
+
+	count, err := loadStatsAlerts(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	config, err := toml.Load(`
+[stats-alerts]
+warning = ["clients.connected < 10"]
+critical = ["load.publish.dropped.1min > 0", "clients_connected < 2"]
+`)
+	require.NoError(t, err)
+	count, err = loadStatsAlerts(config)
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+	assert.Equal(t, []viewstats.Rule{
+		{Text: "clients.connected < 10", Stat: "clients_connected", Op: "<", Limit: 10},
+		{Text: "load.publish.dropped.1min > 0", Stat: "load_publish_dropped_1min", Op: ">", Limit: 0, Critical: true},
+		{Text: "clients_connected < 2", Stat: "clients_connected", Op: "<", Limit: 2, Critical: true},
+	}, viewstats.Rules())
+
+	table := []struct {
+		config string
+		err    string
+	}{
+		{`stats-alerts = 1`, "stats-alerts in config file must be a table"},
+		{"[stats-alerts]\nwarning = \"clients.connected < 10\"", "stats-alerts warning must be a list of rules"},
+		{"[stats-alerts]\ncritical = [1]", "stats-alerts critical must be a list of rules"},
+		{"[stats-alerts]\ncritical = [\"clients.connected\"]", `stats alert "clients.connected" must look like clients.connected < 10`},
+	}
+	for _, test := range table {
+		config, err := toml.Load(test.config)
+		require.NoError(t, err, test.config)
+		_, err = loadStatsAlerts(config)
+		assert.EqualError(t, err, test.err, test.config)
+	}
+}
+
+func TestCheckResult(t *testing.T) {
+	warning, err := viewstats.ParseRule("clients.connected < 10", false)
+	require.NoError(t, err)
+	critical, err := viewstats.ParseRule("load.publish.dropped.1min > 0", true)
+	require.NoError(t, err)
+	viewstats.SetRules([]viewstats.Rule{warning, critical})
+	defer viewstats.SetRules(nil)
+
+	viewstats.PrepViewer("one", "two")
+
+	table := []struct {
+		names     []string
+		connected []bool
+		alerts    [][]viewstats.Alert
+		code      int
+		out       string
+	}{
+		{[]string{""}, []bool{true}, [][]viewstats.Alert{nil}, checkOK,
+			"MQTT OK - all stats alerts passed | reconnects=0\n"},
+		{[]string{""}, []bool{true}, [][]viewstats.Alert{{{Rule: warning, Value: "3"}}}, checkWarning,
+			"MQTT WARNING - clients.connected < 10 (is 3) | reconnects=0\n"},
+		{[]string{""}, []bool{true}, [][]viewstats.Alert{{{Rule: warning, Value: "3"}, {Rule: critical, Missing: true}}}, checkWarning,
+			"MQTT WARNING - clients.connected < 10 (is 3), load.publish.dropped.1min > 0 (no value) | reconnects=0\n"},
+		{[]string{""}, []bool{true}, [][]viewstats.Alert{{{Rule: critical, Missing: true}}}, checkUnknown,
+			"MQTT UNKNOWN - load.publish.dropped.1min > 0 (no value) | reconnects=0\n"},
+		{[]string{"one", "two"}, []bool{true, true}, [][]viewstats.Alert{nil, {{Rule: critical, Value: "2"}}}, checkCritical,
+			"MQTT CRITICAL - two: load.publish.dropped.1min > 0 (is 2) | one_reconnects=0 two_reconnects=0\n"},
+		{[]string{"one", "two"}, []bool{true, false}, [][]viewstats.Alert{{{Rule: warning, Value: "3"}}, nil}, checkCritical,
+			"MQTT CRITICAL - one: clients.connected < 10 (is 3), two: not connected to the broker | one_reconnects=0\n"},
+	}
+	for _, test := range table {
+		var buf bytes.Buffer
+		err := checkResult(&buf, test.names, test.connected, test.alerts)
+		if test.code == checkOK {
+			assert.NoError(t, err)
+		} else {
+			assert.Equal(t, &exitError{test.code}, err, test.out)
+		}
+		assert.Equal(t, test.out, buf.String())
+	}
+}
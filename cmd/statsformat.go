@@ -0,0 +1,286 @@
+// Copyright © 2017 Ray Johnson <ray.johnson@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rayjohnson/zap/viewstats"
+)
+
+// brokerSnapshot is the stats of one broker, name is its section in the
+// config file and may be empty.  The connection history is left out when
+// conn is nil.
+type brokerSnapshot struct {
+	name  string
+	stats []viewstats.Stat
+	conn  *viewstats.Connection
+}
+
+// snapshotBroker takes the stats and connection history of a broker
+func snapshotBroker(broker int, name string) brokerSnapshot {
+	conn := viewstats.ConnectionHistory(broker)
+	return brokerSnapshot{name, viewstats.Snapshot(broker), &conn}
+}
+
+// statsFormatter writes the stats of each broker
+type statsFormatter func(w io.Writer, snapshots []brokerSnapshot) error
+
+var statsFormatters = map[string]statsFormatter{
+	"json":       writeStatsJSON,
+	"table":      writeStatsTable,
+	"prometheus": writeStatsPrometheus,
+}
+
+// writeStatsJSON writes an object for the broker, or an array of them
+// when there is more than one
+func writeStatsJSON(w io.Writer, snapshots []brokerSnapshot) error {
+	var objects []map[string]interface{}
+	for _, snap := range snapshots {
+		values := statsObject(snap)
+		if snap.conn != nil {
+			values["connection"] = connectionObject(*snap.conn, true)
+		}
+		objects = append(objects, values)
+	}
+
+	var data []byte
+	var err error
+	if len(objects) == 1 {
+		data, err = json.MarshalIndent(objects[0], "", "  ")
+	} else {
+		data, err = json.MarshalIndent(objects, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// statsObject returns the stats of a broker for json, numbers are numbers
+func statsObject(snap brokerSnapshot) map[string]interface{} {
+	values := make(map[string]interface{})
+	if snap.name != "" {
+		values["broker"] = snap.name
+	}
+	for _, stat := range snap.stats {
+		if num, ok := stat.Number(); ok {
+			values[stat.Name] = num
+		} else {
+			values[stat.Name] = stat.Value
+		}
+	}
+	return values
+}
+
+// connectionObject returns the connection history for json, the outages
+// are optional
+func connectionObject(c viewstats.Connection, outages bool) map[string]interface{} {
+	values := map[string]interface{}{
+		"connected":            c.Connected,
+		"reconnects":           c.Reconnects,
+		"connected_seconds":    c.Uptime.Seconds(),
+		"disconnected_seconds": c.Downtime.Seconds(),
+	}
+	if outages {
+		list := []map[string]interface{}{}
+		for _, o := range c.Outages {
+			outage := map[string]interface{}{
+				"start":  o.Start.UTC().Format(time.RFC3339),
+				"reason": o.Reason,
+			}
+			if !o.End.IsZero() {
+				outage["end"] = o.End.UTC().Format(time.RFC3339)
+				outage["seconds"] = o.Duration(o.End).Seconds()
+			}
+			list = append(list, outage)
+		}
+		values["outages"] = list
+	}
+	return values
+}
+
+func writeStatsTable(w io.Writer, snapshots []brokerSnapshot) error {
+	for i, snap := range snapshots {
+		if i > 0 {
+			if _, err := fmt.Fprintln(w); err != nil {
+				return err
+			}
+		}
+
+		var rows [][2]string
+		if snap.name != "" {
+			rows = append(rows, [2]string{"broker", snap.name})
+		}
+		for _, stat := range snap.stats {
+			rows = append(rows, [2]string{stat.Name, stat.Value})
+		}
+		if snap.conn != nil {
+			rows = append(rows, connectionRows(*snap.conn)...)
+		}
+
+		width := 0
+		for _, row := range rows {
+			if len(row[0]) > width {
+				width = len(row[0])
+			}
+		}
+		for _, row := range rows {
+			if _, err := fmt.Fprintf(w, "%-*s  %s\n", width, row[0], row[1]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// connectionRows returns the connection history for the table format
+func connectionRows(c viewstats.Connection) [][2]string {
+	connected := "no"
+	if c.Connected {
+		connected = "yes"
+	}
+	rows := [][2]string{
+		{"connected", connected},
+		{"reconnects", strconv.Itoa(c.Reconnects)},
+		{"connected_time", c.Uptime.Round(time.Second).String()},
+		{"disconnected_time", c.Downtime.Round(time.Second).String()},
+	}
+	for _, o := range c.Outages {
+		when := "still down"
+		if !o.End.IsZero() {
+			when = "for " + o.Duration(o.End).Round(time.Second).String()
+		}
+		rows = append(rows, [2]string{"outage", fmt.Sprintf("%s %s: %s", o.Start.UTC().Format(time.RFC3339), when, o.Reason)})
+	}
+	return rows
+}
+
+const prometheusPrefix = "mqtt_broker_"
+
+// writeStatsPrometheus writes the stats in the Prometheus text format.
+func writeStatsPrometheus(w io.Writer, snapshots []brokerSnapshot) error {
+	metrics := newPrometheusMetrics()
+	for _, snap := range snapshots {
+		metrics.addSnapshot(snap)
+	}
+	return metrics.write(w)
+}
+
+// prometheusMetrics collects samples so that all the samples of a metric
+// are written together, as the text format requires, even when they come
+// from different brokers
+type prometheusMetrics struct {
+	families []*prometheusFamily
+	byName   map[string]*prometheusFamily
+}
+
+type prometheusFamily struct {
+	name    string
+	help    string
+	samples []string
+}
+
+func newPrometheusMetrics() *prometheusMetrics {
+	return &prometheusMetrics{byName: make(map[string]*prometheusFamily)}
+}
+
+// add adds a sample of a gauge
+func (m *prometheusMetrics) add(name string, help string, labels []string, value float64) {
+	name = prometheusPrefix + name
+	family, ok := m.byName[name]
+	if !ok {
+		family = &prometheusFamily{name: name, help: help}
+		m.byName[name] = family
+		m.families = append(m.families, family)
+	}
+
+	var labelStr string
+	if len(labels) > 0 {
+		labelStr = "{" + strings.Join(labels, ",") + "}"
+	}
+	family.samples = append(family.samples, name+labelStr+" "+strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+// addSnapshot adds the connection history, if there is one, and the stats
+// of a broker
+func (m *prometheusMetrics) addSnapshot(snap brokerSnapshot) {
+	labels := prometheusLabels(snap.name)
+	if c := snap.conn; c != nil {
+		connected := 0.0
+		if c.Connected {
+			connected = 1
+		}
+		m.add("connected", "Whether zap is connected to the broker", labels, connected)
+		m.add("reconnects", "How many times zap reconnected to the broker", labels, float64(c.Reconnects))
+		m.add("connected_seconds", "How long zap has been connected to the broker in total", labels, c.Uptime.Seconds())
+		m.add("disconnected_seconds", "How long zap has not been connected to the broker in total", labels, c.Downtime.Seconds())
+	}
+	m.addStats(snap.stats, labels)
+}
+
+// addStats adds the stats of a broker.  The numbers are gauges and the
+// version is a label of an info metric.  The broker time is left out as
+// Prometheus has its own.
+func (m *prometheusMetrics) addStats(stats []viewstats.Stat, labels []string) {
+	for _, stat := range stats {
+		if stat.Name == "version" {
+			info := append(append([]string{}, labels...), prometheusLabel("version", stat.Value))
+			m.add("info", "Version of the broker", info, 1)
+		} else if num, ok := stat.Number(); ok {
+			m.add(stat.Name, stat.Topic, labels, num)
+		}
+	}
+}
+
+func (m *prometheusMetrics) write(w io.Writer) error {
+	for _, family := range m.families {
+		help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(family.help)
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", family.name, help, family.name); err != nil {
+			return err
+		}
+		for _, sample := range family.samples {
+			if _, err := fmt.Fprintln(w, sample); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// prometheusLabels are the labels every metric of a broker gets
+func prometheusLabels(broker string) []string {
+	if broker == "" {
+		return nil
+	}
+	return []string{prometheusLabel("broker", broker)}
+}
+
+func prometheusLabel(name string, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return fmt.Sprintf(`%s="%s"`, name, value)
+}
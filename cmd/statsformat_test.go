@@ -0,0 +1,200 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/rayjohnson/zap/viewstats"
+	"github.com/stretchr/testify/assert"
+)
+
+var testStats = []viewstats.Stat{
+	{Topic: "$SYS/broker/uptime", Key: "Broker Uptime", Name: "uptime_seconds", Value: "42 seconds"},
+	{Topic: "$SYS/broker/version", Key: "Broker Version", Name: "version", Value: `mosquitto "1.4"`},
+	{Topic: "$SYS/broker/time", Key: "Broker Time", Name: "time", Value: "2018-02-03 10:11:12"},
+	{Topic: "$SYS/broker/clients/connected", Key: "Clients Connected", Name: "clients_connected", Value: "3"},
+	{Topic: "$SYS/broker/load/sockets/1min", Key: "LoadSockets1min", Name: "load_sockets_1min", Value: "0.25"},
+}
+
+func TestValidateStatsOptions(t *testing.T) {
+	statsOpts := &statsOptions{format: "table", timeout: time.Second, interval: time.Second}
+	assert.NoError(t, statsOpts.validateOptions())
+
+	statsOpts.format = "xml"
+	assert.EqualError(t, statsOpts.validateOptions(), "--format must be one of json, table or prometheus")
+
+	statsOpts = &statsOptions{format: "json", interval: time.Second}
+	assert.EqualError(t, statsOpts.validateOptions(), "--timeout must be greater than 0")
+
+	statsOpts = &statsOptions{format: "table", timeout: time.Second, interval: time.Second, once: true, serve: ":9234"}
+	assert.EqualError(t, statsOpts.validateOptions(), "only one of --once, --check, --serve or --no-ui can be used")
+
+	statsOpts = &statsOptions{format: "table", timeout: time.Second, interval: time.Second, once: true, check: true}
+	assert.EqualError(t, statsOpts.validateOptions(), "only one of --once, --check, --serve or --no-ui can be used")
+
+	statsOpts = &statsOptions{format: "table", timeout: time.Second, interval: time.Second, serve: ":9234", noUI: true}
+	assert.EqualError(t, statsOpts.validateOptions(), "only one of --once, --check, --serve or --no-ui can be used")
+
+	statsOpts = &statsOptions{format: "table", timeout: time.Second, interval: time.Second, once: true, log: "stats.csv"}
+	assert.EqualError(t, statsOpts.validateOptions(), "--log can not be used with --once or --check")
+
+	statsOpts = &statsOptions{format: "table", timeout: time.Second, interval: time.Second, log: "stats.csv", logFormat: "xml"}
+	assert.EqualError(t, statsOpts.validateOptions(), "--log-format must be one of csv or jsonl")
+
+	statsOpts = &statsOptions{format: "table", timeout: time.Second}
+	assert.EqualError(t, statsOpts.validateOptions(), "--interval must be greater than 0")
+}
+
+func TestWriteStatsJSON(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, writeStatsJSON(&buf, []brokerSnapshot{{"prod", testStats, nil}}))
+	assert.Equal(t, `{
+  "broker": "prod",
+  "clients_connected": 3,
+  "load_sockets_1min": 0.25,
+  "time": "2018-02-03 10:11:12",
+  "uptime_seconds": 42,
+  "version": "mosquitto \"1.4\""
+}
+`, buf.String())
+}
+
+func TestWriteStatsTable(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, writeStatsTable(&buf, []brokerSnapshot{{"", testStats, nil}}))
+	assert.Equal(t, `uptime_seconds     42 seconds
+version            mosquitto "1.4"
+time               2018-02-03 10:11:12
+clients_connected  3
+load_sockets_1min  0.25
+`, buf.String())
+}
+
+func TestWriteStatsPrometheus(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, writeStatsPrometheus(&buf, []brokerSnapshot{{"prod", testStats, nil}}))
+	assert.Equal(t, `# HELP mqtt_broker_uptime_seconds $SYS/broker/uptime
+# TYPE mqtt_broker_uptime_seconds gauge
+mqtt_broker_uptime_seconds{broker="prod"} 42
+# HELP mqtt_broker_info Version of the broker
+# TYPE mqtt_broker_info gauge
+mqtt_broker_info{broker="prod",version="mosquitto \"1.4\""} 1
+# HELP mqtt_broker_clients_connected $SYS/broker/clients/connected
+# TYPE mqtt_broker_clients_connected gauge
+mqtt_broker_clients_connected{broker="prod"} 3
+# HELP mqtt_broker_load_sockets_1min $SYS/broker/load/sockets/1min
+# TYPE mqtt_broker_load_sockets_1min gauge
+mqtt_broker_load_sockets_1min{broker="prod"} 0.25
+`, buf.String())
+
+	buf.Reset()
+	assert.NoError(t, writeStatsPrometheus(&buf, []brokerSnapshot{{"", testStats[3:4], nil}}))
+	assert.Contains(t, buf.String(), "\nmqtt_broker_clients_connected 3\n")
+}
+
+func TestWriteStatsManyBrokers(t *testing.T) {
+	snapshots := []brokerSnapshot{{"prod", testStats[3:5], nil}, {"edge", testStats[3:4], nil}}
+
+	var buf bytes.Buffer
+	assert.NoError(t, writeStatsJSON(&buf, snapshots))
+	assert.Equal(t, `[
+  {
+    "broker": "prod",
+    "clients_connected": 3,
+    "load_sockets_1min": 0.25
+  },
+  {
+    "broker": "edge",
+    "clients_connected": 3
+  }
+]
+`, buf.String())
+
+	buf.Reset()
+	assert.NoError(t, writeStatsTable(&buf, snapshots))
+	assert.Equal(t, `broker             prod
+clients_connected  3
+load_sockets_1min  0.25
+
+broker             edge
+clients_connected  3
+`, buf.String())
+
+	// the samples of each metric are kept together
+	buf.Reset()
+	assert.NoError(t, writeStatsPrometheus(&buf, snapshots))
+	assert.Equal(t, `# HELP mqtt_broker_clients_connected $SYS/broker/clients/connected
+# TYPE mqtt_broker_clients_connected gauge
+mqtt_broker_clients_connected{broker="prod"} 3
+mqtt_broker_clients_connected{broker="edge"} 3
+# HELP mqtt_broker_load_sockets_1min $SYS/broker/load/sockets/1min
+# TYPE mqtt_broker_load_sockets_1min gauge
+mqtt_broker_load_sockets_1min{broker="prod"} 0.25
+`, buf.String())
+}
+
+func TestWriteStatsConnection(t *testing.T) {
+	start := time.Date(2018, 2, 3, 10, 11, 12, 0, time.UTC)
+	conn := &viewstats.Connection{
+		Connected:  true,
+		Reconnects: 1,
+		Uptime:     90 * time.Second,
+		Downtime:   30 * time.Second,
+		Outages:    []viewstats.Outage{{Start: start, End: start.Add(30 * time.Second), Reason: "EOF"}},
+	}
+	snapshots := []brokerSnapshot{{"", testStats[3:4], conn}}
+
+	var buf bytes.Buffer
+	assert.NoError(t, writeStatsJSON(&buf, snapshots))
+	assert.Equal(t, `{
+  "clients_connected": 3,
+  "connection": {
+    "connected": true,
+    "connected_seconds": 90,
+    "disconnected_seconds": 30,
+    "outages": [
+      {
+        "end": "2018-02-03T10:11:42Z",
+        "reason": "EOF",
+        "seconds": 30,
+        "start": "2018-02-03T10:11:12Z"
+      }
+    ],
+    "reconnects": 1
+  }
+}
+`, buf.String())
+
+	buf.Reset()
+	conn.Connected = false
+	conn.Outages = append(conn.Outages, viewstats.Outage{Start: start.Add(time.Minute), Reason: "refused"})
+	assert.NoError(t, writeStatsTable(&buf, snapshots))
+	assert.Equal(t, `clients_connected  3
+connected          no
+reconnects         1
+connected_time     1m30s
+disconnected_time  30s
+outage             2018-02-03T10:11:12Z for 30s: EOF
+outage             2018-02-03T10:12:12Z still down: refused
+`, buf.String())
+
+	buf.Reset()
+	assert.NoError(t, writeStatsPrometheus(&buf, snapshots))
+	assert.Equal(t, `# HELP mqtt_broker_connected Whether zap is connected to the broker
+# TYPE mqtt_broker_connected gauge
+mqtt_broker_connected 0
+# HELP mqtt_broker_reconnects How many times zap reconnected to the broker
+# TYPE mqtt_broker_reconnects gauge
+mqtt_broker_reconnects 1
+# HELP mqtt_broker_connected_seconds How long zap has been connected to the broker in total
+# TYPE mqtt_broker_connected_seconds gauge
+mqtt_broker_connected_seconds 90
+# HELP mqtt_broker_disconnected_seconds How long zap has not been connected to the broker in total
+# TYPE mqtt_broker_disconnected_seconds gauge
+mqtt_broker_disconnected_seconds 30
+# HELP mqtt_broker_clients_connected $SYS/broker/clients/connected
+# TYPE mqtt_broker_clients_connected gauge
+mqtt_broker_clients_connected 3
+`, buf.String())
+}
@@ -0,0 +1,185 @@
+// Copyright © 2017 Ray Johnson <ray.johnson@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/rayjohnson/zap/viewstats"
+)
+
+// statsLogger appends a row with the stats of each broker to a file every
+// interval until it is closed
+type statsLogger struct {
+	file   *os.File
+	format string
+	csv    *csv.Writer
+
+	stop chan struct{}
+	done chan struct{}
+	err  error
+}
+
+// statsLogFormat returns the format of a log file, given by --log-format
+// or taken from the extension of the file
+func statsLogFormat(path string, format string) string {
+	if format != "" {
+		return format
+	}
+	switch filepath.Ext(path) {
+	case ".json", ".jsonl":
+		return "jsonl"
+	}
+	return "csv"
+}
+
+// startStatsLog opens the log file for appending and starts logging.  A
+// new csv file gets a header with the names of the stats.
+func startStatsLog(path string, format string, interval time.Duration, names []string) (*statsLogger, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l := &statsLogger{
+		file:   file,
+		format: format,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	if format == "csv" {
+		l.csv = csv.NewWriter(file)
+		info, err := file.Stat()
+		if err == nil && info.Size() == 0 {
+			l.csv.Write(append([]string{"timestamp", "broker"}, statsLogColumns()...))
+			l.csv.Flush()
+			err = l.csv.Error()
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	go func() {
+		defer close(l.done)
+		l.err = l.run(interval, names)
+	}()
+	return l, nil
+}
+
+func (l *statsLogger) run(interval time.Duration, names []string) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return nil
+		case at := <-ticker.C:
+			var snapshots []brokerSnapshot
+			for i, name := range names {
+				snapshots = append(snapshots, snapshotBroker(i, name))
+			}
+			if err := l.write(at, snapshots); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// write adds a row for each broker that has sent stats
+func (l *statsLogger) write(at time.Time, snapshots []brokerSnapshot) error {
+	timestamp := at.UTC().Format(time.RFC3339)
+	for _, snap := range snapshots {
+		if len(snap.stats) == 0 {
+			continue
+		}
+
+		if l.format == "jsonl" {
+			values := statsObject(snap)
+			values["timestamp"] = timestamp
+			if snap.conn != nil {
+				values["connection"] = connectionObject(*snap.conn, false)
+			}
+			data, err := json.Marshal(values)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(l.file, "%s\n", data); err != nil {
+				return err
+			}
+			continue
+		}
+
+		byName := make(map[string]string)
+		for _, stat := range snap.stats {
+			byName[stat.Name] = stat.Value
+			if num, ok := stat.Number(); ok {
+				byName[stat.Name] = strconv.FormatFloat(num, 'f', -1, 64)
+			}
+		}
+		if c := snap.conn; c != nil {
+			for name, value := range connectionObject(*c, false) {
+				if num, ok := value.(float64); ok {
+					byName[name] = strconv.FormatFloat(num, 'f', -1, 64)
+				} else {
+					byName[name] = fmt.Sprint(value)
+				}
+			}
+		}
+		row := []string{timestamp, snap.name}
+		for _, name := range statsLogColumns() {
+			row = append(row, byName[name])
+		}
+		l.csv.Write(row)
+	}
+
+	if l.csv != nil {
+		l.csv.Flush()
+		return l.csv.Error()
+	}
+	return nil
+}
+
+// statsLogColumns are the names of the stats followed by the connection
+// history
+func statsLogColumns() []string {
+	return append(viewstats.StatNames(), "connected", "reconnects", "connected_seconds", "disconnected_seconds")
+}
+
+// Close stops logging and closes the file, it returns the error that
+// stopped the logging if there was one
+func (l *statsLogger) Close() error {
+	close(l.stop)
+	<-l.done
+	err := l.file.Close()
+	if l.err != nil {
+		return l.err
+	}
+	return err
+}
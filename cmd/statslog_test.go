@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rayjohnson/zap/viewstats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsLogFormat(t *testing.T) {
+	assert.Equal(t, "csv", statsLogFormat("stats.csv", ""))
+	assert.Equal(t, "csv", statsLogFormat("stats", ""))
+	assert.Equal(t, "jsonl", statsLogFormat("stats.jsonl", ""))
+	assert.Equal(t, "jsonl", statsLogFormat("stats.json", ""))
+	assert.Equal(t, "jsonl", statsLogFormat("stats.csv", "jsonl"))
+}
+
+func TestStatsLogCSV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zap-log")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.csv")
+	at := time.Date(2018, 2, 3, 10, 11, 12, 0, time.UTC)
+
+	conn := &viewstats.Connection{Connected: true, Reconnects: 2, Uptime: 1500 * time.Millisecond}
+
+	// the header is only written to a new file
+	for i := 0; i < 2; i++ {
+		l, err := startStatsLog(path, "csv", time.Hour, nil)
+		require.NoError(t, err)
+		require.NoError(t, l.write(at, []brokerSnapshot{{"prod", testStats, conn}, {"staging", nil, conn}}))
+		require.NoError(t, l.Close())
+	}
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 3)
+	assert.Equal(t, append([]string{"timestamp", "broker"}, statsLogColumns()...), rows[0])
+	assert.Equal(t, rows[1], rows[2])
+
+	row := make(map[string]string)
+	for i, name := range rows[0] {
+		row[name] = rows[1][i]
+	}
+	assert.Equal(t, "2018-02-03T10:11:12Z", row["timestamp"])
+	assert.Equal(t, "prod", row["broker"])
+	assert.Equal(t, "42", row["uptime_seconds"])
+	assert.Equal(t, `mosquitto "1.4"`, row["version"])
+	assert.Equal(t, "0.25", row["load_sockets_1min"])
+	assert.Equal(t, "", row["clients_total"])
+	assert.Equal(t, "true", row["connected"])
+	assert.Equal(t, "2", row["reconnects"])
+	assert.Equal(t, "1.5", row["connected_seconds"])
+	assert.Equal(t, "0", row["disconnected_seconds"])
+}
+
+func TestStatsLogJSONL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zap-log")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.jsonl")
+	at := time.Date(2018, 2, 3, 10, 11, 12, 0, time.UTC)
+
+	l, err := startStatsLog(path, "jsonl", time.Hour, nil)
+	require.NoError(t, err)
+	require.NoError(t, l.write(at, []brokerSnapshot{{"", testStats[3:5], nil}}))
+	require.NoError(t, l.write(at.Add(time.Minute), []brokerSnapshot{{"", testStats[3:4], &viewstats.Connection{Reconnects: 1}}}))
+	require.NoError(t, l.Close())
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, `{"clients_connected":3,"load_sockets_1min":0.25,"timestamp":"2018-02-03T10:11:12Z"}
+{"clients_connected":3,"connection":{"connected":false,"connected_seconds":0,"disconnected_seconds":0,"reconnects":1},"timestamp":"2018-02-03T10:12:12Z"}
+`, string(data))
+}
+
+func TestStatsLogError(t *testing.T) {
+	_, err := startStatsLog(filepath.Join("no", "such", "dir", "stats.csv"), "csv", time.Hour, nil)
+	assert.Error(t, err)
+}
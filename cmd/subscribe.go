@@ -26,6 +26,8 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
 	"text/template"
@@ -33,6 +35,7 @@ import (
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/rayjohnson/zap/output"
+	"github.com/rayjohnson/zap/topicfilter"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
@@ -44,19 +47,46 @@ const builtinTemplate = "Received message on topic: {{.Topic}}\nMessage: {{.Mess
 
 // MqttMessage is the struct passed to the template engine
 type MqttMessage struct {
-	Topic   string
-	Message string
-	MsgJSON map[string]interface{}
+	Topic      string
+	Message    string
+	MsgJSON    map[string]interface{}
+	Decoded    interface{}
+	Properties MqttProperties
+}
+
+// MqttProperties holds the MQTT 5 properties of a message.  They
+// are empty when connected with an older protocol version.
+type MqttProperties struct {
+	ContentType     string
+	ResponseTopic   string
+	CorrelationData string
+	MessageExpiry   uint32
+	UserProperties  map[string]string
 }
 
 type subscribeOptions struct {
 	cleanSession   bool
 	templateString string
-	topic          string
+	topics         []string
+	filters        map[string]byte
 	count          int
 	skipRetained   bool
 	qos            int
 	stdoutTemplate *template.Template
+
+	filterOut       []string
+	filterOutRegexp []string
+	excludeRegexps  []*regexp.Regexp
+
+	where      []string
+	wherePreds []*wherePredicate
+
+	decode          string
+	protoDescriptor string
+	protoMessage    string
+	decoder         payloadDecoder
+
+	record string
 }
 
 type messageOptions struct {
@@ -65,6 +95,12 @@ type messageOptions struct {
 	count          int
 	numMsgs        int
 	skipRetained   bool
+	filterOut      []string
+	excludeRegexps []*regexp.Regexp
+	where          []*wherePredicate
+	decode         string
+	decoder        payloadDecoder
+	recorder       *captureWriter
 }
 
 func newSubscribeCommand() *cobra.Command {
@@ -90,20 +126,40 @@ to stdout.  Use the --format flag to adjust the output.`,
 	flags := cmd.Flags()
 	flags.BoolVar(&subOpts.cleanSession, "clean-session", true, "Set to false and mqtt will send queued up messages if service disconnects and restarts")
 	flags.StringVar(&subOpts.templateString, "template", builtinTemplate, "Template to use for output to stdout")
-	flags.StringVar(&subOpts.topic, "topic", "#", "The mqtt topic or topic filter to listen to")
+	flags.StringArrayVar(&subOpts.topics, "topic", []string{"#"}, "The mqtt topic or topic filter to listen to, may be repeated and use filter@qos to set the qos per filter")
 	flags.IntVar(&subOpts.count, "count", -1, "After count of messages disconnect and exit")
 	flags.BoolVar(&subOpts.skipRetained, "skip-retained", false, "Skip printing messages marked as retained from mqtt")
 	flags.IntVar(&subOpts.qos, "qos", 0, "The qos setting for inbound messages")
-	// TODO: -T, --filter-out. - use regexp for this maybe?  (this is for the topic but what about the message?)
+	flags.StringArrayVarP(&subOpts.filterOut, "filter-out", "T", nil, "Do not print messages on topics matching this topic filter, may be repeated")
+	flags.StringArrayVar(&subOpts.filterOutRegexp, "filter-out-regexp", nil, "Do not print messages on topics matching this regular expression, may be repeated")
+	flags.StringVar(&subOpts.decode, "decode", "", "Decode payloads as json, text, hex, base64, msgpack, cbor or protobuf (default is to try json quietly)")
+	flags.StringVar(&subOpts.protoDescriptor, "proto-descriptor", "", "File descriptor set used by --decode protobuf (see protoc --descriptor_set_out)")
+	flags.StringVar(&subOpts.protoMessage, "proto-message", "", "Full name of the protobuf message type used by --decode protobuf")
+	flags.StringVar(&subOpts.record, "record", "", "Append each message to a capture file that can be played back with zap replay")
+	flags.StringArrayVar(&subOpts.where, "where", nil, "Only print messages matching this expression (e.g. 'MsgJSON.temp > 30'), may be repeated")
 
 	annotation := []string{"0|1|2"}
 	flags.SetAnnotation("qos", "man-arg-hints", annotation)
-	annotation = []string{"topic path"}
+	annotation = []string{"topic path[@qos]"}
 	flags.SetAnnotation("topic", "man-arg-hints", annotation)
 	annotation = []string{"go template"}
 	flags.SetAnnotation("template", "man-arg-hints", annotation)
 	annotation = []string{"int"}
 	flags.SetAnnotation("count", "man-arg-hints", annotation)
+	annotation = []string{"topic filter"}
+	flags.SetAnnotation("filter-out", "man-arg-hints", annotation)
+	annotation = []string{"regexp"}
+	flags.SetAnnotation("filter-out-regexp", "man-arg-hints", annotation)
+	annotation = []string{"expression"}
+	flags.SetAnnotation("where", "man-arg-hints", annotation)
+	annotation = []string{"json|text|hex|base64|msgpack|cbor|protobuf"}
+	flags.SetAnnotation("decode", "man-arg-hints", annotation)
+	annotation = []string{"path"}
+	flags.SetAnnotation("proto-descriptor", "man-arg-hints", annotation)
+	annotation = []string{"path"}
+	flags.SetAnnotation("record", "man-arg-hints", annotation)
+	annotation = []string{"message name"}
+	flags.SetAnnotation("proto-message", "man-arg-hints", annotation)
 
 	zapOpts = buildZapFlags(flags)
 	zapOpts.conOpts = addConnectionFlags(flags)
@@ -124,9 +180,64 @@ func (subOpts *subscribeOptions) validateOptions() error {
 		return err
 	}
 
+	subOpts.filters = make(map[string]byte)
+	for _, topic := range subOpts.topics {
+		filter, qos, err := parseTopicFilter(topic, subOpts.qos)
+		if err != nil {
+			return err
+		}
+		subOpts.filters[filter] = byte(qos)
+	}
+
+	subOpts.excludeRegexps = nil
+	for _, expr := range subOpts.filterOutRegexp {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("bad --filter-out-regexp: %s", err)
+		}
+		subOpts.excludeRegexps = append(subOpts.excludeRegexps, re)
+	}
+
+	subOpts.decoder, err = newPayloadDecoder(subOpts.decode, subOpts.protoDescriptor, subOpts.protoMessage)
+	if err != nil {
+		return err
+	}
+
+	subOpts.wherePreds = nil
+	for _, expr := range subOpts.where {
+		pred, err := parseWhere(expr)
+		if err != nil {
+			return err
+		}
+		subOpts.wherePreds = append(subOpts.wherePreds, pred)
+	}
+
 	return nil
 }
 
+// parseTopicFilter splits a --topic value of the form filter@qos.  If there
+// is no @qos suffix the default qos is used.
+func parseTopicFilter(topic string, defQos int) (string, int, error) {
+	i := strings.LastIndex(topic, "@")
+	if i < 0 {
+		return topic, defQos, nil
+	}
+
+	qos, err := strconv.Atoi(topic[i+1:])
+	if err != nil {
+		// the @ is just part of the topic name
+		return topic, defQos, nil
+	}
+	if qos < 0 || qos > 2 {
+		return "", 0, fmt.Errorf("qos for topic %s must be 0, 1 or 2", topic[:i])
+	}
+	if i == 0 {
+		return "", 0, fmt.Errorf("missing topic filter before @%d", qos)
+	}
+
+	return topic[:i], qos, nil
+}
+
 func runSubscribe(flags *pflag.FlagSet, zapOpts *zapOptions) error {
 	subOpts := zapOpts.subOpts
 
@@ -135,6 +246,16 @@ func runSubscribe(flags *pflag.FlagSet, zapOpts *zapOptions) error {
 	}
 	clientOpts := zapOpts.clientOpts
 
+	// open the capture file first so it is closed after we disconnect
+	var recorder *captureWriter
+	if subOpts.record != "" {
+		var err error
+		if recorder, err = newCaptureWriter(subOpts.record); err != nil {
+			return err
+		}
+		defer recorder.Close()
+	}
+
 	quit := make(chan bool)
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
@@ -144,7 +265,7 @@ func runSubscribe(flags *pflag.FlagSet, zapOpts *zapOptions) error {
 		quit <- true
 	}()
 
-	client := MQTT.NewClient(clientOpts)
+	client := zapOpts.newClient()
 	if token := client.Connect(); token.Wait() && token.Error() != nil {
 		return fmt.Errorf("could not connect: %s", token.Error())
 	}
@@ -157,13 +278,19 @@ func runSubscribe(flags *pflag.FlagSet, zapOpts *zapOptions) error {
 	msgOpts.count = subOpts.count
 	msgOpts.skipRetained = subOpts.skipRetained
 	msgOpts.stdoutTemplate = subOpts.stdoutTemplate
-
-	if token := client.Subscribe(subOpts.topic, byte(subOpts.qos), func(client MQTT.Client, msg MQTT.Message) {
+	msgOpts.filterOut = subOpts.filterOut
+	msgOpts.excludeRegexps = subOpts.excludeRegexps
+	msgOpts.where = subOpts.wherePreds
+	msgOpts.decode = subOpts.decode
+	msgOpts.decoder = subOpts.decoder
+	msgOpts.recorder = recorder
+
+	if token := client.SubscribeMultiple(subOpts.filters, func(client MQTT.Client, msg MQTT.Message) {
 		subscriptionHandler(client, msg, &msgOpts)
 	}); token.Wait() && token.Error() != nil {
 		return fmt.Errorf("could not subscribe: %s", token.Error())
 	}
-	defer client.Unsubscribe(subOpts.topic)
+	defer client.Unsubscribe(subOpts.filterNames()...)
 
 loop:
 	for {
@@ -177,14 +304,73 @@ loop:
 	return nil
 }
 
+// filterNames returns the topic filters without their qos
+func (subOpts *subscribeOptions) filterNames() []string {
+	var names []string
+	for filter := range subOpts.filters {
+		names = append(names, filter)
+	}
+	return names
+}
+
+// isFilteredOut returns true if the topic matches any --filter-out or --filter-out-regexp
+func (msgOpts *messageOptions) isFilteredOut(topic string) bool {
+	for _, filter := range msgOpts.filterOut {
+		if topicfilter.Match(filter, topic) {
+			return true
+		}
+	}
+	for _, re := range msgOpts.excludeRegexps {
+		if re.MatchString(topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// newMqttMessage builds what the template engine sees from a received message
+func newMqttMessage(msg MQTT.Message, decode string, decoder payloadDecoder) MqttMessage {
+	data := MqttMessage{Topic: msg.Topic(), Message: string(msg.Payload())}
+	if v5Msg, ok := msg.(*v5Message); ok {
+		data.Properties = v5Msg.properties()
+	}
+	data.MsgJSON = map[string]interface{}{}
+	if decoded, err := decoder(msg.Payload()); err == nil {
+		data.Decoded = decoded
+		if m, ok := decoded.(map[string]interface{}); ok {
+			data.MsgJSON = m
+		}
+	} else if decode != "" {
+		// only complain if the user asked for a decoder
+		fmt.Printf("Can not decode as %s: %s\n", decode, err)
+	}
+
+	return data
+}
+
 func subscriptionHandler(client MQTT.Client, msg MQTT.Message, msgOpts *messageOptions) {
 	doExit := false
+	received := time.Now()
 
 	// skipping retained messages does not count toward --count value
 	if msgOpts.skipRetained && msg.Retained() {
 		return
 	}
 
+	// neither do messages on topics that are filtered out
+	if msgOpts.isFilteredOut(msg.Topic()) {
+		return
+	}
+
+	data := newMqttMessage(msg, msgOpts.decode, msgOpts.decoder)
+
+	// messages that do not match --where are dropped and not counted
+	for _, pred := range msgOpts.where {
+		if !pred.matches(&data) {
+			return
+		}
+	}
+
 	// This handles the --count option
 	if msgOpts.count > 0 {
 		// TODO: this may be a race condition
@@ -198,15 +384,13 @@ func subscriptionHandler(client MQTT.Client, msg MQTT.Message, msgOpts *messageO
 		}
 	}
 
-	var buf bytes.Buffer
-	data := MqttMessage{Topic: msg.Topic(), Message: string(msg.Payload())}
-	m := map[string]interface{}{}
-	if err := json.Unmarshal([]byte(data.Message), &m); err != nil {
-		// TODO: Need flag to know if user wants json or not
-		fmt.Printf("Can not parse as json: %s", err)
+	if msgOpts.recorder != nil {
+		if err := msgOpts.recorder.write(newCaptureRecord(msg, received)); err != nil {
+			fmt.Printf("error recording message: %s\n", err)
+		}
 	}
-	data.MsgJSON = m
 
+	var buf bytes.Buffer
 	err := msgOpts.stdoutTemplate.Execute(&buf, data)
 	if err != nil {
 		fmt.Printf("error using template: %s", err)
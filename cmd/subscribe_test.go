@@ -17,7 +17,7 @@ func TestValidateSubscribeOptions(t *testing.T) {
 		templateString: "{{",
 	}
 	err = subOpts.validateOptions()
-	assert.Equal(t, "template: stdout:1: unexpected unclosed action in command", err.Error(), "error message not right")
+	assert.Equal(t, "template: stdout:1: unclosed action", err.Error(), "error message not right")
 	assert.Nil(t, subOpts.stdoutTemplate)
 
 	subOpts.templateString = ".Message"
@@ -35,5 +35,59 @@ func TestNewSubscribeCommand(t *testing.T) {
 	assert.NotNil(t, flags.Lookup("count"))
 	assert.NotNil(t, flags.Lookup("skip-retained"))
 	assert.NotNil(t, flags.Lookup("qos"))
+	assert.NotNil(t, flags.Lookup("filter-out"))
+	assert.NotNil(t, flags.Lookup("filter-out-regexp"))
 	assert.Nil(t, flags.Lookup("not-an-option"))
 }
+
+func TestParseTopicFilter(t *testing.T) {
+	filter, qos, err := parseTopicFilter("sensors/+/temp", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "sensors/+/temp", filter)
+	assert.Equal(t, 1, qos)
+
+	filter, qos, err = parseTopicFilter("alerts/#@2", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "alerts/#", filter)
+	assert.Equal(t, 2, qos)
+
+	filter, qos, err = parseTopicFilter("user@example.com", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "user@example.com", filter)
+	assert.Equal(t, 0, qos)
+
+	_, _, err = parseTopicFilter("alerts/#@3", 0)
+	assert.Equal(t, "qos for topic alerts/# must be 0, 1 or 2", err.Error(), "error message not right")
+
+	_, _, err = parseTopicFilter("@1", 0)
+	assert.Equal(t, "missing topic filter before @1", err.Error(), "error message not right")
+
+	subOpts := &subscribeOptions{
+		templateString: ".Message",
+		topics:         []string{"sensors/+/temp@1", "alerts/#@2"},
+	}
+	err = subOpts.validateOptions()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]byte{"sensors/+/temp": 1, "alerts/#": 2}, subOpts.filters)
+}
+
+func TestFilterOut(t *testing.T) {
+	subOpts := &subscribeOptions{
+		templateString:  ".Message",
+		filterOutRegexp: []string{"("},
+	}
+	err := subOpts.validateOptions()
+	assert.Equal(t, "bad --filter-out-regexp: error parsing regexp: missing closing ): `(`", err.Error(), "error message not right")
+
+	subOpts.filterOut = []string{"$SYS/#", "+/heartbeat"}
+	subOpts.filterOutRegexp = []string{"^debug/.*/trace$"}
+	err = subOpts.validateOptions()
+	assert.Nil(t, err)
+
+	msgOpts := &messageOptions{filterOut: subOpts.filterOut, excludeRegexps: subOpts.excludeRegexps}
+	assert.True(t, msgOpts.isFilteredOut("$SYS/broker/uptime"))
+	assert.True(t, msgOpts.isFilteredOut("device1/heartbeat"))
+	assert.True(t, msgOpts.isFilteredOut("debug/device1/trace"))
+	assert.False(t, msgOpts.isFilteredOut("device1/temp"))
+	assert.False(t, msgOpts.isFilteredOut("debug/device1/trace/more"))
+}
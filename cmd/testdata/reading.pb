@@ -0,0 +1,8 @@
+
+
+reading.protozap.test"_
+Reading
+sensor (	Rsensor
+temp (Rtemp
+count (Rcount
+tags (	Rtagsbproto3
\ No newline at end of file
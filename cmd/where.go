@@ -0,0 +1,373 @@
+// Copyright © 2017 Ray Johnson <ray.johnson@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A wherePredicate is a parsed --where expression.  The syntax is a list of
+// comparisons joined by && and ||, where && binds tighter.  Each comparison
+// is a path into the message (e.g. MsgJSON.sensor.temp or MsgJSON.list[0])
+// optionally followed by an operator (==, !=, <, <=, >, >=, =~) and a value
+// (a number, a quoted string, true, false or null).  A path on its own is
+// true if the value exists and is not false, null, zero or empty.
+type wherePredicate struct {
+	// the outer slice is or'ed together, the inner one and'ed
+	terms [][]whereComparison
+}
+
+type whereComparison struct {
+	path  []string
+	op    string
+	value interface{}
+	re    *regexp.Regexp
+}
+
+var whereOps = []string{"==", "!=", "<=", ">=", "=~", "<", ">"}
+
+func parseWhere(expr string) (*wherePredicate, error) {
+	pred := &wherePredicate{}
+	for _, orPart := range splitWhere(expr, "||") {
+		var term []whereComparison
+		for _, andPart := range splitWhere(orPart, "&&") {
+			comp, err := parseWhereComparison(strings.TrimSpace(andPart))
+			if err != nil {
+				return nil, fmt.Errorf("bad --where %q: %s", expr, err)
+			}
+			term = append(term, comp)
+		}
+		pred.terms = append(pred.terms, term)
+	}
+	return pred, nil
+}
+
+// splitWhere splits the expression at each sep that is not inside a quoted
+// string, so "a||b" stays a value
+func splitWhere(expr string, sep string) []string {
+	var parts []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(expr); i++ {
+		switch {
+		case quote != 0:
+			if expr[i] == quote {
+				quote = 0
+			}
+		case expr[i] == '"' || expr[i] == '\'':
+			quote = expr[i]
+		case strings.HasPrefix(expr[i:], sep):
+			parts = append(parts, expr[start:i])
+			i += len(sep) - 1
+			start = i + 1
+		}
+	}
+	return append(parts, expr[start:])
+}
+
+func parseWhereComparison(str string) (whereComparison, error) {
+	comp := whereComparison{}
+	if str == "" {
+		return comp, fmt.Errorf("missing comparison")
+	}
+
+	pathStr := str
+	for i := range str {
+		for _, op := range whereOps {
+			if strings.HasPrefix(str[i:], op) {
+				pathStr = strings.TrimSpace(str[:i])
+				comp.op = op
+				valueStr := strings.TrimSpace(str[i+len(op):])
+				value, err := parseWhereValue(valueStr)
+				if err != nil {
+					return comp, err
+				}
+				comp.value = value
+				break
+			}
+		}
+		if comp.op != "" {
+			break
+		}
+	}
+
+	path, err := parseWherePath(pathStr)
+	if err != nil {
+		return comp, err
+	}
+	comp.path = path
+
+	if comp.op == "=~" {
+		str, ok := comp.value.(string)
+		if !ok {
+			return comp, fmt.Errorf("=~ needs a quoted regular expression")
+		}
+		if comp.re, err = regexp.Compile(str); err != nil {
+			return comp, err
+		}
+	}
+
+	return comp, nil
+}
+
+func parseWhereValue(str string) (interface{}, error) {
+	switch str {
+	case "":
+		return nil, fmt.Errorf("missing value")
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+
+	if str[0] == '"' || str[0] == '\'' {
+		if len(str) < 2 || str[len(str)-1] != str[0] {
+			return nil, fmt.Errorf("unterminated string %s", str)
+		}
+		return str[1 : len(str)-1], nil
+	}
+
+	num, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return nil, fmt.Errorf("value %s is not a number, quoted string, true, false or null", str)
+	}
+	return num, nil
+}
+
+// parseWherePath splits a.b[2].c into its parts: a, b, 2, c
+func parseWherePath(str string) ([]string, error) {
+	if str == "" {
+		return nil, fmt.Errorf("missing path")
+	}
+
+	var path []string
+	for _, part := range strings.Split(str, ".") {
+		for part != "" {
+			open := strings.Index(part, "[")
+			if open < 0 {
+				path = append(path, part)
+				break
+			}
+			if open > 0 {
+				path = append(path, part[:open])
+			}
+			end := strings.Index(part, "]")
+			if end < open {
+				return nil, fmt.Errorf("missing ] in %s", str)
+			}
+			path = append(path, part[open+1:end])
+			part = part[end+1:]
+		}
+	}
+
+	for _, part := range path {
+		if part == "" || strings.IndexFunc(part, unicode.IsSpace) >= 0 {
+			return nil, fmt.Errorf("bad path %s", str)
+		}
+	}
+	return path, nil
+}
+
+// matches evaluates the predicate against a received message
+func (pred *wherePredicate) matches(data *MqttMessage) bool {
+	for _, term := range pred.terms {
+		all := true
+		for _, comp := range term {
+			if !comp.matches(data) {
+				all = false
+				break
+			}
+		}
+		if all {
+			return true
+		}
+	}
+	return false
+}
+
+func (comp *whereComparison) matches(data *MqttMessage) bool {
+	value, found := lookupWherePath(data, comp.path)
+
+	switch comp.op {
+	case "":
+		return found && isTruthy(value)
+	case "=~":
+		str, ok := value.(string)
+		return found && ok && comp.re.MatchString(str)
+	case "==":
+		return found && whereEqual(value, comp.value)
+	case "!=":
+		return !found || !whereEqual(value, comp.value)
+	}
+
+	if !found {
+		return false
+	}
+	cmp, ok := whereCompare(value, comp.value)
+	if !ok {
+		return false
+	}
+	switch comp.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+func lookupWherePath(data *MqttMessage, path []string) (interface{}, bool) {
+	var current interface{}
+	switch path[0] {
+	case "Topic":
+		current = data.Topic
+	case "Message":
+		current = data.Message
+	case "MsgJSON":
+		current = data.MsgJSON
+	case "Decoded":
+		current = data.Decoded
+	default:
+		return nil, false
+	}
+
+	for _, part := range path[1:] {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			v, ok := node[part]
+			if !ok {
+				return nil, false
+			}
+			current = v
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			current = node[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return current, true
+}
+
+func isTruthy(value interface{}) bool {
+	if n, ok := toFloat(value); ok {
+		return n != 0
+	}
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case map[string]interface{}:
+		return len(v) > 0
+	case []interface{}:
+		return len(v) > 0
+	}
+	return true
+}
+
+func whereEqual(a interface{}, b interface{}) bool {
+	if cmp, ok := whereCompare(a, b); ok {
+		return cmp == 0
+	}
+	switch av := a.(type) {
+	case nil:
+		return b == nil
+	case bool:
+		bv, ok := b.(bool)
+		return ok && av == bv
+	}
+	return false
+}
+
+// whereCompare compares two numbers or two strings
+func whereCompare(a interface{}, b interface{}) (int, bool) {
+	if av, ok := toFloat(a); ok {
+		bv, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case av < bv:
+			return -1, true
+		case av > bv:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	switch av := a.(type) {
+	case string:
+		bv, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(av, bv), true
+	}
+	return 0, false
+}
+
+// toFloat handles the different number types the decoders produce
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func whereMatches(t *testing.T, expr string, payload string) bool {
+	pred, err := parseWhere(expr)
+	assert.NoError(t, err, expr)
+
+	data := MqttMessage{Topic: "sensors/kitchen/temp", Message: payload}
+	json.Unmarshal([]byte(payload), &data.MsgJSON)
+	return pred.matches(&data)
+}
+
+func TestWhere(t *testing.T) {
+	payload := `{"temperature": 31.5, "unit": "C", "ok": true, "tags": ["a", "b"], "meta": {"room": "kitchen"}}`
+
+	assert.True(t, whereMatches(t, "MsgJSON.temperature > 30", payload))
+	assert.False(t, whereMatches(t, "MsgJSON.temperature <= 30", payload))
+	assert.True(t, whereMatches(t, "MsgJSON.unit == 'C'", payload))
+	assert.True(t, whereMatches(t, `MsgJSON.meta.room != "garage"`, payload))
+	assert.True(t, whereMatches(t, `MsgJSON.tags[1] == "b"`, payload))
+	assert.True(t, whereMatches(t, "MsgJSON.ok", payload))
+	assert.False(t, whereMatches(t, "MsgJSON.missing", payload))
+	assert.False(t, whereMatches(t, "MsgJSON.missing > 1", payload))
+	assert.True(t, whereMatches(t, "MsgJSON.missing > 1 || MsgJSON.ok == true", payload))
+	assert.False(t, whereMatches(t, "MsgJSON.ok && MsgJSON.temperature < 0", payload))
+	assert.True(t, whereMatches(t, `Topic =~ "^sensors/.*/temp$"`, payload))
+	assert.False(t, whereMatches(t, "MsgJSON.temperature > 30", "not json"))
+}
+
+func TestWhereOperatorsInQuotes(t *testing.T) {
+	payload := `{"msg": "a||b", "other": "c&&d", "ok": true}`
+
+	assert.True(t, whereMatches(t, `MsgJSON.msg == "a||b"`, payload))
+	assert.True(t, whereMatches(t, `MsgJSON.other == 'c&&d' && MsgJSON.ok`, payload))
+	assert.True(t, whereMatches(t, `MsgJSON.msg == "x||y" || MsgJSON.other =~ "&&"`, payload))
+	assert.False(t, whereMatches(t, `MsgJSON.msg == "a" || MsgJSON.msg == "b"`, payload))
+
+	pred, err := parseWhere(`MsgJSON.msg == "a||b" && MsgJSON.ok`)
+	assert.NoError(t, err)
+	assert.Len(t, pred.terms, 1)
+	assert.Len(t, pred.terms[0], 2)
+	assert.Equal(t, "a||b", pred.terms[0][0].value)
+
+	_, err = parseWhere(`MsgJSON.msg == "a||b`)
+	assert.Equal(t, `bad --where "MsgJSON.msg == \"a||b": unterminated string "a||b`, err.Error(), "error message not right")
+}
+
+func TestBadWhere(t *testing.T) {
+	_, err := parseWhere("MsgJSON.temperature >")
+	assert.Equal(t, `bad --where "MsgJSON.temperature >": missing value`, err.Error(), "error message not right")
+
+	_, err = parseWhere("MsgJSON.temperature > hot")
+	assert.Equal(t, `bad --where "MsgJSON.temperature > hot": value hot is not a number, quoted string, true, false or null`, err.Error(), "error message not right")
+
+	_, err = parseWhere(`MsgJSON.name == "abc`)
+	assert.Equal(t, `bad --where "MsgJSON.name == \"abc": unterminated string "abc`, err.Error(), "error message not right")
+
+	_, err = parseWhere("MsgJSON.a && ")
+	assert.Equal(t, `bad --where "MsgJSON.a && ": missing comparison`, err.Error(), "error message not right")
+
+	_, err = parseWhere("Topic =~ 5")
+	assert.Equal(t, `bad --where "Topic =~ 5": =~ needs a quoted regular expression`, err.Error(), "error message not right")
+}
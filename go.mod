@@ -0,0 +1,36 @@
+module github.com/rayjohnson/zap
+
+go 1.22
+
+require (
+	github.com/eclipse/paho.golang v0.12.0
+	github.com/eclipse/paho.mqtt.golang v1.2.0
+	github.com/fxamacker/cbor/v2 v2.7.0
+	github.com/mitchellh/go-homedir v1.1.0
+	github.com/moby/term v0.5.2
+	github.com/nsf/termbox-go v0.0.0-20190121233118-02980233997d
+	github.com/pelletier/go-toml v1.0.1
+	github.com/spf13/cobra v0.0.1
+	github.com/spf13/pflag v1.0.0
+	github.com/stretchr/testify v1.8.4
+	github.com/vmihailenco/msgpack/v4 v4.3.13
+	google.golang.org/protobuf v1.36.6
+)
+
+require (
+	github.com/Azure/go-ansiterm v0.0.0-20250102033503-faa5f7b0171c // indirect
+	github.com/BurntSushi/toml v1.6.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/inconshreveable/mousetrap v1.1.0 // indirect
+	github.com/mattn/go-runewidth v0.0.3 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/vmihailenco/tagparser v0.1.1 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/net v0.17.0 // indirect
+	golang.org/x/sync v0.4.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+	google.golang.org/appengine v1.6.8 // indirect
+	gopkg.in/yaml.v2 v2.4.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
@@ -0,0 +1,33 @@
+package topicfilter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	table := []struct {
+		filter  string
+		topic   string
+		matches bool
+	}{
+		{"#", "a/b/c", true},
+		{"#", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/+/c", "a/b/d", false},
+		{"a/+", "a/b/c", false},
+		{"+/+", "/finance", true},
+		{"+", "/finance", false},
+		{"a/b", "a/b", true},
+		{"a/b", "a/b/c", false},
+	}
+
+	for _, entry := range table {
+		assert.Equal(t, entry.matches, Match(entry.filter, entry.topic), "filter %s topic %s", entry.filter, entry.topic)
+	}
+}
@@ -0,0 +1,146 @@
+package viewstats
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/nsf/termbox-go"
+)
+
+// Rule is an alert on a stat, e.g. clients.connected < 10
+type Rule struct {
+	Text     string // the rule as written
+	Stat     string // the name of the stat, e.g. clients_connected
+	Op       string
+	Limit    float64
+	Critical bool // a critical alert rather than a warning
+}
+
+// Alert is a rule that fired for a broker, or could not be checked because
+// the stat has not arrived or is not a number
+type Alert struct {
+	Rule    Rule
+	Broker  int
+	Value   string
+	Missing bool
+}
+
+var ruleRE = regexp.MustCompile(`^\s*([A-Za-z0-9_.]+)\s*(<=|>=|==|!=|<|>)\s*(\S+)\s*$`)
+
+var rules []Rule
+
+var alertWriter = colorWriter(termbox.ColorRed | termbox.AttrBold)
+
+// ParseRule parses a rule like load.publish.dropped.1min > 0.  The stat
+// is named as in --format json, dots may be used instead of underscores.
+func ParseRule(text string, critical bool) (Rule, error) {
+	match := ruleRE.FindStringSubmatch(text)
+	if match == nil {
+		return Rule{}, fmt.Errorf("stats alert %q must look like clients.connected < 10", text)
+	}
+
+	name := strings.Replace(match[1], ".", "_", -1)
+	if _, ok := statsByName[name]; !ok {
+		return Rule{}, fmt.Errorf("stats alert %q has unknown stat %s", text, match[1])
+	}
+	limit, err := strconv.ParseFloat(match[3], 64)
+	if err != nil {
+		return Rule{}, fmt.Errorf("stats alert %q must compare with a number", text)
+	}
+
+	return Rule{Text: strings.TrimSpace(text), Stat: name, Op: match[2], Limit: limit, Critical: critical}, nil
+}
+
+// SetRules sets the rules checked by Alerts and highlighted in the UI
+func SetRules(r []Rule) {
+	mqttDataLock.Lock()
+	defer mqttDataLock.Unlock()
+	rules = r
+}
+
+// Rules returns the rules set with SetRules
+func Rules() []Rule {
+	mqttDataLock.RLock()
+	defer mqttDataLock.RUnlock()
+	return rules
+}
+
+// Alerts checks the rules against the stats of a broker
+func Alerts(broker int) []Alert {
+	mqttDataLock.RLock()
+	defer mqttDataLock.RUnlock()
+	alerts := brokers[broker].alerts()
+	for i := range alerts {
+		alerts[i].Broker = broker
+	}
+	return alerts
+}
+
+func (b *brokerStats) alerts() []Alert {
+	var alerts []Alert
+	for _, r := range rules {
+		value, ok := b.mqttData[statsByName[r.Stat].key]
+		num, isNum := Stat{Value: value}.Number()
+		if !ok || !isNum {
+			alerts = append(alerts, Alert{Rule: r, Value: value, Missing: true})
+		} else if r.fires(num) {
+			alerts = append(alerts, Alert{Rule: r, Value: value})
+		}
+	}
+	return alerts
+}
+
+// alerting is true if a rule on the stat with the key fires
+func (b *brokerStats) alerting(key string) bool {
+	def, ok := statsByKey[key]
+	if !ok {
+		return false
+	}
+	num, ok := Stat{Value: b.mqttData.get(key)}.Number()
+	if !ok {
+		return false
+	}
+	for _, r := range rules {
+		if r.Stat == def.name && r.fires(num) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Rule) fires(value float64) bool {
+	switch r.Op {
+	case "<":
+		return value < r.Limit
+	case "<=":
+		return value <= r.Limit
+	case ">":
+		return value > r.Limit
+	case ">=":
+		return value >= r.Limit
+	case "==":
+		return value == r.Limit
+	case "!=":
+		return value != r.Limit
+	}
+	return false
+}
+
+// drawAlerts lists the rules that fire for the broker in red
+func drawAlerts(b *brokerStats, x, y int) int {
+	for _, a := range b.alerts() {
+		if a.Missing {
+			continue
+		}
+		level := "WARNING"
+		if a.Rule.Critical {
+			level = "CRITICAL"
+		}
+		alertWriter(x, y, fmt.Sprintf("%s: %s (is %s)", level, a.Rule.Text, a.Value))
+		y++
+	}
+
+	return y
+}
@@ -0,0 +1,74 @@
+package viewstats
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRule(t *testing.T) {
+	rule, err := ParseRule(" load.publish.dropped.1min>=0.5 ", true)
+	require.NoError(t, err)
+	assert.Equal(t, Rule{Text: "load.publish.dropped.1min>=0.5", Stat: "load_publish_dropped_1min", Op: ">=", Limit: 0.5, Critical: true}, rule)
+
+	table := []struct {
+		text string
+		err  string
+	}{
+		{"clients.connected", `stats alert "clients.connected" must look like clients.connected < 10`},
+		{"clients.connected = 1", `stats alert "clients.connected = 1" must look like clients.connected < 10`},
+		{"clients.lost < 1", `stats alert "clients.lost < 1" has unknown stat clients.lost`},
+		{"clients.connected < ten", `stats alert "clients.connected < ten" must compare with a number`},
+	}
+	for _, test := range table {
+		_, err := ParseRule(test.text, false)
+		assert.EqualError(t, err, test.err)
+	}
+}
+
+func TestRuleFires(t *testing.T) {
+	table := []struct {
+		op    string
+		fires []bool // for 1, 2 and 3 against a limit of 2
+	}{
+		{"<", []bool{true, false, false}},
+		{"<=", []bool{true, true, false}},
+		{">", []bool{false, false, true}},
+		{">=", []bool{false, true, true}},
+		{"==", []bool{false, true, false}},
+		{"!=", []bool{true, false, true}},
+	}
+	for _, test := range table {
+		r := Rule{Op: test.op, Limit: 2}
+		for i, fires := range test.fires {
+			assert.Equal(t, fires, r.fires(float64(i+1)), test.op)
+		}
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	low, err := ParseRule("clients.connected < 10", false)
+	require.NoError(t, err)
+	uptime, err := ParseRule("uptime.seconds < 60", true)
+	require.NoError(t, err)
+	dropped, err := ParseRule("load.publish.dropped.1min > 0", true)
+	require.NoError(t, err)
+	SetRules([]Rule{low, uptime, dropped})
+	defer SetRules(nil)
+
+	PrepViewer("one", "two")
+	storeStat(statMsg{1, "$SYS/broker/clients/connected", "3"})
+	storeStat(statMsg{1, "$SYS/broker/uptime", "90 seconds"})
+	storeStat(statMsg{1, "$SYS/broker/load/publish/dropped/1min", "0"})
+
+	assert.Equal(t, []Alert{{Rule: low, Broker: 1, Value: "3"}}, Alerts(1))
+	assert.Len(t, Alerts(0), 3)
+	for _, a := range Alerts(0) {
+		assert.True(t, a.Missing)
+	}
+
+	assert.True(t, brokers[1].alerting("Clients Connected"))
+	assert.False(t, brokers[1].alerting("Broker Uptime"))
+	assert.False(t, brokers[0].alerting("Clients Connected"))
+}
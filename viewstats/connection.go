@@ -0,0 +1,152 @@
+package viewstats
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// only the latest outages are kept so a flapping connection does not use
+// up memory over a long session
+const maxOutages = 100
+
+// Outage is a time zap could not reach a broker
+type Outage struct {
+	Start  time.Time
+	End    time.Time // zero while the broker is still down
+	Reason string
+}
+
+// Duration is how long the outage lasted, or has lasted so far
+func (o Outage) Duration(now time.Time) time.Duration {
+	if o.End.IsZero() {
+		return now.Sub(o.Start)
+	}
+	return o.End.Sub(o.Start)
+}
+
+// Connection is the history of the connection to a broker
+type Connection struct {
+	Connected  bool
+	Reconnects int
+	Uptime     time.Duration // the total time zap was connected
+	Downtime   time.Duration // the total time zap was not connected
+	Outages    []Outage      // the latest outages, oldest first
+}
+
+// connHistory is kept for each broker from the ConnectHandlers
+type connHistory struct {
+	since    time.Time // when the connection last went up or down
+	connects int
+	uptime   time.Duration
+	downtime time.Duration
+	outages  []Outage
+}
+
+// ConnectionHistory returns the history of the connection to a broker
+func ConnectionHistory(broker int) Connection {
+	mqttDataLock.RLock()
+	defer mqttDataLock.RUnlock()
+	return brokers[broker].connection(time.Now())
+}
+
+// recordConnection adds a ConnectHandler to the history, only changes
+// between connected and disconnected count
+func (b *brokerStats) recordConnection(c ConnectHandler, at time.Time) {
+	history := &b.history
+	known := !history.since.IsZero()
+	wasConnected := b.conData.IsConnected
+	if known && c.IsConnected == wasConnected {
+		b.conData = c
+		return
+	}
+
+	if known {
+		if wasConnected {
+			history.uptime += at.Sub(history.since)
+		} else {
+			history.downtime += at.Sub(history.since)
+		}
+	}
+	history.since = at
+
+	if c.IsConnected {
+		if n := len(history.outages); n > 0 && history.outages[n-1].End.IsZero() {
+			history.outages[n-1].End = at
+		}
+		history.connects++
+		// a reconnect continues the session, only the first connect
+		// (or the r key) starts a new one
+		if history.connects == 1 {
+			b.startTime = at
+		}
+	} else {
+		reason := "disconnected"
+		if c.Err != nil {
+			reason = c.Err.Error()
+		}
+		history.outages = append(history.outages, Outage{Start: at, Reason: reason})
+		if len(history.outages) > maxOutages {
+			history.outages = history.outages[len(history.outages)-maxOutages:]
+		}
+	}
+	b.conData = c
+}
+
+func (b *brokerStats) connection(now time.Time) Connection {
+	history := b.history
+	c := Connection{
+		Connected: b.conData.IsConnected,
+		Uptime:    history.uptime,
+		Downtime:  history.downtime,
+		Outages:   append([]Outage{}, history.outages...),
+	}
+	if history.connects > 1 {
+		c.Reconnects = history.connects - 1
+	}
+	if !history.since.IsZero() {
+		if c.Connected {
+			c.Uptime += now.Sub(history.since)
+		} else {
+			c.Downtime += now.Sub(history.since)
+		}
+	}
+	return c
+}
+
+// drawConnection draws the totals of the connection history and the
+// latest outages
+func drawConnection(w termWriter, b *brokerStats, x, y int, width int, now time.Time) int {
+	c := b.connection(now)
+	mid := 12
+	y = drawTitle(underlineWriter, x, y, mid+8, "Connection")
+	y = drawOne(w, x, y, mid, "Reconnects", strconv.Itoa(c.Reconnects))
+	y = drawOne(w, x, y, mid, "Connected", formatShare(c.Uptime, c.Uptime+c.Downtime))
+	y = drawOne(w, x, y, mid, "Disconnected", formatShare(c.Downtime, c.Uptime+c.Downtime))
+
+	shown := 0
+	for i := len(c.Outages) - 1; i >= 0 && shown < 3; i-- {
+		o := c.Outages[i]
+		when := fmt.Sprintf("%s for %s", o.Start.Format(datePrint), o.Duration(now).Round(time.Second))
+		if o.End.IsZero() {
+			when = fmt.Sprintf("%s, down %s", o.Start.Format(datePrint), o.Duration(now).Round(time.Second))
+		}
+		line := []rune(fmt.Sprintf("%*s : %s: %s", mid, "Outage", when, o.Reason))
+		if len(line) > width {
+			line = line[:width]
+		}
+		w(x, y, string(line))
+		y++
+		shown++
+	}
+
+	return y
+}
+
+// formatShare formats a duration along with its share of the total
+func formatShare(d time.Duration, total time.Duration) string {
+	if total <= 0 {
+		return d.Round(time.Second).String()
+	}
+	return fmt.Sprintf("%s (%.1f%%)", d.Round(time.Second), 100*float64(d)/float64(total))
+}
@@ -0,0 +1,80 @@
+package viewstats
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordConnection(t *testing.T) {
+	PrepViewer()
+	b := brokers[0]
+	start := time.Date(2018, 2, 3, 10, 0, 0, 0, time.UTC)
+	at := func(secs int) time.Time { return start.Add(time.Duration(secs) * time.Second) }
+
+	// nothing is known before the first connect
+	assert.Equal(t, Connection{Outages: []Outage{}}, b.connection(at(0)))
+
+	b.recordConnection(ConnectHandler{IsConnected: true}, at(0))
+	assert.Equal(t, at(0), b.startTime)
+	b.recordConnection(ConnectHandler{IsConnected: true}, at(5))
+	b.recordConnection(ConnectHandler{IsConnected: false, Err: errors.New("EOF")}, at(60))
+	b.recordConnection(ConnectHandler{IsConnected: false, Err: errors.New("refused")}, at(65))
+	b.recordConnection(ConnectHandler{IsConnected: true}, at(90))
+	assert.Equal(t, at(0), b.startTime, "a reconnect must not restart the session")
+	b.recordConnection(ConnectHandler{IsConnected: false}, at(100))
+
+	assert.Equal(t, Connection{
+		Connected:  false,
+		Reconnects: 1,
+		Uptime:     70 * time.Second,
+		Downtime:   40 * time.Second,
+		Outages: []Outage{
+			{Start: at(60), End: at(90), Reason: "EOF"},
+			{Start: at(100), Reason: "disconnected"},
+		},
+	}, b.connection(at(110)))
+	assert.Equal(t, 30*time.Second, b.history.outages[0].Duration(at(110)))
+	assert.Equal(t, 10*time.Second, b.history.outages[1].Duration(at(110)))
+
+	for i := 0; i < maxOutages; i++ {
+		b.recordConnection(ConnectHandler{IsConnected: true}, at(200+2*i))
+		b.recordConnection(ConnectHandler{IsConnected: false}, at(201+2*i))
+	}
+	assert.Len(t, b.connection(at(1000)).Outages, maxOutages)
+	assert.Equal(t, maxOutages+1, b.connection(at(1000)).Reconnects)
+	assert.Equal(t, at(0), b.startTime)
+}
+
+func TestDrawConnection(t *testing.T) {
+	var lines []string
+	f := func(x, y int, str string) { lines = append(lines, str) }
+
+	PrepViewer()
+	start := time.Date(2018, 2, 3, 10, 0, 0, 0, time.UTC)
+	y := drawConnection(f, brokers[0], 0, 0, 60, start)
+	assert.Equal(t, 4, y)
+	assert.Equal(t, []string{
+		"  Reconnects : 0",
+		"   Connected : 0s",
+		"Disconnected : 0s",
+	}, lines)
+
+	b := brokers[0]
+	b.recordConnection(ConnectHandler{IsConnected: true}, start)
+	b.recordConnection(ConnectHandler{IsConnected: false, Err: errors.New("connection lost")}, start.Add(time.Minute))
+	b.recordConnection(ConnectHandler{IsConnected: true}, start.Add(2*time.Minute))
+	b.recordConnection(ConnectHandler{IsConnected: false, Err: errors.New("a very long reason that does not fit")}, start.Add(3*time.Minute))
+
+	lines = nil
+	drawConnection(f, b, 0, 0, 60, start.Add(4*time.Minute))
+	assert.Equal(t, []string{
+		"  Reconnects : 1",
+		"   Connected : 2m0s (50.0%)",
+		"Disconnected : 2m0s (50.0%)",
+		"      Outage : Feb 03, 2018 10:03:00, down 1m0s: a very long",
+		"      Outage : Feb 03, 2018 10:01:00 for 1m0s: connection lo",
+	}, lines)
+}
@@ -2,6 +2,7 @@ package viewstats
 
 import (
 	"fmt"
+	"math"
 	"strconv"
 	"time"
 
@@ -10,96 +11,247 @@ import (
 
 type termWriter func(x, y int, str string)
 
+// setCell draws a cell, the lines from bodyTop on are scrolled and those
+// scrolled above bodyTop are not drawn
+func setCell(x, y int, c rune, fg termbox.Attribute) {
+	if y >= bodyTop {
+		y -= scroll
+		if y < bodyTop {
+			return
+		}
+	}
+	termbox.SetCell(x, y, c, fg, coldef)
+}
+
 func stdWriter(x, y int, str string) {
-	for i, c := range str {
-		termbox.SetCell(x+i, y, c, coldef, coldef)
+	for _, c := range str {
+		setCell(x, y, c, coldef)
+		x++
+	}
+}
+
+func reverseWriter(x, y int, str string) {
+	for _, c := range str {
+		setCell(x, y, c, coldef|termbox.AttrReverse)
+		x++
 	}
 }
 
 func underlineWriter(x, y int, str string) {
-	for i, c := range str {
-		termbox.SetCell(x+i, y, c, coldef+termbox.AttrUnderline, coldef)
+	for _, c := range str {
+		setCell(x, y, c, coldef+termbox.AttrUnderline)
+		x++
+	}
+}
+
+// colorWriter returns a writer drawing in a color
+func colorWriter(color termbox.Attribute) termWriter {
+	return func(x, y int, str string) {
+		for _, c := range str {
+			setCell(x, y, c, color)
+			x++
+		}
 	}
 }
 
 func redrawAll() {
 	termbox.Clear(coldef, coldef)
 	w, h = termbox.Size()
-	half := w / 2
+	shown := shownBrokers()
+	b := shown[selected]
 
-	curY := 0
-	drawHeader(stdWriter, 0, curY, conData)
+	// the header does not scroll
+	bodyTop = h
 
-	curY = 2
-	curY = drawBroker(0, curY)
-	curY++
-	curY = drawMessages(0, curY)
-
-	curY = 2
-	curY = drawLoad(half, curY)
-	curY++
-	curY = drawClient(half, curY)
+	// with more than one broker there is a line of tabs to pick one
+	top := 0
+	if len(shown) > 1 {
+		drawTabs(shown, 0, top)
+		top++
+	}
+	y := drawHeader(stdWriter, 0, top, b)
+	y = drawAlerts(b, 0, y)
+
+	// the panels are drawn in full and scrolled into view
+	bodyTop = y + 1
+	scrollBy(0)
+	contentBottom = drawLayout(b, bodyTop, w, math.MaxInt32)
+	scrollBy(0)
+	bodyTop = h
+
+	if contentBottom-scroll > h {
+		more := " more below, \u2193 or PgDn to scroll "
+		reverseWriter(w-len([]rune(more)), h-1, more)
+	}
+	if showHelp {
+		drawHelp(reverseWriter, w, h)
+	}
 
 	termbox.HideCursor()
 
 	termbox.Flush()
 }
 
-func drawBroker(x, y int) int {
+// drawTabs draws a tab for each broker, the one shown is highlighted
+func drawTabs(shown []*brokerStats, x, y int) int {
+	for i, b := range shown {
+		label := tabLabel(i, b)
+		if i == selected {
+			reverseWriter(x, y, label)
+		} else {
+			stdWriter(x, y, label)
+		}
+		x += len([]rune(label)) + 1
+	}
+	stdWriter(x, y, " [Tab] next broker")
+
+	return y + 1
+}
+
+func tabLabel(i int, b *brokerStats) string {
+	status := "disconnected"
+	if b.conData.IsConnected {
+		status = "connected"
+	}
+	return fmt.Sprintf(" %d %s: %s ", i+1, b.name, status)
+}
+
+func drawBroker(b *brokerStats, x, y int) int {
 	mid := 19
 	y = drawTitle(underlineWriter, x, y, mid+8, "Broker")
-	y = drawOne(stdWriter, x, y, mid, "Broker Version", mqttData.get("Broker Version"))
-	y = drawOne(stdWriter, x, y, mid, "Broker Time", mqttData.get("Broker Time"))
-	y = drawUptime(stdWriter, x, y, mid, "Broker Uptime", mqttData.get("Broker Uptime"))
-	y = drawOne(stdWriter, x, y, mid, "Subscriptions Count", mqttData.get("Subscriptions Count"))
-	y = drawOne(stdWriter, x, y, mid, "Total Bytes Sent", mqttData.get("Bytes Sent"))
-	y = drawOne(stdWriter, x, y, mid, "Total Bytes Received", mqttData.get("Bytes Received"))
+	y = drawOne(b.writerFor("Broker Version"), x, y, mid, "Broker Version", b.mqttData.get("Broker Version"))
+	y = drawOne(b.writerFor("Broker Time"), x, y, mid, "Broker Time", b.mqttData.get("Broker Time"))
+	y = drawUptime(b.writerFor("Broker Uptime"), x, y, mid, "Broker Uptime", b.mqttData.get("Broker Uptime"))
+	y = drawOne(b.writerFor("Subscriptions Count"), x, y, mid, "Subscriptions Count", b.mqttData.get("Subscriptions Count"))
+	y = drawOne(b.writerFor("Load Bytes Sent"), x, y, mid, "Total Bytes Sent", b.mqttData.get("Load Bytes Sent"))
+	y = drawOne(b.writerFor("Load Bytes Received"), x, y, mid, "Total Bytes Received", b.mqttData.get("Load Bytes Received"))
 
 	return y
 }
 
-func drawLoad(x, y int) int {
+func drawLoad(b *brokerStats, x, y int) int {
 	mid := 14
 	y = drawLoadTitle(underlineWriter, x, y, mid+2)
-	y = drawThree(stdWriter, x, y, mid, "Sockets", mqttData["LoadSockets1min"], mqttData["LoadSockets5min"], mqttData["LoadSockets15min"])
-	y = drawThree(stdWriter, x, y, mid, "Connections", mqttData["LoadConnections1min"], mqttData["LoadConnections5min"], mqttData["LoadConnections15min"])
-	y = drawThree(stdWriter, x, y, mid, "Msg Received", mqttData["LoadMessagesReceived1min"], mqttData["LoadMessagesReceived5min"], mqttData["LoadMessagesReceived15min"])
-	y = drawThree(stdWriter, x, y, mid, "Msg Sent", mqttData["LoadMessagesSent1min"], mqttData["LoadMessagesSent5min"], mqttData["LoadMessagesSent15min"])
+	y = drawThree(b.writerFor("LoadSockets1min"), x, y, mid, "Sockets", b.mqttData["LoadSockets1min"], b.mqttData["LoadSockets5min"], b.mqttData["LoadSockets15min"])
+	y = drawThree(b.writerFor("LoadConnections1min"), x, y, mid, "Connections", b.mqttData["LoadConnections1min"], b.mqttData["LoadConnections5min"], b.mqttData["LoadConnections15min"])
+	y = drawThree(b.writerFor("LoadMessagesReceived1min"), x, y, mid, "Msg Received", b.mqttData["LoadMessagesReceived1min"], b.mqttData["LoadMessagesReceived5min"], b.mqttData["LoadMessagesReceived15min"])
+	y = drawThree(b.writerFor("LoadMessagesSent1min"), x, y, mid, "Msg Sent", b.mqttData["LoadMessagesSent1min"], b.mqttData["LoadMessagesSent5min"], b.mqttData["LoadMessagesSent15min"])
 
-	y = drawThree(stdWriter, x, y, mid, "Bytes Received", mqttData["LoadBytesReceived1min"], mqttData["LoadBytesReceived5min"], mqttData["LoadBytesReceived15min"])
-	y = drawThree(stdWriter, x, y, mid, "Bytes Sent", mqttData["LoadBytesSent1min"], mqttData["LoadBytesSent5min"], mqttData["LoadBytesSent15min"])
+	y = drawThree(b.writerFor("LoadBytesReceived1min"), x, y, mid, "Bytes Received", b.mqttData["LoadBytesReceived1min"], b.mqttData["LoadBytesReceived5min"], b.mqttData["LoadBytesReceived15min"])
+	y = drawThree(b.writerFor("LoadBytesSent1min"), x, y, mid, "Bytes Sent", b.mqttData["LoadBytesSent1min"], b.mqttData["LoadBytesSent5min"], b.mqttData["LoadBytesSent15min"])
 
-	y = drawThree(stdWriter, x, y, mid, "Pub Received", mqttData["LoadPublishReceived1min"], mqttData["LoadPublishReceived5min"], mqttData["LoadPublishReceived15min"])
-	y = drawThree(stdWriter, x, y, mid, "Pub Sent", mqttData["LoadPublishSent1min"], mqttData["LoadPublishSent5min"], mqttData["LoadPublishSent15min"])
-	y = drawThree(stdWriter, x, y, mid, "Pub Dropped", mqttData["LoadPublishDropped1min"], mqttData["LoadPublishDropped5min"], mqttData["LoadPublishDropped15min"])
+	y = drawThree(b.writerFor("LoadPublishReceived1min"), x, y, mid, "Pub Received", b.mqttData["LoadPublishReceived1min"], b.mqttData["LoadPublishReceived5min"], b.mqttData["LoadPublishReceived15min"])
+	y = drawThree(b.writerFor("LoadPublishSent1min"), x, y, mid, "Pub Sent", b.mqttData["LoadPublishSent1min"], b.mqttData["LoadPublishSent5min"], b.mqttData["LoadPublishSent15min"])
+	y = drawThree(b.writerFor("LoadPublishDropped1min"), x, y, mid, "Pub Dropped", b.mqttData["LoadPublishDropped1min"], b.mqttData["LoadPublishDropped5min"], b.mqttData["LoadPublishDropped15min"])
 
 	return y
 }
 
-func drawMessages(x, y int) int {
+func drawMessages(b *brokerStats, x, y int) int {
 	mid := 18
 	y = drawTitle(underlineWriter, x, y, mid+8, "Message Stats")
-	y = drawOneFixedNum(stdWriter, x, y, mid, "Messages Received", mqttData.get("Messages Received"))
-	y = drawOneFixedNum(stdWriter, x, y, mid, "Messages Sent", mqttData.get("Messages Sent"))
-	y = drawOneFixedNum(stdWriter, x, y, mid, "Messages In-flight", mqttData.get("Messages Inflight"))
-	y = drawOneFixedNum(stdWriter, x, y, mid, "Messages Stored", mqttData.get("Messages Stored"))
+	y = drawOneFixedNum(b.writerFor("Messages Received"), x, y, mid, "Messages Received", b.mqttData.get("Messages Received"))
+	y = drawOneFixedNum(b.writerFor("Messages Sent"), x, y, mid, "Messages Sent", b.mqttData.get("Messages Sent"))
+	y = drawOneFixedNum(b.writerFor("Messages Inflight"), x, y, mid, "Messages In-flight", b.mqttData.get("Messages Inflight"))
+	y = drawOneFixedNum(b.writerFor("Messages Stored"), x, y, mid, "Messages Stored", b.mqttData.get("Messages Stored"))
 	y++
-	y = drawOneFixedNum(stdWriter, x, y, mid, "Messages Publish Dropped", mqttData.get("Messages Publish Dropped"))
-	y = drawOneFixedNum(stdWriter, x, y, mid, "Messages Publish Sent", mqttData.get("Messages Publish Sent"))
-	y = drawOneFixedNum(stdWriter, x, y, mid, "Messages Publish Received", mqttData.get("Messages Publish Received"))
-	y = drawOneFixedNum(stdWriter, x, y, mid, "Messages Retained Count", mqttData.get("Messages Retained Count"))
+	y = drawOneFixedNum(b.writerFor("Messages Publish Dropped"), x, y, mid, "Messages Publish Dropped", b.mqttData.get("Messages Publish Dropped"))
+	y = drawOneFixedNum(b.writerFor("Messages Publish Sent"), x, y, mid, "Messages Publish Sent", b.mqttData.get("Messages Publish Sent"))
+	y = drawOneFixedNum(b.writerFor("Messages Publish Received"), x, y, mid, "Messages Publish Received", b.mqttData.get("Messages Publish Received"))
+	y = drawOneFixedNum(b.writerFor("Messages Retained Count"), x, y, mid, "Messages Retained Count", b.mqttData.get("Messages Retained Count"))
 
 	return y
 }
 
-func drawClient(x, y int) int {
+func drawClient(b *brokerStats, x, y int) int {
 	mid := 20
 	y = drawTitle(underlineWriter, x, y, mid+8, "Clients")
-	y = drawOne(stdWriter, x, y, mid, "Clients Total", mqttData.get("Clients Total"))
-	y = drawOne(stdWriter, x, y, mid, "Clients Connected", mqttData.get("Clients Connected"))
-	y = drawOne(stdWriter, x, y, mid, "Clients Disconnected", mqttData.get("Clients Disconnected"))
-	y = drawOne(stdWriter, x, y, mid, "Clients Expired", mqttData.get("Clients Expired"))
-	y = drawOne(stdWriter, x, y, mid, "Clients Maximum", mqttData.get("Clients Maximum"))
+	y = drawOne(b.writerFor("Clients Total"), x, y, mid, "Clients Total", b.mqttData.get("Clients Total"))
+	y = drawOne(b.writerFor("Clients Connected"), x, y, mid, "Clients Connected", b.mqttData.get("Clients Connected"))
+	y = drawOne(b.writerFor("Clients Disconnected"), x, y, mid, "Clients Disconnected", b.mqttData.get("Clients Disconnected"))
+	y = drawOne(b.writerFor("Clients Expired"), x, y, mid, "Clients Expired", b.mqttData.get("Clients Expired"))
+	y = drawOne(b.writerFor("Clients Maximum"), x, y, mid, "Clients Maximum", b.mqttData.get("Clients Maximum"))
+
+	return y
+}
+
+// trend is a stat drawn with its history.  Counters that only go up are
+// drawn as a per second rate.
+type trend struct {
+	label string
+	key   string
+	rate  bool
+}
+
+var trends = []trend{
+	{"Msgs Received/s", "Messages Received", true},
+	{"Msgs Sent/s", "Messages Sent", true},
+	{"Bytes Received/s", "Load Bytes Received", true},
+	{"Bytes Sent/s", "Load Bytes Sent", true},
+	{"Clients Connected", "Clients Connected", false},
+	{"Subscriptions", "Subscriptions Count", false},
+}
+
+func drawTrends(b *brokerStats, x, y int, width int) int {
+	mid := 17
+	y = drawTitle(underlineWriter, x, y, mid+8, "Trends")
+	for _, t := range trends {
+		y = drawTrend(stdWriter, x, y, mid, width-x, t, b.histories[t.key])
+	}
+
+	return y
+}
+
+// drawTrend draws the latest value, a sparkline of the history and how
+// much the stat changed this session
+func drawTrend(w termWriter, x int, y int, mid int, width int, t trend, s *series) int {
+	current, values, delta := "n/a", []float64(nil), "n/a"
+	if s != nil {
+		prec := -1
+		values = s.values()
+		if t.rate {
+			values, prec = s.rates(), 1
+		}
+		if len(values) > 0 {
+			current = strconv.FormatFloat(values[len(values)-1], 'f', prec, 64)
+		}
+		delta = formatDelta(s.delta())
+	}
+
+	// label, value and delta take up the rest of the line
+	sparkWidth := width - mid - 24
+	if sparkWidth < 0 {
+		sparkWidth = 0
+	}
+	str := fmt.Sprintf("%*s : %s %-*s  %s", mid, t.label, fixedLenNum(current), sparkWidth, sparkline(values, sparkWidth), delta)
+	w(x, y, str)
+
+	return y + 1
+}
+
+// drawUnknown lists the $SYS topics the profile of the broker does not
+// map to a stat, as many as fit above maxY
+func drawUnknown(w termWriter, b *brokerStats, x, y int, width int, maxY int) int {
+	unknown := b.unknownTopics()
+	title := fmt.Sprintf("Unknown Metrics (profile %s)", b.profile.Name)
+	y = drawTitle(underlineWriter, x, y, len(title), title)
+	if len(unknown) == 0 {
+		w(x, y, "    none")
+		return y + 1
+	}
+
+	for i, topic := range unknown {
+		if y >= maxY-1 && i < len(unknown)-1 {
+			w(x, y, fmt.Sprintf("    ... and %d more", len(unknown)-i))
+			return y + 1
+		}
+		line := []rune(fmt.Sprintf("%s : %s", topic, b.raw[topic]))
+		if len(line) > width-x {
+			line = line[:width-x]
+		}
+		w(x, y, string(line))
+		y++
+	}
 
 	return y
 }
@@ -183,21 +335,22 @@ func drawUptime(w termWriter, x int, y int, mid int, label string, uptime string
 	return y + 1
 }
 
-func drawHeader(w termWriter, x, y int, conData ConnectHandler) int {
-	now := time.Now()
-	since := now.Sub(startTime)
+func drawHeader(w termWriter, x, y int, b *brokerStats) int {
+	conData := b.conData
+	now := displayTime()
+	since := now.Sub(b.startTime)
 	h := int(since.Hours())
 	m := int(since.Minutes()) % 60
 	s := int(since.Seconds()) % 60
 	if conData.IsConnected == true {
-		headerStr := fmt.Sprintf("Now:  %-24s  Connected for: %3d:%02d:%02d  [Q] to quit", now.Format(datePrint), h, m, s)
+		headerStr := fmt.Sprintf("Now:  %-24s  Connected for: %3d:%02d:%02d  %s", now.Format(datePrint), h, m, s, headerKeys())
 		w(x, y, headerStr)
 
 		y++
 		return y
 	}
 
-	headerStr := fmt.Sprintf("Now:  %-24s  Disconnected!!!  [Q] to quit", now.Format(datePrint), h, m, s)
+	headerStr := fmt.Sprintf("Now:  %-24s  Disconnected!!!  %s", now.Format(datePrint), headerKeys())
 	w(x, y, headerStr)
 	y++
 
@@ -208,3 +361,54 @@ func drawHeader(w termWriter, x, y int, conData ConnectHandler) int {
 	}
 	return y
 }
+
+func headerKeys() string {
+	if paused {
+		return "PAUSED [P] to resume  [?] help"
+	}
+	return "[Q] to quit  [?] help"
+}
+
+var helpLines = []string{
+	"Keys",
+	"",
+	"Tab, \u2192     next broker",
+	"\u2190           previous broker",
+	"1-9         show broker number",
+	"\u2191, \u2193        scroll a line",
+	"PgUp, PgDn  scroll a page",
+	"Home, End   scroll to the top or bottom",
+	"P           pause or resume updates",
+	"R           reset the connected timer",
+	"?           show this help",
+	"Q, Esc      quit",
+	"",
+	"Press any key to close the help",
+}
+
+// drawHelp draws the help in a box in the middle of the screen
+func drawHelp(w termWriter, width int, height int) {
+	boxWidth := 0
+	for _, line := range helpLines {
+		if n := len([]rune(line)); n > boxWidth {
+			boxWidth = n
+		}
+	}
+	boxWidth += 4
+
+	x := (width - boxWidth) / 2
+	y := (height - len(helpLines) - 2) / 2
+	if x < 0 {
+		x = 0
+	}
+	if y < 0 {
+		y = 0
+	}
+
+	blank := fmt.Sprintf("%*s", boxWidth, "")
+	w(x, y, blank)
+	for i, line := range helpLines {
+		w(x, y+i+1, fmt.Sprintf("  %-*s  ", boxWidth-4, line))
+	}
+	w(x, y+len(helpLines)+1, blank)
+}
@@ -0,0 +1,116 @@
+package viewstats
+
+import (
+	"strconv"
+	"time"
+)
+
+// historySize is how many samples are kept for each stat
+const historySize = 120
+
+var sparkChars = []rune("▁▂▃▄▅▆▇█")
+
+type sample struct {
+	at    time.Time
+	value float64
+}
+
+// series is the rolling history of one stat, oldest sample first
+type series struct {
+	samples []sample
+}
+
+func (s *series) add(at time.Time, value float64) {
+	s.samples = append(s.samples, sample{at, value})
+	if len(s.samples) > historySize {
+		s.samples = s.samples[len(s.samples)-historySize:]
+	}
+}
+
+func (s *series) values() []float64 {
+	values := make([]float64, len(s.samples))
+	for i, smp := range s.samples {
+		values[i] = smp.value
+	}
+	return values
+}
+
+// rates turns the samples of a counter into a per second rate between
+// each pair of samples.  A counter going down means the broker restarted
+// so that pair is skipped.
+func (s *series) rates() []float64 {
+	var rates []float64
+	for i := 1; i < len(s.samples); i++ {
+		prev, cur := s.samples[i-1], s.samples[i]
+		secs := cur.at.Sub(prev.at).Seconds()
+		if secs <= 0 || cur.value < prev.value {
+			continue
+		}
+		rates = append(rates, (cur.value-prev.value)/secs)
+	}
+	return rates
+}
+
+// delta is how much the stat changed since the first sample
+func (s *series) delta() float64 {
+	if len(s.samples) == 0 {
+		return 0
+	}
+	return s.samples[len(s.samples)-1].value - s.samples[0].value
+}
+
+// storeHistory keeps a series for every stat with a numeric value
+func (b *brokerStats) storeHistory(key string, value string, at time.Time) {
+	num, ok := Stat{Value: value}.Number()
+	if !ok {
+		return
+	}
+	s, ok := b.histories[key]
+	if !ok {
+		s = &series{}
+		b.histories[key] = s
+	}
+	s.add(at, num)
+}
+
+// sparkline draws the last width values scaled between their minimum
+// and maximum
+func sparkline(values []float64, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	if len(values) > width {
+		values = values[len(values)-width:]
+	}
+	if len(values) == 0 {
+		return ""
+	}
+
+	min, max := values[0], values[0]
+	for _, v := range values {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+
+	spark := make([]rune, len(values))
+	for i, v := range values {
+		level := 0
+		if max > min {
+			level = int((v - min) / (max - min) * float64(len(sparkChars)-1))
+		}
+		spark[i] = sparkChars[level]
+	}
+	return string(spark)
+}
+
+func formatDelta(delta float64) string {
+	str := strconv.FormatFloat(delta, 'f', -1, 64)
+	if delta >= 0 {
+		str = "+" + str
+	}
+	return str
+}
@@ -0,0 +1,64 @@
+package viewstats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeries(t *testing.T) {
+	start := time.Now()
+	s := &series{}
+	s.add(start, 100)
+	s.add(start.Add(10*time.Second), 150)
+	s.add(start.Add(20*time.Second), 350)
+	// the broker restarted
+	s.add(start.Add(30*time.Second), 20)
+	s.add(start.Add(40*time.Second), 40)
+
+	assert.Equal(t, []float64{100, 150, 350, 20, 40}, s.values())
+	assert.Equal(t, []float64{5, 20, 2}, s.rates())
+	assert.Equal(t, float64(-60), s.delta())
+
+	for i := 0; i < historySize; i++ {
+		s.add(start.Add(time.Duration(50+i)*time.Second), float64(i))
+	}
+	assert.Len(t, s.values(), historySize)
+	assert.Equal(t, float64(0), s.values()[0])
+}
+
+func TestSparkline(t *testing.T) {
+	assert.Equal(t, "", sparkline(nil, 10))
+	assert.Equal(t, "", sparkline([]float64{1, 2}, 0))
+	assert.Equal(t, "▁▁▁", sparkline([]float64{5, 5, 5}, 10))
+	assert.Equal(t, "▁▄█", sparkline([]float64{0, 50, 100}, 10))
+	// only the latest values fit
+	assert.Equal(t, "▁█", sparkline([]float64{100, 0, 100}, 2))
+}
+
+func TestFormatDelta(t *testing.T) {
+	assert.Equal(t, "+0", formatDelta(0))
+	assert.Equal(t, "+12", formatDelta(12))
+	assert.Equal(t, "-3.5", formatDelta(-3.5))
+}
+
+func TestDrawTrend(t *testing.T) {
+	var output string
+	f := func(x, y int, str string) { output = str }
+
+	start := time.Now()
+	s := &series{}
+	s.add(start, 100)
+	s.add(start.Add(10*time.Second), 200)
+	s.add(start.Add(20*time.Second), 250)
+
+	drawTrend(f, 0, 0, 12, 44, trend{"Msgs Sent/s", "Messages Sent", true}, s)
+	assert.Equal(t, " Msgs Sent/s :    5.0 █▁        +150", output)
+
+	drawTrend(f, 0, 0, 12, 44, trend{"Clients", "Clients Connected", false}, s)
+	assert.Equal(t, "     Clients :    250 ▁▅█       +150", output)
+
+	drawTrend(f, 0, 0, 12, 44, trend{"Clients", "Clients Connected", false}, nil)
+	assert.Equal(t, "     Clients :    n/a           n/a", output)
+}
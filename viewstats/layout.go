@@ -0,0 +1,265 @@
+package viewstats
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/nsf/termbox-go"
+)
+
+// Layout says which panels the dashboard shows and where
+type Layout struct {
+	Columns int
+	Panels  []Panel
+
+	// Colors holds thresholds for stats by name, a stat is drawn in the
+	// color of the highest threshold it has reached
+	Colors map[string][]Threshold
+}
+
+// Panel is either one of the built-in panels, given by Name, or a list of
+// stats under a Title
+type Panel struct {
+	Name   string   // broker, messages, load, clients, connection, trends or unknown
+	Title  string   // the title of a panel of stats
+	Stats  []string // the names of the stats, e.g. clients_connected
+	Column int      // starting at 1, 0 puts the panel below the columns using the whole width
+}
+
+// Threshold is the value from which a stat is drawn in Color
+type Threshold struct {
+	Value float64
+	Color string
+}
+
+type panelDrawer func(b *brokerStats, x, y int, width int, maxY int) int
+
+var builtinPanels = map[string]panelDrawer{
+	"broker":   func(b *brokerStats, x, y int, width int, maxY int) int { return drawBroker(b, x, y) },
+	"messages": func(b *brokerStats, x, y int, width int, maxY int) int { return drawMessages(b, x, y) },
+	"load":     func(b *brokerStats, x, y int, width int, maxY int) int { return drawLoad(b, x, y) },
+	"clients":  func(b *brokerStats, x, y int, width int, maxY int) int { return drawClient(b, x, y) },
+	"connection": func(b *brokerStats, x, y int, width int, maxY int) int {
+		return drawConnection(stdWriter, b, x, y, width, displayTime())
+	},
+	"trends": func(b *brokerStats, x, y int, width int, maxY int) int { return drawTrends(b, x, y, x+width) },
+	"unknown": func(b *brokerStats, x, y int, width int, maxY int) int {
+		return drawUnknown(stdWriter, b, x, y, x+width, maxY)
+	},
+}
+
+var colors = map[string]termbox.Attribute{
+	"black":   termbox.ColorBlack,
+	"red":     termbox.ColorRed,
+	"green":   termbox.ColorGreen,
+	"yellow":  termbox.ColorYellow,
+	"blue":    termbox.ColorBlue,
+	"magenta": termbox.ColorMagenta,
+	"cyan":    termbox.ColorCyan,
+	"white":   termbox.ColorWhite,
+}
+
+// DefaultLayout is the dashboard zap shows unless told otherwise
+var DefaultLayout = Layout{
+	Columns: 2,
+	Panels: []Panel{
+		{Name: "broker", Column: 1},
+		{Name: "messages", Column: 1},
+		{Name: "load", Column: 2},
+		{Name: "clients", Column: 2},
+		{Name: "connection", Column: 2},
+		{Name: "trends"},
+		{Name: "unknown"},
+	},
+}
+
+var layout = DefaultLayout
+
+// SetLayout checks a layout and uses it for the dashboard
+func SetLayout(l Layout) error {
+	if l.Columns < 1 {
+		return fmt.Errorf("stats layout must have at least 1 column")
+	}
+	for _, p := range l.Panels {
+		if p.Column < 0 || p.Column > l.Columns {
+			return fmt.Errorf("stats layout panel %s has column %d but there are %d columns", p.label(), p.Column, l.Columns)
+		}
+		if p.Name != "" {
+			if _, ok := builtinPanels[p.Name]; !ok {
+				return fmt.Errorf("stats layout has unknown panel %s, must be one of %s", p.Name, strings.Join(builtinPanelNames(), ", "))
+			}
+			continue
+		}
+		if len(p.Stats) == 0 {
+			return fmt.Errorf("stats layout panel %s needs a name or stats", p.label())
+		}
+		for _, name := range p.Stats {
+			if _, ok := statsByName[name]; !ok {
+				return fmt.Errorf("stats layout panel %s has unknown stat %s", p.label(), name)
+			}
+		}
+	}
+
+	sorted := make(map[string][]Threshold)
+	for name, thresholds := range l.Colors {
+		if _, ok := statsByName[name]; !ok {
+			return fmt.Errorf("stats layout has colors for unknown stat %s", name)
+		}
+		for _, t := range thresholds {
+			if _, ok := colors[t.Color]; !ok {
+				return fmt.Errorf("stats layout has unknown color %s for %s", t.Color, name)
+			}
+		}
+		thresholds = append([]Threshold{}, thresholds...)
+		sort.Slice(thresholds, func(i, j int) bool { return thresholds[i].Value < thresholds[j].Value })
+		sorted[name] = thresholds
+	}
+	l.Colors = sorted
+
+	layout = l
+	return nil
+}
+
+func builtinPanelNames() []string {
+	var names []string
+	for name := range builtinPanels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (p Panel) label() string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return fmt.Sprintf("%q", p.Title)
+}
+
+// minColumnWidth is the narrowest a column gets before the columns are
+// stacked on top of each other
+const minColumnWidth = 40
+
+// drawLayout draws the panels of the layout starting at line y, it returns
+// the line after the last panel
+func drawLayout(b *brokerStats, y int, width int, maxY int) int {
+	if width/layout.Columns < minColumnWidth {
+		return drawStacked(b, y, width, maxY)
+	}
+
+	colWidth := width / layout.Columns
+	colY := make([]int, layout.Columns)
+	for i := range colY {
+		colY[i] = y
+	}
+
+	bottom := y
+	for _, p := range layout.Panels {
+		if p.Column == 0 {
+			continue
+		}
+		c := p.Column - 1
+		colY[c] = p.draw(b, c*colWidth, colY[c], colWidth, maxY) + 1
+		if colY[c] > bottom {
+			bottom = colY[c]
+		}
+	}
+
+	for _, p := range layout.Panels {
+		if p.Column == 0 {
+			bottom = p.draw(b, 0, bottom, width, maxY) + 1
+		}
+	}
+
+	return bottom
+}
+
+// drawStacked draws the panels of each column in turn, using the whole
+// width, for terminals too narrow for the columns
+func drawStacked(b *brokerStats, y int, width int, maxY int) int {
+	for column := 1; column <= layout.Columns; column++ {
+		for _, p := range layout.Panels {
+			if p.Column == column {
+				y = p.draw(b, 0, y, width, maxY) + 1
+			}
+		}
+	}
+	for _, p := range layout.Panels {
+		if p.Column == 0 {
+			y = p.draw(b, 0, y, width, maxY) + 1
+		}
+	}
+	return y
+}
+
+func (p Panel) draw(b *brokerStats, x, y int, width int, maxY int) int {
+	if p.Name != "" {
+		return builtinPanels[p.Name](b, x, y, width, maxY)
+	}
+	return drawStatsPanel(b.writerFor, b, x, y, p)
+}
+
+// drawStatsPanel draws a panel of stats from the layout, writerFor picks
+// the writer for each stat so it can be colored
+func drawStatsPanel(writerFor func(key string) termWriter, b *brokerStats, x, y int, p Panel) int {
+	mid := 0
+	for _, name := range p.Stats {
+		if l := len(statsByName[name].label()); l > mid {
+			mid = l
+		}
+	}
+
+	y = drawTitle(underlineWriter, x, y, mid+8, p.Title)
+	for _, name := range p.Stats {
+		def := statsByName[name]
+		w := writerFor(def.key)
+		if def.name == "uptime_seconds" {
+			y = drawUptime(w, x, y, mid, def.label(), b.mqttData.get(def.key))
+		} else {
+			y = drawOne(w, x, y, mid, def.label(), b.mqttData.get(def.key))
+		}
+	}
+
+	return y
+}
+
+// label is how a stat is named in a panel of stats
+func (def *statDef) label() string {
+	if strings.Contains(def.key, " ") {
+		return def.key
+	}
+	// the load keys are run together, e.g. LoadSockets1min
+	return strings.Title(strings.Replace(def.name, "_", " ", -1))
+}
+
+// writerFor returns the writer for a stat, red if an alert on it fires or
+// colored if it reached one of its thresholds
+func (b *brokerStats) writerFor(key string) termWriter {
+	if b.alerting(key) {
+		return alertWriter
+	}
+	if color, ok := thresholdColor(key, b.mqttData.get(key)); ok {
+		return colorWriter(color)
+	}
+	return stdWriter
+}
+
+func thresholdColor(key string, value string) (termbox.Attribute, bool) {
+	def, ok := statsByKey[key]
+	if !ok {
+		return coldef, false
+	}
+	num, ok := Stat{Value: value}.Number()
+	if !ok {
+		return coldef, false
+	}
+
+	color, found := coldef, false
+	for _, t := range layout.Colors[def.name] {
+		if num >= t.Value {
+			color, found = colors[t.Color], true
+		}
+	}
+	return color, found
+}
@@ -0,0 +1,90 @@
+package viewstats
+
+import (
+	"testing"
+
+	"github.com/nsf/termbox-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetLayout(t *testing.T) {
+	defer func() { layout = DefaultLayout }()
+
+	table := []struct {
+		layout Layout
+		err    string
+	}{
+		{Layout{}, "stats layout must have at least 1 column"},
+		{Layout{Columns: 1, Panels: []Panel{{Name: "broker", Column: 2}}}, "stats layout panel broker has column 2 but there are 1 columns"},
+		{Layout{Columns: 1, Panels: []Panel{{Name: "nope"}}}, "stats layout has unknown panel nope, must be one of broker, clients, connection, load, messages, trends, unknown"},
+		{Layout{Columns: 1, Panels: []Panel{{Title: "Mine"}}}, `stats layout panel "Mine" needs a name or stats`},
+		{Layout{Columns: 1, Panels: []Panel{{Title: "Mine", Stats: []string{"nope"}}}}, `stats layout panel "Mine" has unknown stat nope`},
+		{Layout{Columns: 1, Colors: map[string][]Threshold{"nope": {{1, "red"}}}}, "stats layout has colors for unknown stat nope"},
+		{Layout{Columns: 1, Colors: map[string][]Threshold{"clients_connected": {{1, "pink"}}}}, "stats layout has unknown color pink for clients_connected"},
+	}
+	for _, test := range table {
+		assert.EqualError(t, SetLayout(test.layout), test.err)
+	}
+	assert.Equal(t, DefaultLayout, layout)
+
+	require.NoError(t, SetLayout(Layout{
+		Columns: 1,
+		Colors:  map[string][]Threshold{"clients_connected": {{1000, "red"}, {500, "yellow"}}},
+	}))
+	assert.Equal(t, []Threshold{{500, "yellow"}, {1000, "red"}}, layout.Colors["clients_connected"])
+}
+
+func TestThresholdColor(t *testing.T) {
+	defer func() { layout = DefaultLayout }()
+	require.NoError(t, SetLayout(Layout{
+		Columns: 1,
+		Colors: map[string][]Threshold{
+			"clients_connected": {{500, "yellow"}, {1000, "red"}},
+			"uptime_seconds":    {{60, "green"}},
+		},
+	}))
+
+	table := []struct {
+		key   string
+		value string
+		color termbox.Attribute
+		found bool
+	}{
+		{"Clients Connected", "10", coldef, false},
+		{"Clients Connected", "500", termbox.ColorYellow, true},
+		{"Clients Connected", "2000", termbox.ColorRed, true},
+		{"Clients Connected", "n/a", coldef, false},
+		{"Broker Uptime", "61 seconds", termbox.ColorGreen, true},
+		{"Clients Total", "2000", coldef, false},
+		{"No Such Stat", "2000", coldef, false},
+	}
+	for _, test := range table {
+		color, found := thresholdColor(test.key, test.value)
+		assert.Equal(t, test.color, color, test.key+" "+test.value)
+		assert.Equal(t, test.found, found, test.key+" "+test.value)
+	}
+}
+
+func TestDrawStatsPanel(t *testing.T) {
+	var lines []string
+	var keys []string
+	writerFor := func(key string) termWriter {
+		keys = append(keys, key)
+		return func(x, y int, str string) { lines = append(lines, str) }
+	}
+
+	PrepViewer()
+	store("$SYS/broker/clients/connected", "5")
+	store("$SYS/broker/uptime", "90 seconds")
+
+	panel := Panel{Title: "Mine", Stats: []string{"clients_connected", "uptime_seconds", "load_sockets_1min"}}
+	y := drawStatsPanel(writerFor, brokers[0], 0, 3, panel)
+	assert.Equal(t, 7, y)
+	assert.Equal(t, []string{"Clients Connected", "Broker Uptime", "LoadSockets1min"}, keys)
+	assert.Equal(t, []string{
+		"Clients Connected : 5",
+		"    Broker Uptime : 1m30s",
+		"Load Sockets 1min : n/a",
+	}, lines)
+}
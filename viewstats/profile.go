@@ -0,0 +1,218 @@
+package viewstats
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/rayjohnson/zap/topicfilter"
+)
+
+// Profile maps the $SYS topics of one kind of broker to the stats zap
+// knows about.  Brokers lay out $SYS in very different ways.
+type Profile struct {
+	Name string
+
+	// The profile is picked when a message arrives on DetectTopic (a topic
+	// filter) with a payload matching DetectVersion, nil matches anything
+	DetectTopic   string
+	DetectVersion *regexp.Regexp
+
+	// Topics maps topic filters to the names of stats, e.g. clients_connected
+	Topics map[string]string
+
+	// the filters with wildcards, sorted so matching does not depend on
+	// map order
+	wildcards []string
+}
+
+// mosquittoProfile is the default, its topics are the ones in statDefs
+var mosquittoProfile = &Profile{
+	Name:        "mosquitto",
+	DetectTopic: "$SYS/broker/version",
+	Topics:      make(map[string]string),
+}
+
+var builtinProfiles = []*Profile{
+	{
+		Name:        "emqx",
+		DetectTopic: "$SYS/brokers/+/version",
+		Topics: map[string]string{
+			"$SYS/brokers/+/version":                          "version",
+			"$SYS/brokers/+/uptime":                           "uptime_seconds",
+			"$SYS/brokers/+/datetime":                         "time",
+			"$SYS/brokers/+/stats/connections/count":          "clients_connected",
+			"$SYS/brokers/+/stats/connections/max":            "clients_maximum",
+			"$SYS/brokers/+/stats/subscriptions/count":        "subscriptions_count",
+			"$SYS/brokers/+/stats/retained/count":             "retained_messages_count",
+			"$SYS/brokers/+/metrics/messages/received":        "messages_received",
+			"$SYS/brokers/+/metrics/messages/sent":            "messages_sent",
+			"$SYS/brokers/+/metrics/messages/dropped":         "publish_messages_dropped",
+			"$SYS/brokers/+/metrics/packets/publish/received": "messages_publish_received",
+			"$SYS/brokers/+/metrics/packets/publish/sent":     "messages_publish_sent",
+			"$SYS/brokers/+/metrics/bytes/received":           "bytes_received",
+			"$SYS/brokers/+/metrics/bytes/sent":               "bytes_sent",
+		},
+	},
+	{
+		Name:          "hivemq",
+		DetectTopic:   "$SYS/broker/version",
+		DetectVersion: regexp.MustCompile(`(?i)hivemq`),
+		Topics: map[string]string{
+			"$SYS/broker/version":                   "version",
+			"$SYS/broker/uptime":                    "uptime_seconds",
+			"$SYS/broker/time":                      "time",
+			"$SYS/broker/clients/connected":         "clients_connected",
+			"$SYS/broker/clients/disconnected":      "clients_disconnected",
+			"$SYS/broker/clients/maximum":           "clients_maximum",
+			"$SYS/broker/clients/total":             "clients_total",
+			"$SYS/broker/messages/received":         "messages_received",
+			"$SYS/broker/messages/sent":             "messages_sent",
+			"$SYS/broker/messages/publish/received": "messages_publish_received",
+			"$SYS/broker/messages/publish/sent":     "messages_publish_sent",
+			"$SYS/broker/messages/retained/count":   "retained_messages_count",
+			"$SYS/broker/subscriptions/count":       "subscriptions_count",
+			"$SYS/broker/bytes/received":            "bytes_received",
+			"$SYS/broker/bytes/sent":                "bytes_sent",
+		},
+	},
+	{
+		// VerneMQ has no version topic, its metrics are per node
+		Name:        "vernemq",
+		DetectTopic: "$SYS/+/mqtt_publish_received",
+		Topics: map[string]string{
+			"$SYS/+/mqtt_publish_received": "messages_publish_received",
+			"$SYS/+/mqtt_publish_sent":     "messages_publish_sent",
+			"$SYS/+/queue_message_drop":    "publish_messages_dropped",
+			"$SYS/+/router_subscriptions":  "subscriptions_count",
+			"$SYS/+/retain_messages":       "retained_messages_count",
+			"$SYS/+/bytes_received":        "bytes_received",
+			"$SYS/+/bytes_sent":            "bytes_sent",
+		},
+	},
+	mosquittoProfile,
+}
+
+// profiles are tried in order when detecting, user profiles come first
+// and mosquitto, which matches any $SYS/broker/version, comes last
+var profiles = builtinProfiles
+
+var statsByName = make(map[string]*statDef)
+var statsByKey = make(map[string]*statDef)
+
+func init() {
+	for i := range statDefs {
+		statsByName[statDefs[i].name] = &statDefs[i]
+		statsByKey[statDefs[i].key] = &statDefs[i]
+		for _, topic := range statDefs[i].topics {
+			mosquittoProfile.Topics[topic] = statDefs[i].name
+		}
+	}
+	for _, p := range builtinProfiles {
+		p.prepare()
+	}
+}
+
+// AddProfile adds a user defined profile, it replaces a built-in profile
+// with the same name.  It must be called before PrepViewer.
+func AddProfile(p Profile) error {
+	for filter, name := range p.Topics {
+		if _, ok := statsByName[name]; !ok {
+			return fmt.Errorf("stats profile %s maps %s to unknown stat %s", p.Name, filter, name)
+		}
+	}
+	p.prepare()
+
+	newProfiles := []*Profile{&p}
+	for _, old := range profiles {
+		if old.Name != p.Name {
+			newProfiles = append(newProfiles, old)
+		}
+	}
+	profiles = newProfiles
+	return nil
+}
+
+// SetProfile stops auto detection for a broker and uses the named profile
+func SetProfile(broker int, name string) error {
+	p := findProfile(name)
+	if p == nil {
+		return fmt.Errorf("unknown stats profile %s, must be one of %s", name, strings.Join(ProfileNames(), ", "))
+	}
+
+	mqttDataLock.Lock()
+	defer mqttDataLock.Unlock()
+	b := brokers[broker]
+	b.forced = true
+	b.setProfile(p)
+	return nil
+}
+
+// ProfileNames returns the names of all the profiles
+func ProfileNames() []string {
+	var names []string
+	for _, p := range profiles {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+func findProfile(name string) *Profile {
+	for _, p := range profiles {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// detectProfile returns the profile a message identifies, if any
+func detectProfile(topic string, value string) *Profile {
+	for _, p := range profiles {
+		if p.DetectTopic == "" || !topicfilter.Match(p.DetectTopic, topic) {
+			continue
+		}
+		if p.DetectVersion == nil || p.DetectVersion.MatchString(value) {
+			return p
+		}
+	}
+	return nil
+}
+
+func (p *Profile) prepare() {
+	p.wildcards = nil
+	for filter := range p.Topics {
+		if strings.ContainsAny(filter, "+#") {
+			p.wildcards = append(p.wildcards, filter)
+		}
+	}
+	sort.Strings(p.wildcards)
+}
+
+// statFor returns the stat a topic is mapped to, or nil
+func (p *Profile) statFor(topic string) *statDef {
+	name, ok := p.Topics[topic]
+	if !ok {
+		for _, filter := range p.wildcards {
+			if topicfilter.Match(filter, topic) {
+				name, ok = p.Topics[filter], true
+				break
+			}
+		}
+	}
+	if !ok {
+		return nil
+	}
+	return statsByName[name]
+}
+
+// hasStat is true if the profile maps some topic to the stat
+func (p *Profile) hasStat(name string) bool {
+	for _, mapped := range p.Topics {
+		if mapped == name {
+			return true
+		}
+	}
+	return false
+}
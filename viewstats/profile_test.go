@@ -0,0 +1,125 @@
+package viewstats
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func store(topic string, value string) {
+	storeStat(statMsg{0, topic, value})
+}
+
+func TestDetectProfile(t *testing.T) {
+	PrepViewer()
+	assert.Equal(t, "mosquitto", ProfileName(0))
+
+	// topics that arrive before the broker is known are mapped later
+	store("$SYS/brokers/emqx@host/stats/connections/count", "5")
+	assert.Equal(t, "n/a", GetStat(0, "Clients Connected"))
+	store("$SYS/brokers/emqx@host/version", "4.2.3")
+	assert.Equal(t, "emqx", ProfileName(0))
+	assert.Equal(t, "5", GetStat(0, "Clients Connected"))
+	assert.Equal(t, "4.2.3", GetStat(0, "Broker Version"))
+
+	PrepViewer()
+	store("$SYS/broker/version", "HiveMQ 4.0.1")
+	assert.Equal(t, "hivemq", ProfileName(0))
+	store("$SYS/broker/bytes/received", "1024")
+	assert.Equal(t, "1024", GetStat(0, "Load Bytes Received"))
+
+	PrepViewer()
+	store("$SYS/broker/version", "mosquitto version 1.4.14")
+	assert.Equal(t, "mosquitto", ProfileName(0))
+
+	PrepViewer()
+	store("$SYS/VerneMQ@127.0.0.1/mqtt_publish_received", "12")
+	assert.Equal(t, "vernemq", ProfileName(0))
+	assert.Equal(t, "12", GetStat(0, "Messages Publish Received"))
+	assert.Equal(t, []Stat{{"$SYS/VerneMQ@127.0.0.1/mqtt_publish_received", "Messages Publish Received", "messages_publish_received", "12"}}, Snapshot(0))
+}
+
+func TestSetProfile(t *testing.T) {
+	PrepViewer("one", "two")
+	require.NoError(t, SetProfile(1, "mosquitto"))
+	assert.EqualError(t, SetProfile(0, "nope"), "unknown stats profile nope, must be one of emqx, hivemq, vernemq, mosquitto")
+
+	// a forced profile is not replaced by detection
+	storeStat(statMsg{1, "$SYS/brokers/emqx@host/version", "4.2.3"})
+	storeStat(statMsg{0, "$SYS/brokers/emqx@host/version", "4.2.3"})
+	assert.Equal(t, "mosquitto", ProfileName(1))
+	assert.Equal(t, "emqx", ProfileName(0))
+}
+
+func TestAddProfile(t *testing.T) {
+	defer func() { profiles = builtinProfiles }()
+
+	err := AddProfile(Profile{Name: "bad", Topics: map[string]string{"$SYS/x": "nope"}})
+	assert.EqualError(t, err, "stats profile bad maps $SYS/x to unknown stat nope")
+
+	require.NoError(t, AddProfile(Profile{
+		Name:          "acme",
+		DetectTopic:   "$SYS/broker/version",
+		DetectVersion: regexp.MustCompile("^acme"),
+		Topics: map[string]string{
+			"$SYS/acme/+/clients": "clients_connected",
+			"$SYS/acme/uptime":    "uptime_seconds",
+		},
+	}))
+	assert.Equal(t, []string{"acme", "emqx", "hivemq", "vernemq", "mosquitto"}, ProfileNames())
+
+	PrepViewer()
+	store("$SYS/broker/version", "acme 2.0")
+	store("$SYS/acme/node1/clients", "7")
+	store("$SYS/acme/uptime", "100 seconds")
+	assert.Equal(t, "acme", ProfileName(0))
+	assert.Equal(t, "7", GetStat(0, "Clients Connected"))
+
+	// the profile has all its stats even though the version is not one
+	assert.True(t, HaveAllStats())
+	assert.Equal(t, []string{"$SYS/broker/version"}, brokers[0].unknownTopics())
+}
+
+func TestHaveAllStats(t *testing.T) {
+	PrepViewer()
+	assert.False(t, HaveAllStats())
+	for _, def := range statDefs {
+		store(def.topics[0], "1")
+	}
+	assert.True(t, HaveAllStats())
+}
+
+func TestDrawUnknown(t *testing.T) {
+	var lines []string
+	f := func(x, y int, str string) { lines = append(lines, str) }
+
+	PrepViewer()
+	drawUnknown(f, brokers[0], 0, 0, 40, 10)
+	assert.Equal(t, []string{"    none"}, lines)
+
+	store("$SYS/broker/clients/connected", "1")
+	store("$SYS/broker/bridge/status", "up")
+	store("$SYS/broker/a/very/long/topic/name/for/testing", "clipped")
+	store("$SYS/broker/c", "3")
+	store("$SYS/broker/d", "4")
+
+	lines = nil
+	drawUnknown(f, brokers[0], 0, 0, 40, 10)
+	assert.Equal(t, []string{
+		"$SYS/broker/a/very/long/topic/name/for/t",
+		"$SYS/broker/bridge/status : up",
+		"$SYS/broker/c : 3",
+		"$SYS/broker/d : 4",
+	}, lines)
+
+	// only what fits is drawn
+	lines = nil
+	drawUnknown(f, brokers[0], 0, 0, 40, 4)
+	assert.Equal(t, []string{
+		"$SYS/broker/a/very/long/topic/name/for/t",
+		"$SYS/broker/bridge/status : up",
+		"    ... and 2 more",
+	}, lines)
+}
@@ -22,6 +22,10 @@ package viewstats
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/nsf/termbox-go"
@@ -31,16 +35,29 @@ const coldef = termbox.ColorDefault
 const datePrint = "Jan 02, 2006 15:04:05"
 
 // ConnectHandler is used in a channel to tell us if
-// out connection to MQTT has disconnected or reconnected
+// out connection to MQTT has disconnected or reconnected.  Broker is
+// the index of the broker in the names passed to PrepViewer.
 type ConnectHandler struct {
 	IsConnected bool
 	Err         error
+	Broker      int
 }
 
 type dataHash map[string]string
 
-var conData ConnectHandler
-var mqInbound = make(chan [2]string, 16)
+// statMsg is a $SYS message on its way from AddBrokerStat to the stored
+// data
+type statMsg struct {
+	broker int
+	topic  string
+	value  string
+}
+
+var mqInbound = make(chan statMsg, 16)
+
+// stopped is closed once nothing reads mqInbound any more, so messages
+// arriving late do not block the MQTT client
+var stopped = make(chan struct{})
 
 func (d dataHash) get(key string) (result string) {
 	if v, ok := d[key]; ok {
@@ -50,18 +67,87 @@ func (d dataHash) get(key string) (result string) {
 	return "n/a"
 }
 
-var mqttData dataHash
+// brokerStats is everything collected from one broker
+type brokerStats struct {
+	name      string
+	mqttData  dataHash
+	histories map[string]*series
+	conData   ConnectHandler
+	startTime time.Time
+	history   connHistory
+
+	// profile maps the raw $SYS topics to mqttData, unless forced it can
+	// change when the broker is detected
+	profile *Profile
+	forced  bool
+	raw     map[string]string
+	topics  map[string]string // the topic each key of mqttData came from
+}
+
+var brokers []*brokerStats
+
+// mqttDataLock guards writes to the brokers data and reads from outside
+// the goroutine that stores the stats
+var mqttDataLock sync.RWMutex
 
 var (
-	startTime time.Time
+	// selected is the broker shown in the UI
+	selected int
 
 	w, h int
+
+	// the panels below the header scroll by scroll lines, bodyTop is the
+	// first line of the screen they are on and contentBottom is the line
+	// after the last panel
+	scroll        int
+	bodyTop       int
+	contentBottom int
+
+	paused   bool
+	showHelp bool
+
+	// while paused the UI draws the brokers as they were when it was
+	// paused, at the time it was paused
+	frozen   []*brokerStats
+	frozenAt time.Time
 )
 
-// PrepViewer is called to make sure our hash table exists before AddStat
-func PrepViewer() {
-	mqttData = make(dataHash)
-	startTime = time.Now()
+// PrepViewer is called to make sure our hash tables exist before AddStat.
+// It takes the names of the brokers stats are collected from, with no
+// names there is a single unnamed broker.
+func PrepViewer(names ...string) {
+	mqttDataLock.Lock()
+	defer mqttDataLock.Unlock()
+
+	if len(names) == 0 {
+		names = []string{""}
+	}
+	brokers = nil
+	for _, name := range names {
+		brokers = append(brokers, &brokerStats{
+			name:      name,
+			mqttData:  make(dataHash),
+			histories: make(map[string]*series),
+			startTime: time.Now(),
+			profile:   mosquittoProfile,
+			raw:       make(map[string]string),
+			topics:    make(map[string]string),
+		})
+	}
+	select {
+	case <-stopped:
+		stopped = make(chan struct{})
+		// what came in after the last collection stopped is stale
+		for len(mqInbound) > 0 {
+			<-mqInbound
+		}
+	default:
+	}
+	selected = 0
+	scroll = 0
+	paused = false
+	frozen = nil
+	showHelp = false
 }
 
 // StartStatsDisplay sets up the terminal UI to display
@@ -76,9 +162,7 @@ func StartStatsDisplay(connectionChan chan ConnectHandler) {
 	redrawAll()
 
 	//capture and process events from the CLI
-	quit := make(chan bool)
 	eventChan := make(chan termbox.Event, 16)
-	go handleEvents(eventChan, quit)
 	go func() {
 		for {
 			ev := termbox.PollEvent()
@@ -91,170 +175,385 @@ func StartStatsDisplay(connectionChan chan ConnectHandler) {
 loop:
 	for {
 		select {
-		case <-quit:
-			termbox.Close()
-			break loop
-		case <-timer:
+		case ev := <-eventChan:
+			if handleEvent(ev) {
+				termbox.Close()
+				break loop
+			}
 			redrawAll()
+		case <-timer:
+			if !paused {
+				redrawAll()
+			}
 		case inMsg := <-mqInbound:
-			mqttData[inMsg[0]] = inMsg[1]
+			storeStat(inMsg)
 		case connHandler := <-connectionChan:
-			conData = connHandler
-			if conData.IsConnected {
-				startTime = time.Now()
-			}
+			storeConnection(connHandler)
 		}
 	}
 
+	stopCollecting()
 	fmt.Println("all done")
 }
 
+// CollectStats stores the stats passed to AddStat without displaying
+// them until done is closed.  It is used when there is no terminal.
+func CollectStats(connectionChan chan ConnectHandler, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			stopCollecting()
+			return
+		case inMsg := <-mqInbound:
+			storeStat(inMsg)
+		case connHandler := <-connectionChan:
+			storeConnection(connHandler)
+		}
+	}
+}
+
+// GetStat returns the latest value of a stat of a broker, or n/a if there
+// is none
+func GetStat(broker int, key string) string {
+	mqttDataLock.RLock()
+	defer mqttDataLock.RUnlock()
+	return brokers[broker].mqttData.get(key)
+}
+
+// IsConnected is true while the connection to the broker is up
+func IsConnected(broker int) bool {
+	mqttDataLock.RLock()
+	defer mqttDataLock.RUnlock()
+	return brokers[broker].conData.IsConnected
+}
+
+// Stat is one statistic collected from the broker
+type Stat struct {
+	Topic string // the $SYS topic it came from
+	Key   string // the name shown in the UI
+	Name  string // a name for json and prometheus output
+	Value string
+}
+
+// Number returns the value as a number if it is one.  The uptime is
+// sent as "N seconds" so the unit is dropped.
+func (s Stat) Number() (float64, bool) {
+	value := strings.TrimSuffix(s.Value, " seconds")
+	num, err := strconv.ParseFloat(value, 64)
+	return num, err == nil
+}
+
+// Snapshot returns the stats collected so far from a broker, in the order
+// of statDefs
+func Snapshot(broker int) []Stat {
+	mqttDataLock.RLock()
+	defer mqttDataLock.RUnlock()
+
+	var stats []Stat
+	for _, def := range statDefs {
+		if value, ok := brokers[broker].mqttData[def.key]; ok {
+			stats = append(stats, Stat{Topic: brokers[broker].topics[def.key], Key: def.key, Name: def.name, Value: value})
+		}
+	}
+	return stats
+}
+
+// StatNames returns the names of all the stats zap knows about, in the
+// order of statDefs
+func StatNames() []string {
+	var names []string
+	for _, def := range statDefs {
+		names = append(names, def.name)
+	}
+	return names
+}
+
+// HaveAllStats is true once every stat the profile of each broker knows
+// about has arrived
+func HaveAllStats() bool {
+	mqttDataLock.RLock()
+	defer mqttDataLock.RUnlock()
+
+	for _, b := range brokers {
+		for _, def := range statDefs {
+			if _, ok := b.mqttData[def.key]; !ok && b.profile.hasStat(def.name) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ProfileName returns the name of the profile in use for a broker
+func ProfileName(broker int) string {
+	mqttDataLock.RLock()
+	defer mqttDataLock.RUnlock()
+	return brokers[broker].profile.Name
+}
+
+func storeStat(inMsg statMsg) {
+	mqttDataLock.Lock()
+	defer mqttDataLock.Unlock()
+	b := brokers[inMsg.broker]
+	b.raw[inMsg.topic] = inMsg.value
+	if !b.forced {
+		if p := detectProfile(inMsg.topic, inMsg.value); p != nil && p != b.profile {
+			b.setProfile(p)
+		}
+	}
+	if def := b.profile.statFor(inMsg.topic); def != nil {
+		b.mqttData[def.key] = inMsg.value
+		b.topics[def.key] = inMsg.topic
+		b.storeHistory(def.key, inMsg.value, time.Now())
+	}
+}
+
+// setProfile maps all the topics seen so far with a new profile, the
+// history of the old one does not mean the same thing so it is dropped
+func (b *brokerStats) setProfile(p *Profile) {
+	b.profile = p
+	b.mqttData = make(dataHash)
+	b.topics = make(map[string]string)
+	b.histories = make(map[string]*series)
+	for topic, value := range b.raw {
+		if def := p.statFor(topic); def != nil {
+			b.mqttData[def.key] = value
+			b.topics[def.key] = topic
+		}
+	}
+}
+
+// unknownTopics returns the topics the profile does not map, sorted
+func (b *brokerStats) unknownTopics() []string {
+	var unknown []string
+	for topic := range b.raw {
+		if b.profile.statFor(topic) == nil {
+			unknown = append(unknown, topic)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+func storeConnection(connHandler ConnectHandler) {
+	mqttDataLock.Lock()
+	defer mqttDataLock.Unlock()
+	brokers[connHandler.Broker].recordConnection(connHandler, time.Now())
+}
+
+// statDef is a stat zap knows about.  The topics are those of mosquitto,
+// other brokers are handled by profiles.  Not all versions of mosquitto
+// agree on every topic name so some stats have more than one.
+type statDef struct {
+	topics []string
+	key    string // the name used by the UI
+	name   string // the name used for json, prometheus and profiles
+}
+
+var statDefs = []statDef{
+	{[]string{"$SYS/broker/load/bytes/received"}, "Load Bytes Received", "bytes_received"},
+	{[]string{"$SYS/broker/load/bytes/sent"}, "Load Bytes Sent", "bytes_sent"},
+	{[]string{"$SYS/broker/subscriptions/count"}, "Subscriptions Count", "subscriptions_count"},
+	{[]string{"$SYS/broker/time"}, "Broker Time", "time"},
+	{[]string{"$SYS/broker/uptime"}, "Broker Uptime", "uptime_seconds"},
+	{[]string{"$SYS/broker/version"}, "Broker Version", "version"},
+	{[]string{"$SYS/broker/clients/total"}, "Clients Total", "clients_total"},
+	{[]string{"$SYS/broker/clients/connected"}, "Clients Connected", "clients_connected"},
+	{[]string{"$SYS/broker/clients/disconnected"}, "Clients Disconnected", "clients_disconnected"},
+	{[]string{"$SYS/broker/clients/maximum"}, "Clients Maximum", "clients_maximum"},
+	{[]string{"$SYS/broker/clients/expired"}, "Clients Expired", "clients_expired"},
+	{[]string{"$SYS/broker/heap/current size"}, "Heap Current Size", "heap_current_size"},
+	{[]string{"$SYS/broker/heap/maximum size"}, "Heap Maximum Size", "heap_maximum_size"},
+	{[]string{"$SYS/broker/messages/received"}, "Messages Received", "messages_received"},
+	{[]string{"$SYS/broker/messages/sent"}, "Messages Sent", "messages_sent"},
+	{[]string{"$SYS/broker/messages/inflight"}, "Messages Inflight", "messages_inflight"},
+	{[]string{"$SYS/broker/messages/stored"}, "Messages Stored", "messages_stored"},
+	{[]string{"$SYS/broker/publish/messages/dropped"}, "Messages Publish Dropped", "publish_messages_dropped"},
+	{[]string{"$SYS/broker/messages/publish/sent"}, "Messages Publish Sent", "messages_publish_sent"},
+	{[]string{"$SYS/broker/messages/publish/received"}, "Messages Publish Received", "messages_publish_received"},
+	{[]string{"$SYS/broker/messages/retained/count", "$SYS/broker/retained messages/count"}, "Messages Retained Count", "retained_messages_count"},
+	{[]string{"$SYS/broker/load/messages/received/1min"}, "LoadMessagesReceived1min", "load_messages_received_1min"},
+	{[]string{"$SYS/broker/load/messages/received/5min"}, "LoadMessagesReceived5min", "load_messages_received_5min"},
+	{[]string{"$SYS/broker/load/messages/received/15min"}, "LoadMessagesReceived15min", "load_messages_received_15min"},
+	{[]string{"$SYS/broker/load/messages/sent/1min"}, "LoadMessagesSent1min", "load_messages_sent_1min"},
+	{[]string{"$SYS/broker/load/messages/sent/5min"}, "LoadMessagesSent5min", "load_messages_sent_5min"},
+	{[]string{"$SYS/broker/load/messages/sent/15min"}, "LoadMessagesSent15min", "load_messages_sent_15min"},
+	{[]string{"$SYS/broker/load/bytes/sent/1min"}, "LoadBytesSent1min", "load_bytes_sent_1min"},
+	{[]string{"$SYS/broker/load/bytes/sent/5min"}, "LoadBytesSent5min", "load_bytes_sent_5min"},
+	{[]string{"$SYS/broker/load/bytes/sent/15min"}, "LoadBytesSent15min", "load_bytes_sent_15min"},
+	{[]string{"$SYS/broker/load/bytes/received/1min"}, "LoadBytesReceived1min", "load_bytes_received_1min"},
+	{[]string{"$SYS/broker/load/bytes/received/5min"}, "LoadBytesReceived5min", "load_bytes_received_5min"},
+	{[]string{"$SYS/broker/load/bytes/received/15min"}, "LoadBytesReceived15min", "load_bytes_received_15min"},
+	{[]string{"$SYS/broker/load/sockets/1min"}, "LoadSockets1min", "load_sockets_1min"},
+	{[]string{"$SYS/broker/load/sockets/5min"}, "LoadSockets5min", "load_sockets_5min"},
+	{[]string{"$SYS/broker/load/sockets/15min"}, "LoadSockets15min", "load_sockets_15min"},
+	{[]string{"$SYS/broker/load/connections/1min"}, "LoadConnections1min", "load_connections_1min"},
+	{[]string{"$SYS/broker/load/connections/5min"}, "LoadConnections5min", "load_connections_5min"},
+	{[]string{"$SYS/broker/load/connections/15min"}, "LoadConnections15min", "load_connections_15min"},
+	{[]string{"$SYS/broker/load/publish/received/1min"}, "LoadPublishReceived1min", "load_publish_received_1min"},
+	{[]string{"$SYS/broker/load/publish/received/5min"}, "LoadPublishReceived5min", "load_publish_received_5min"},
+	{[]string{"$SYS/broker/load/publish/received/15min"}, "LoadPublishReceived15min", "load_publish_received_15min"},
+	{[]string{"$SYS/broker/load/publish/sent/1min"}, "LoadPublishSent1min", "load_publish_sent_1min"},
+	{[]string{"$SYS/broker/load/publish/sent/5min"}, "LoadPublishSent5min", "load_publish_sent_5min"},
+	{[]string{"$SYS/broker/load/publish/sent/15min"}, "LoadPublishSent15min", "load_publish_sent_15min"},
+	{[]string{"$SYS/broker/load/publish/dropped/1min"}, "LoadPublishDropped1min", "load_publish_dropped_1min"},
+	{[]string{"$SYS/broker/load/publish/dropped/5min"}, "LoadPublishDropped5min", "load_publish_dropped_5min"},
+	{[]string{"$SYS/broker/load/publish/dropped/15min"}, "LoadPublishDropped15min", "load_publish_dropped_15min"},
+}
+
 // AddStat parses the MQTT topics and puts the latest
-// values in a hash that is displayed in the UI
+// values in a hash that is displayed in the UI.  The profile of the
+// broker decides which topics are which stats.
 func AddStat(topic string, data string) {
-	var key string
-	var msg [2]string
-
-	switch topic {
-	case "$SYS/broker/load/bytes/received":
-		key = "Load Bytes Received"
-	case "$SYS/broker/load/bytes/sent":
-		key = "Load Bytes Sent"
-	case "$SYS/broker/subscriptions/count":
-		key = "Subscriptions Count"
-	case "$SYS/broker/time":
-		key = "Broker Time"
-
-	case "$SYS/broker/uptime":
-		key = "Broker Uptime"
-	case "$SYS/broker/version":
-		key = "Broker Version"
-
-	case "$SYS/broker/clients/total":
-		key = "Clients Total"
-	case "$SYS/broker/clients/connected":
-		key = "Clients Connected"
-	case "$SYS/broker/clients/disconnected":
-		key = "Clients Disconnected"
-	case "$SYS/broker/clients/maximum":
-		key = "Clients Maximum"
-	case "$SYS/broker/clients/expired":
-		key = "Clients Expired"
-
-	case "$SYS/broker/heap/current size":
-		key = "Heap Current Size"
-	case "$SYS/broker/heap/maximum size":
-		key = "Heap Maximum Size"
-
-	case "$SYS/broker/messages/received":
-		key = "Messages Received"
-	case "$SYS/broker/messages/sent":
-		key = "Messages Sent"
-	case "$SYS/broker/messages/inflight":
-		key = "Messages Inflight"
-	case "$SYS/broker/messages/stored":
-		key = "Messages Stored"
-
-	case "$SYS/broker/publish/messages/dropped":
-		key = "Messages Publish Dropped"
-	case "$SYS/broker/messages/publish/sent":
-		key = "Messages Publish Sent"
-	case "$SYS/broker/messages/publish/received":
-		key = "Messages Publish Received"
-	case "$SYS/broker/messages/retained/count", "$SYS/broker/retained messages/count":
-		key = "Messages Retained Count"
-
-	case "$SYS/broker/load/messages/received/1min":
-		key = "LoadMessagesReceived1min"
-	case "$SYS/broker/load/messages/received/5min":
-		key = "LoadMessagesReceived5min"
-	case "$SYS/broker/load/messages/received/15min":
-		key = "LoadMessagesReceived15min"
-
-	case "$SYS/broker/load/messages/sent/1min":
-		key = "LoadMessagesSent1min"
-	case "$SYS/broker/load/messages/sent/5min":
-		key = "LoadMessagesSent5min"
-	case "$SYS/broker/load/messages/sent/15min":
-		key = "LoadMessagesSent15min"
-
-	case "$SYS/broker/load/bytes/sent/1min":
-		key = "LoadBytesSent1min"
-	case "$SYS/broker/load/bytes/sent/5min":
-		key = "LoadBytesSent5min"
-	case "$SYS/broker/load/bytes/sent/15min":
-		key = "LoadBytesSent15min"
-
-	case "$SYS/broker/load/bytes/received/1min":
-		key = "LoadBytesReceived1min"
-	case "$SYS/broker/load/bytes/received/5min":
-		key = "LoadBytesReceived5min"
-	case "$SYS/broker/load/bytes/received/15min":
-		key = "LoadBytesReceived15min"
-
-	case "$SYS/broker/load/sockets/1min":
-		key = "LoadSockets1min"
-	case "$SYS/broker/load/sockets/5min":
-		key = "LoadSockets5min"
-	case "$SYS/broker/load/sockets/15min":
-		key = "LoadSockets15min"
-
-	case "$SYS/broker/load/connections/1min":
-		key = "LoadConnections1min"
-	case "$SYS/broker/load/connections/5min":
-		key = "LoadConnections5min"
-	case "$SYS/broker/load/connections/15min":
-		key = "LoadConnections15min"
-
-	case "$SYS/broker/load/publish/received/1min":
-		key = "LoadPublishReceived1min"
-	case "$SYS/broker/load/publish/received/5min":
-		key = "LoadPublishReceived5min"
-	case "$SYS/broker/load/publish/received/15min":
-		key = "LoadPublishReceived15min"
-
-	case "$SYS/broker/load/publish/sent/1min":
-		key = "LoadPublishSent1min"
-	case "$SYS/broker/load/publish/sent/5min":
-		key = "LoadPublishSent5min"
-	case "$SYS/broker/load/publish/sent/15min":
-		key = "LoadPublishSent15min"
-
-	case "$SYS/broker/load/publish/dropped/1min":
-		key = "LoadPublishDropped1min"
-	case "$SYS/broker/load/publish/dropped/5min":
-		key = "LoadPublishDropped5min"
-	case "$SYS/broker/load/publish/dropped/15min":
-		key = "LoadPublishDropped15min"
+	AddBrokerStat(0, topic, data)
+}
+
+// AddBrokerStat is AddStat for one of the brokers passed to PrepViewer
+func AddBrokerStat(broker int, topic string, data string) {
+	mqttDataLock.RLock()
+	done := stopped
+	mqttDataLock.RUnlock()
+
+	select {
+	case mqInbound <- statMsg{broker, topic, data}:
+	case <-done:
 	}
+}
+
+// stopCollecting lets AddBrokerStat drop the messages nobody will read
+func stopCollecting() {
+	mqttDataLock.Lock()
+	defer mqttDataLock.Unlock()
 
-	if key != "" {
-		msg[0] = key
-		msg[1] = data
-		mqInbound <- msg
+	select {
+	case <-stopped:
+	default:
+		close(stopped)
 	}
 }
 
-func handleEvents(eventChan chan termbox.Event, quit chan bool) {
-loop:
-	for {
-		ev := <-eventChan
-		switch ev.Type {
-		case termbox.EventKey:
-			switch ev.Key {
+// handleEvent acts on a key the user pressed, it returns true when the
+// user quits.  Any key closes the help.
+func handleEvent(ev termbox.Event) bool {
+	if ev.Type == termbox.EventError {
+		panic(ev.Err)
+	}
+	if ev.Type != termbox.EventKey {
+		return false
+	}
+	if showHelp {
+		showHelp = false
+		return false
+	}
 
-			case termbox.KeyEsc, termbox.KeyCtrlQ, termbox.KeyCtrlC:
-				quit <- true
-				break loop
+	count := len(brokers)
+	page := h - bodyTop - 1
+	if page < 1 {
+		page = 1
+	}
+	switch ev.Key {
+	case termbox.KeyEsc, termbox.KeyCtrlQ, termbox.KeyCtrlC:
+		return true
+	case termbox.KeyTab, termbox.KeyArrowRight:
+		selectBroker((selected + 1) % count)
+	case termbox.KeyArrowLeft:
+		selectBroker((selected + count - 1) % count)
+	case termbox.KeyArrowUp:
+		scrollBy(-1)
+	case termbox.KeyArrowDown:
+		scrollBy(1)
+	case termbox.KeyPgup:
+		scrollBy(-page)
+	case termbox.KeyPgdn:
+		scrollBy(page)
+	case termbox.KeyHome:
+		scroll = 0
+	case termbox.KeyEnd:
+		scrollBy(contentBottom)
+	default:
+		switch {
+		case ev.Ch == 'q' || ev.Ch == 'Q':
+			return true
+		case ev.Ch == '?':
+			showHelp = true
+		case ev.Ch == 'p' || ev.Ch == 'P':
+			setPaused(!paused)
+		case ev.Ch == 'r' || ev.Ch == 'R':
+			mqttDataLock.Lock()
+			brokers[selected].startTime = time.Now()
+			mqttDataLock.Unlock()
+		case ev.Ch >= '1' && ev.Ch <= '9' && int(ev.Ch-'1') < count:
+			selectBroker(int(ev.Ch - '1'))
+		}
+	}
+	return false
+}
 
-			default:
-				if ev.Ch == 'q' || ev.Ch == 'Q' {
-					quit <- true
-					break loop
-				}
-			}
-		case termbox.EventError:
-			panic(ev.Err)
+// setPaused pauses or resumes the updates of the UI
+func setPaused(pause bool) {
+	paused = pause
+	frozen = nil
+	if pause {
+		frozenAt = time.Now()
+		for _, b := range brokers {
+			frozen = append(frozen, b.clone())
 		}
 	}
 }
+
+// shownBrokers are the brokers as the UI draws them
+func shownBrokers() []*brokerStats {
+	if paused {
+		return frozen
+	}
+	return brokers
+}
+
+// displayTime is the time the UI is drawn at
+func displayTime() time.Time {
+	if paused {
+		return frozenAt
+	}
+	return time.Now()
+}
+
+// clone copies the stats of a broker so it does not change as more arrive
+func (b *brokerStats) clone() *brokerStats {
+	c := *b
+	c.mqttData = make(dataHash, len(b.mqttData))
+	for k, v := range b.mqttData {
+		c.mqttData[k] = v
+	}
+	c.histories = make(map[string]*series, len(b.histories))
+	for k, s := range b.histories {
+		c.histories[k] = &series{samples: append([]sample{}, s.samples...)}
+	}
+	c.raw = make(map[string]string, len(b.raw))
+	for k, v := range b.raw {
+		c.raw[k] = v
+	}
+	c.topics = make(map[string]string, len(b.topics))
+	for k, v := range b.topics {
+		c.topics[k] = v
+	}
+	c.history.outages = append([]Outage{}, b.history.outages...)
+	return &c
+}
+
+func selectBroker(broker int) {
+	if broker != selected {
+		selected = broker
+		scroll = 0
+	}
+}
+
+// scrollBy scrolls the panels, but not past the last line drawn
+func scrollBy(lines int) {
+	scroll += lines
+	if max := contentBottom - h; scroll > max {
+		scroll = max
+	}
+	if scroll < 0 {
+		scroll = 0
+	}
+}
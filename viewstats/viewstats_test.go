@@ -0,0 +1,172 @@
+package viewstats
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsf/termbox-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func key(k termbox.Key) termbox.Event {
+	return termbox.Event{Type: termbox.EventKey, Key: k}
+}
+
+func char(c rune) termbox.Event {
+	return termbox.Event{Type: termbox.EventKey, Ch: c}
+}
+
+func TestHandleEvent(t *testing.T) {
+	defer func() { h, bodyTop, contentBottom = 0, 0, 0 }()
+	PrepViewer("one", "two", "three")
+	h, bodyTop, contentBottom = 20, 3, 50
+
+	// switching brokers
+	assert.False(t, handleEvent(key(termbox.KeyTab)))
+	assert.Equal(t, 1, selected)
+	assert.False(t, handleEvent(key(termbox.KeyArrowLeft)))
+	assert.False(t, handleEvent(key(termbox.KeyArrowLeft)))
+	assert.Equal(t, 2, selected)
+	assert.False(t, handleEvent(char('1')))
+	assert.Equal(t, 0, selected)
+	assert.False(t, handleEvent(char('4')))
+	assert.Equal(t, 0, selected)
+
+	// scrolling stops at the top and at the last line
+	assert.False(t, handleEvent(key(termbox.KeyArrowUp)))
+	assert.Equal(t, 0, scroll)
+	handleEvent(key(termbox.KeyArrowDown))
+	assert.Equal(t, 1, scroll)
+	handleEvent(key(termbox.KeyPgdn))
+	assert.Equal(t, 17, scroll)
+	handleEvent(key(termbox.KeyPgdn))
+	assert.Equal(t, 30, scroll)
+	handleEvent(key(termbox.KeyPgup))
+	assert.Equal(t, 14, scroll)
+	handleEvent(key(termbox.KeyHome))
+	assert.Equal(t, 0, scroll)
+	handleEvent(key(termbox.KeyEnd))
+	assert.Equal(t, 30, scroll)
+
+	// another broker starts at the top
+	handleEvent(key(termbox.KeyArrowRight))
+	assert.Equal(t, 0, scroll)
+
+	handleEvent(char('p'))
+	assert.True(t, paused)
+	assert.Equal(t, "PAUSED [P] to resume  [?] help", headerKeys())
+	handleEvent(char('P'))
+	assert.False(t, paused)
+
+	brokers[1].startTime = time.Now().Add(-time.Hour)
+	handleEvent(char('r'))
+	assert.WithinDuration(t, time.Now(), brokers[1].startTime, time.Second)
+
+	// any key closes the help, even q
+	handleEvent(char('?'))
+	assert.True(t, showHelp)
+	assert.False(t, handleEvent(char('q')))
+	assert.False(t, showHelp)
+
+	assert.True(t, handleEvent(char('q')))
+	assert.True(t, handleEvent(key(termbox.KeyEsc)))
+	assert.False(t, handleEvent(termbox.Event{Type: termbox.EventResize}))
+}
+
+func TestDrawHelp(t *testing.T) {
+	var lines []string
+	var xs, ys []int
+	f := func(x, y int, str string) {
+		lines = append(lines, str)
+		xs = append(xs, x)
+		ys = append(ys, y)
+	}
+
+	drawHelp(f, 80, 24)
+	assert.Len(t, lines, len(helpLines)+2)
+	assert.Equal(t, strings.Repeat(" ", 43), lines[0])
+	assert.Equal(t, "  Keys"+strings.Repeat(" ", 37), lines[1])
+	assert.Equal(t, "  P           pause or resume updates      ", lines[9])
+	assert.Equal(t, 18, xs[0])
+	assert.Equal(t, 4, ys[0])
+
+	// a small screen shows what fits from the top left
+	xs, ys = nil, nil
+	drawHelp(f, 20, 5)
+	assert.Equal(t, 0, xs[0])
+	assert.Equal(t, 0, ys[0])
+}
+
+func TestDrawStacked(t *testing.T) {
+	defer func() { layout = DefaultLayout }()
+	assert.NoError(t, SetLayout(Layout{
+		Columns: 2,
+		Panels: []Panel{
+			{Title: "One", Stats: []string{"clients_connected", "clients_total"}, Column: 1},
+			{Title: "Two", Stats: []string{"version"}, Column: 2},
+			{Title: "Wide", Stats: []string{"uptime_seconds"}},
+		},
+	}))
+
+	PrepViewer()
+	// side by side
+	assert.Equal(t, 9, drawLayout(brokers[0], 2, 80, 100))
+	// one above the other
+	assert.Equal(t, 12, drawLayout(brokers[0], 2, 79, 100))
+}
+
+func TestAddBrokerStatAfterStop(t *testing.T) {
+	PrepViewer()
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		CollectStats(make(chan ConnectHandler), done)
+		close(finished)
+	}()
+
+	AddStat("$SYS/broker/version", "mosquitto 1.4")
+	close(done)
+	<-finished
+
+	// more than fit in the channel, none of them may block
+	for i := 0; i < 2*cap(mqInbound); i++ {
+		AddStat("$SYS/broker/uptime", strconv.Itoa(i))
+	}
+
+	PrepViewer()
+	assert.Zero(t, len(mqInbound))
+}
+
+func TestPausedDisplay(t *testing.T) {
+	PrepViewer()
+	storeStat(statMsg{0, "$SYS/broker/clients/connected", "3"})
+	storeConnection(ConnectHandler{IsConnected: true})
+
+	var lines []string
+	f := func(x, y int, str string) { lines = append(lines, str) }
+	draw := func() []string {
+		lines = nil
+		b := shownBrokers()[0]
+		drawConnection(f, b, 0, 0, 60, displayTime())
+		return append(lines, b.mqttData.get("Clients Connected"))
+	}
+
+	handleEvent(char('p'))
+	before := draw()
+	assert.Equal(t, "3", before[len(before)-1])
+
+	// what arrives while paused is stored but not shown
+	time.Sleep(10 * time.Millisecond)
+	storeStat(statMsg{0, "$SYS/broker/clients/connected", "7"})
+	storeConnection(ConnectHandler{IsConnected: false, Err: errors.New("EOF")})
+	assert.Equal(t, before, draw())
+	assert.Equal(t, "7", GetStat(0, "Clients Connected"))
+
+	handleEvent(char('p'))
+	after := draw()
+	assert.Equal(t, "7", after[len(after)-1])
+	assert.NotEqual(t, before, after)
+}
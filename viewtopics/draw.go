@@ -0,0 +1,164 @@
+package viewtopics
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nsf/termbox-go"
+)
+
+const timePrint = "15:04:05"
+
+type termWriter func(x, y int, str string)
+
+func stdWriter(x, y int, str string) {
+	for i, c := range []rune(str) {
+		termbox.SetCell(x+i, y, c, coldef, coldef)
+	}
+}
+
+func reverseWriter(x, y int, str string) {
+	for i, c := range []rune(str) {
+		termbox.SetCell(x+i, y, c, coldef|termbox.AttrReverse, coldef)
+	}
+}
+
+func (ex *explorer) redraw() {
+	termbox.Clear(coldef, coldef)
+	w, h := termbox.Size()
+	now := time.Now()
+
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	drawHeader(stdWriter, 0, 0, w, tree.topics, tree.messages, ex.conData.IsConnected)
+
+	treeWidth := w * 55 / 100
+	height := h - 2
+	rows, selected := ex.current()
+	ex.scroll(selected, height)
+
+	for i := ex.offset; i < len(rows) && i-ex.offset < height; i++ {
+		writer := stdWriter
+		if i == selected {
+			writer = reverseWriter
+		}
+		writer(0, i-ex.offset+2, treeLine(rows[i], treeWidth-1, now))
+	}
+
+	if len(rows) > 0 {
+		for i, line := range detailLines(rows[selected].node, ex.format, now) {
+			if i >= height {
+				break
+			}
+			stdWriter(treeWidth+1, i+2, clip(line, w-treeWidth-1))
+		}
+	}
+
+	termbox.HideCursor()
+	termbox.Flush()
+}
+
+// scroll keeps the selected row inside the visible part of the tree
+func (ex *explorer) scroll(selected int, height int) {
+	if selected < ex.offset {
+		ex.offset = selected
+	}
+	if height > 0 && selected >= ex.offset+height {
+		ex.offset = selected - height + 1
+	}
+}
+
+func drawHeader(w termWriter, x, y, width int, topics int, messages int64, connected bool) int {
+	status := "Connected"
+	if !connected {
+		status = "Disconnected!!!"
+	}
+	str := fmt.Sprintf("Topics: %d  Messages: %d  %s  [arrows] move [enter] open [e/c] expand/collapse all [Q] quit",
+		topics, messages, status)
+	w(x, y, clip(str, width))
+
+	return y + 1
+}
+
+// treeLine formats a row as its indented name followed by the message
+// count, the rate and R if the topic has a retained message
+func treeLine(r row, width int, now time.Time) string {
+	node := r.node
+	marker := " "
+	if len(node.children) > 0 {
+		marker = "+"
+		if node.expanded {
+			marker = "-"
+		}
+	}
+	retained := " "
+	if node.retained {
+		retained = "R"
+	}
+
+	name := node.name
+	if name == "" {
+		name = `""`
+	}
+	label := strings.Repeat("  ", r.depth) + marker + " " + name
+
+	// when there is no room for the numbers only show the name
+	columns := fmt.Sprintf(" %7d %6.1f/s %s", node.total, node.rate.perSecond(now), retained)
+	nameWidth := width - len(columns)
+	if nameWidth < 8 {
+		return clip(label, width)
+	}
+	return fmt.Sprintf("%-*s%s", nameWidth, clip(label, nameWidth), columns)
+}
+
+// detailLines describes the node and its last payload
+func detailLines(node *topicNode, format func(string) string, now time.Time) []string {
+	lines := []string{
+		"Topic    : " + node.topic,
+		fmt.Sprintf("Messages : %d (%d including below)", node.count, node.total),
+		fmt.Sprintf("Rate     : %.1f/s", node.rate.perSecond(now)),
+	}
+	if !node.hasMessage {
+		return lines
+	}
+
+	retained := "no"
+	if node.retained {
+		retained = "yes"
+	}
+	lines = append(lines,
+		"Retained : "+retained,
+		fmt.Sprintf("Received : %s (%s ago)", node.received.Format(timePrint), now.Sub(node.received).Round(time.Second)),
+		fmt.Sprintf("Size     : %d bytes", len(node.payload)),
+		"")
+
+	var payload string
+	if utf8.Valid(node.payload) {
+		payload = string(node.payload)
+		if format != nil {
+			payload = format(payload)
+		}
+	} else {
+		payload = hex.Dump(node.payload)
+	}
+	for _, line := range strings.Split(strings.TrimRight(payload, "\n"), "\n") {
+		lines = append(lines, strings.Replace(line, "\t", "    ", -1))
+	}
+	return lines
+}
+
+// clip cuts a string to fit in width columns
+func clip(str string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	runes := []rune(str)
+	if len(runes) <= width {
+		return str
+	}
+	return string(runes[:width])
+}
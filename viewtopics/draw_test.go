@@ -0,0 +1,65 @@
+package viewtopics
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTreeLine(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tr := newTopicTree()
+	for i := 0; i < 5; i++ {
+		tr.add("home/light", []byte("on"), true, now)
+	}
+	home := tr.root.children["home"]
+	light := home.children["light"]
+
+	assert.Equal(t, "+ home                      5    0.5/s  ", treeLine(row{node: home}, 40, now))
+	home.expanded = true
+	assert.Equal(t, "- home                      5    0.5/s  ", treeLine(row{node: home}, 40, now))
+	assert.Equal(t, "    light                   5    0.5/s R", treeLine(row{node: light, depth: 1}, 40, now))
+	assert.Equal(t, "    light", treeLine(row{node: light, depth: 1}, 20, now))
+	assert.Equal(t, "    li", treeLine(row{node: light, depth: 1}, 6, now))
+}
+
+func TestDetailLines(t *testing.T) {
+	now := time.Date(2017, 10, 1, 12, 0, 10, 0, time.UTC)
+	tr := newTopicTree()
+	tr.add("home/light", []byte(`{"on":true}`), false, now.Add(-3*time.Second))
+	light := tr.root.children["home"].children["light"]
+
+	lines := detailLines(light, strings.ToUpper, now)
+	assert.Equal(t, []string{
+		"Topic    : home/light",
+		"Messages : 1 (1 including below)",
+		"Rate     : 0.1/s",
+		"Retained : no",
+		"Received : 12:00:07 (3s ago)",
+		"Size     : 11 bytes",
+		"",
+		`{"ON":TRUE}`,
+	}, lines)
+
+	assert.Equal(t, []string{
+		"Topic    : home",
+		"Messages : 0 (1 including below)",
+		"Rate     : 0.1/s",
+	}, detailLines(tr.root.children["home"], nil, now))
+
+	tr.add("bin", []byte{0xff, 0x00}, false, now)
+	lines = detailLines(tr.root.children["bin"], nil, now)
+	assert.Equal(t, "00000000  ff 00                                             |..|", lines[len(lines)-1])
+}
+
+func TestDrawHeader(t *testing.T) {
+	var output string
+	f := func(x, y int, str string) { output = str }
+
+	drawHeader(f, 0, 0, 34, 3, 12, true)
+	assert.Equal(t, "Topics: 3  Messages: 12  Connected", output)
+	drawHeader(f, 0, 0, 40, 3, 12, false)
+	assert.Equal(t, "Topics: 3  Messages: 12  Disconnected!!!", output)
+}
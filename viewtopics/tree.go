@@ -0,0 +1,177 @@
+// Copyright © 2017 Ray Johnson <ray.johnson@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package viewtopics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateWindow is how many seconds the message rate is averaged over
+const rateWindow = 10
+
+// topicNode is one level of the topic tree.  A node has a message if
+// something was published to exactly its topic.
+type topicNode struct {
+	name     string
+	topic    string
+	parent   *topicNode
+	children map[string]*topicNode
+	expanded bool
+
+	count      int64 // messages on this topic
+	total      int64 // messages on this topic and every topic below it
+	hasMessage bool
+	payload    []byte
+	received   time.Time
+	retained   bool
+	rate       rateCounter
+}
+
+// rateCounter counts messages in one second buckets
+type rateCounter struct {
+	buckets [rateWindow]int64
+	last    int64
+}
+
+func (r *rateCounter) advance(sec int64) {
+	if sec <= r.last {
+		return
+	}
+	if sec-r.last >= rateWindow {
+		r.buckets = [rateWindow]int64{}
+	} else {
+		for s := r.last + 1; s <= sec; s++ {
+			r.buckets[s%rateWindow] = 0
+		}
+	}
+	r.last = sec
+}
+
+func (r *rateCounter) add(now time.Time) {
+	sec := now.Unix()
+	r.advance(sec)
+	r.buckets[sec%rateWindow]++
+}
+
+// perSecond is the average rate over the last rateWindow seconds
+func (r *rateCounter) perSecond(now time.Time) float64 {
+	r.advance(now.Unix())
+	var sum int64
+	for _, n := range r.buckets {
+		sum += n
+	}
+	return float64(sum) / rateWindow
+}
+
+// topicTree holds every topic seen so far.  Messages are added from the
+// MQTT goroutines while the display reads it, so it has a lock.
+type topicTree struct {
+	mu       sync.Mutex
+	root     *topicNode
+	topics   int
+	messages int64
+}
+
+// row is one visible line of the tree
+type row struct {
+	node  *topicNode
+	depth int
+}
+
+func newTopicTree() *topicTree {
+	return &topicTree{root: &topicNode{children: make(map[string]*topicNode), expanded: true}}
+}
+
+func (t *topicTree) add(topic string, payload []byte, retained bool, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	node := t.root
+	node.total++
+	for _, level := range strings.Split(topic, "/") {
+		child, ok := node.children[level]
+		if !ok {
+			child = &topicNode{name: level, parent: node, children: make(map[string]*topicNode)}
+			if node == t.root {
+				child.topic = level
+			} else {
+				child.topic = node.topic + "/" + level
+			}
+			node.children[level] = child
+		}
+		node = child
+		node.total++
+		node.rate.add(now)
+	}
+
+	if !node.hasMessage {
+		node.hasMessage = true
+		t.topics++
+	}
+	t.messages++
+	node.count++
+	node.payload = payload
+	node.received = now
+	// a retained topic stays marked when later messages are delivered
+	// live, until an empty message clears it
+	if retained {
+		node.retained = true
+	} else if len(payload) == 0 {
+		node.retained = false
+	}
+}
+
+// rows returns the visible lines, children of expanded nodes sorted by
+// name.  The caller must hold the lock.
+func (t *topicTree) rows() []row {
+	var rows []row
+	var walk func(node *topicNode, depth int)
+	walk = func(node *topicNode, depth int) {
+		for _, child := range node.sortedChildren() {
+			rows = append(rows, row{node: child, depth: depth})
+			if child.expanded {
+				walk(child, depth+1)
+			}
+		}
+	}
+	walk(t.root, 0)
+	return rows
+}
+
+func (n *topicNode) sortedChildren() []*topicNode {
+	children := make([]*topicNode, 0, len(n.children))
+	for _, child := range n.children {
+		children = append(children, child)
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].name < children[j].name })
+	return children
+}
+
+// setExpanded expands or collapses a node and everything below it
+func (n *topicNode) setExpanded(expanded bool) {
+	n.expanded = expanded
+	for _, child := range n.children {
+		child.setExpanded(expanded)
+	}
+}
@@ -0,0 +1,95 @@
+package viewtopics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func rowTopics(rows []row) []string {
+	var topics []string
+	for _, r := range rows {
+		topics = append(topics, r.node.topic)
+	}
+	return topics
+}
+
+func TestTopicTree(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tr := newTopicTree()
+	tr.add("sensors/kitchen/temp", []byte("21"), true, now)
+	tr.add("sensors/kitchen/temp", []byte("22"), false, now)
+	tr.add("sensors/attic", []byte("on"), false, now)
+	tr.add("/leading", []byte("x"), false, now)
+
+	assert.Equal(t, 3, tr.topics)
+	assert.Equal(t, int64(4), tr.messages)
+	assert.Equal(t, []string{"", "sensors"}, rowTopics(tr.rows()))
+
+	sensors := tr.root.children["sensors"]
+	assert.Equal(t, int64(3), sensors.total)
+	assert.Equal(t, int64(0), sensors.count)
+	assert.False(t, sensors.hasMessage)
+
+	sensors.setExpanded(true)
+	assert.Equal(t, []string{"", "sensors", "sensors/attic", "sensors/kitchen", "sensors/kitchen/temp"}, rowTopics(tr.rows()))
+
+	temp := sensors.children["kitchen"].children["temp"]
+	assert.Equal(t, int64(2), temp.count)
+	assert.Equal(t, "22", string(temp.payload))
+	assert.True(t, temp.retained, "live messages keep the retained marker")
+
+	tr.add("sensors/kitchen/temp", nil, false, now)
+	assert.False(t, temp.retained, "an empty message clears the retained marker")
+}
+
+func TestRateCounter(t *testing.T) {
+	var r rateCounter
+	start := time.Unix(1000, 0)
+	for i := 0; i < 20; i++ {
+		r.add(start)
+	}
+	assert.Equal(t, 2.0, r.perSecond(start))
+	r.add(start.Add(5 * time.Second))
+	assert.Equal(t, 2.1, r.perSecond(start.Add(5*time.Second)))
+	assert.Equal(t, 0.1, r.perSecond(start.Add(10*time.Second)))
+	assert.Equal(t, 0.0, r.perSecond(start.Add(time.Minute)))
+}
+
+func TestExplorerNavigation(t *testing.T) {
+	tree = newTopicTree()
+	now := time.Now()
+	tree.add("a/b/c", []byte("1"), false, now)
+	tree.add("a/d", []byte("2"), false, now)
+	tree.add("z", []byte("3"), false, now)
+
+	ex := &explorer{}
+	_, i := ex.current()
+	assert.Equal(t, 0, i)
+	assert.Equal(t, "a", ex.selected)
+
+	ex.expand()
+	assert.Equal(t, []string{"a", "a/b", "a/d", "z"}, rowTopics(tree.rows()))
+	ex.expand()
+	assert.Equal(t, "a/b", ex.selected, "expanding an open node moves to its first child")
+	ex.move(10)
+	assert.Equal(t, "z", ex.selected)
+	ex.move(-1)
+	assert.Equal(t, "a/d", ex.selected)
+	ex.collapse()
+	assert.Equal(t, "a", ex.selected, "collapsing a leaf moves to the parent")
+	ex.collapse()
+	assert.Equal(t, []string{"a", "z"}, rowTopics(tree.rows()))
+
+	ex.selected = "a/b"
+	_, i = ex.current()
+	assert.Equal(t, 0, i)
+	assert.Equal(t, "a", ex.selected, "a hidden selection moves to the first row")
+
+	ex.offset = 0
+	ex.scroll(7, 5)
+	assert.Equal(t, 3, ex.offset)
+	ex.scroll(1, 5)
+	assert.Equal(t, 1, ex.offset)
+}
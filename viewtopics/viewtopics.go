@@ -0,0 +1,232 @@
+// Copyright © 2017 Ray Johnson <ray.johnson@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package viewtopics is a terminal UI that shows a live tree of the
+// topics seen on a subscription
+package viewtopics
+
+import (
+	"time"
+
+	"github.com/nsf/termbox-go"
+	"github.com/rayjohnson/zap/viewstats"
+)
+
+const coldef = termbox.ColorDefault
+
+var tree = newTopicTree()
+
+// explorer is the navigation state of the UI.  The selection is kept as
+// a topic so it stays put when new topics show up above it.
+type explorer struct {
+	selected string
+	offset   int
+	format   func(string) string
+	conData  viewstats.ConnectHandler
+}
+
+// AddMessage records a message in the topic tree, it is called from the
+// MQTT message handler
+func AddMessage(topic string, payload []byte, retained bool) {
+	tree.add(topic, payload, retained, time.Now())
+}
+
+// StartExplorer shows the topic tree until the user quits.  The format
+// function is used to pretty print the payload of the selected topic.
+func StartExplorer(connectionChan chan viewstats.ConnectHandler, format func(string) string) {
+	err := termbox.Init()
+	if err != nil {
+		panic(err)
+	}
+	defer termbox.Close()
+
+	termbox.SetInputMode(termbox.InputEsc)
+	ex := &explorer{format: format}
+	ex.redraw()
+
+	eventChan := make(chan termbox.Event, 16)
+	go func() {
+		for {
+			eventChan <- termbox.PollEvent()
+		}
+	}()
+
+	timer := time.Tick(time.Millisecond * 250)
+	for {
+		select {
+		case <-timer:
+		case ev := <-eventChan:
+			switch ev.Type {
+			case termbox.EventKey:
+				if !ex.handleKey(ev) {
+					return
+				}
+			case termbox.EventError:
+				panic(ev.Err)
+			}
+		case connHandler := <-connectionChan:
+			ex.conData = connHandler
+		}
+		ex.redraw()
+	}
+}
+
+// handleKey moves around the tree and returns false when it is time to quit
+func (ex *explorer) handleKey(ev termbox.Event) bool {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	switch ev.Key {
+	case termbox.KeyEsc, termbox.KeyCtrlQ, termbox.KeyCtrlC:
+		return false
+	case termbox.KeyArrowUp:
+		ex.move(-1)
+	case termbox.KeyArrowDown:
+		ex.move(1)
+	case termbox.KeyPgup:
+		ex.move(-pageSize())
+	case termbox.KeyPgdn:
+		ex.move(pageSize())
+	case termbox.KeyHome:
+		ex.move(-len(tree.rows()))
+	case termbox.KeyEnd:
+		ex.move(len(tree.rows()))
+	case termbox.KeyArrowLeft:
+		ex.collapse()
+	case termbox.KeyArrowRight:
+		ex.expand()
+	case termbox.KeyEnter, termbox.KeySpace:
+		ex.toggle()
+	}
+
+	switch ev.Ch {
+	case 'q', 'Q':
+		return false
+	case 'k':
+		ex.move(-1)
+	case 'j':
+		ex.move(1)
+	case 'h':
+		ex.collapse()
+	case 'l':
+		ex.expand()
+	case 'e':
+		for _, child := range tree.root.children {
+			child.setExpanded(true)
+		}
+	case 'c':
+		for _, child := range tree.root.children {
+			child.setExpanded(false)
+		}
+		ex.selectTopLevel()
+	}
+	return true
+}
+
+// current returns the rows and the index of the selected one, selecting
+// the first row if nothing visible is selected.  The caller must hold
+// the tree lock.
+func (ex *explorer) current() ([]row, int) {
+	rows := tree.rows()
+	for i, r := range rows {
+		if r.node.topic == ex.selected {
+			return rows, i
+		}
+	}
+	if len(rows) > 0 {
+		ex.selected = rows[0].node.topic
+	}
+	return rows, 0
+}
+
+func (ex *explorer) move(delta int) {
+	rows, i := ex.current()
+	if len(rows) == 0 {
+		return
+	}
+	i += delta
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(rows) {
+		i = len(rows) - 1
+	}
+	ex.selected = rows[i].node.topic
+}
+
+// expand opens the selected node, or moves to its first child if it is
+// already open
+func (ex *explorer) expand() {
+	rows, i := ex.current()
+	if len(rows) == 0 || len(rows[i].node.children) == 0 {
+		return
+	}
+	if rows[i].node.expanded {
+		ex.move(1)
+		return
+	}
+	rows[i].node.expanded = true
+}
+
+// collapse closes the selected node, or moves to its parent if it is
+// already closed
+func (ex *explorer) collapse() {
+	rows, i := ex.current()
+	if len(rows) == 0 {
+		return
+	}
+	node := rows[i].node
+	if node.expanded && len(node.children) > 0 {
+		node.expanded = false
+		return
+	}
+	if node.parent != tree.root {
+		ex.selected = node.parent.topic
+	}
+}
+
+func (ex *explorer) toggle() {
+	rows, i := ex.current()
+	if len(rows) == 0 || len(rows[i].node.children) == 0 {
+		return
+	}
+	rows[i].node.expanded = !rows[i].node.expanded
+}
+
+// selectTopLevel moves the selection to the top level topic it is under
+func (ex *explorer) selectTopLevel() {
+	rows, i := ex.current()
+	if len(rows) == 0 {
+		return
+	}
+	node := rows[i].node
+	for node.parent != nil && node.parent != tree.root {
+		node = node.parent
+	}
+	ex.selected = node.topic
+}
+
+func pageSize() int {
+	_, h := termbox.Size()
+	if h > 4 {
+		return h - 4
+	}
+	return 1
+}